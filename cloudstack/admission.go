@@ -0,0 +1,224 @@
+package cloudstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// AdmissionWebhookPath is where the validating admission webhook is
+	// served.
+	AdmissionWebhookPath = "/validate-service"
+)
+
+// knownServiceAnnotations are the labels and annotations read from services.
+var knownServiceAnnotations = []string{
+	lbNameLabel,
+	lbNameSuffix,
+	lbUseTargetPort,
+	lbIPFamilies,
+	lbNodeSelector,
+	lbAdditionalVIPs,
+	lbRetainIP,
+	lbCustomHealthCheck,
+	removeLBsOnDeleteLabelKey,
+	lbScheme,
+	lbSourceNetwork,
+	lbProxyProtocol,
+	lbTopologyZone,
+	lbProfile,
+	lbClass,
+}
+
+// knownServiceAnnotationPrefixes are the prefixes of per port labels and
+// annotations read from services.
+var knownServiceAnnotationPrefixes = append([]string{
+	lbCustomHealthCheckMessagePrefix,
+	lbCustomHealthCheckResponsePrefix,
+}, append(healthCheckPrefixes, poolParamPrefixes...)...)
+
+// ServeAdmissionWebhook serves the validating admission webhook for services
+// over TLS on addr until it fails.
+func ServeAdmissionWebhook(addr, certFile, keyFile string) error {
+	mux := http.NewServeMux()
+	mux.Handle(AdmissionWebhookPath, AdmissionHandler())
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	klog.Infof("Serving admission webhook on %s%s", addr, AdmissionWebhookPath)
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// AdmissionHandler handles AdmissionReview requests for services, rejecting
+// services with invalid csccm labels or annotations.
+func AdmissionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var review admissionv1beta1.AdmissionReview
+		if err = json.Unmarshal(data, &review); err != nil || review.Request == nil {
+			http.Error(w, fmt.Sprintf("invalid admission review: %v", err), http.StatusBadRequest)
+			return
+		}
+		review.Response = reviewService(review.Request)
+		review.Response.UID = review.Request.UID
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(review); err != nil {
+			klog.Errorf("Unable to write admission review response: %v", err)
+		}
+	})
+}
+
+func reviewService(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	if req.Kind.Kind != "Service" || req.Operation == admissionv1beta1.Delete {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	var service v1.Service
+	if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
+		return &admissionv1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Message: fmt.Sprintf("unable to decode service: %v", err),
+				Reason:  metav1.StatusReasonBadRequest,
+				Code:    http.StatusBadRequest,
+			},
+		}
+	}
+	errs := validateService(&service)
+	if len(errs) == 0 {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	klog.V(3).Infof("Rejecting service %s/%s: %v", req.Namespace, service.Name, errs)
+	return &admissionv1beta1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: fmt.Sprintf("invalid %s annotations: %s", ProviderName, strings.Join(errs, "; ")),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
+
+// validateService returns the problems found in the csccm labels and
+// annotations of a LoadBalancer service, using the same parsing applied when
+// the load balancer is reconciled.
+func validateService(service *v1.Service) []string {
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return nil
+	}
+	var errs []string
+	addErr := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, key := range unknownServiceAnnotations(service) {
+		errs = append(errs, fmt.Sprintf("unknown annotation %q", key))
+	}
+	_, _, err := lbRemovalFlag(service)
+	addErr(err)
+	if value, ok := getLabelOrAnnotation(service.ObjectMeta, lbRetainIP); ok {
+		if _, err = strconv.ParseBool(value); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid value for %q: %q, expected a boolean", lbRetainIP, value))
+		}
+	}
+	_, err = isInternalLB(service)
+	addErr(err)
+	_, err = proxyProtocolForService(service)
+	addErr(err)
+	_, err = vipsForService(service)
+	addErr(err)
+	_, err = nodeSelectorForService(service)
+	addErr(err)
+
+	// Named target ports are resolved from the service endpoints when the
+	// load balancer is reconciled, they may not exist yet.
+	svc := service.DeepCopy()
+	delete(svc.Labels, lbUseTargetPort)
+	delete(svc.Annotations, lbUseTargetPort)
+	ports, err := serviceToLBPorts(&loadBalancer{service: svc})
+	if err != nil {
+		return append(errs, err.Error())
+	}
+	_, customHealthCheck := getLabelOrAnnotation(service.ObjectMeta, lbCustomHealthCheck)
+	manageHealthCheck := customHealthCheck || ports.protocol == v1.ProtocolUDP
+	portNames := map[string]bool{}
+	for _, portInfo := range ports.ports {
+		portNames[portInfo.name] = true
+		_, explicit, err := explicitHealthCheck(service, ports, portInfo)
+		addErr(err)
+		_, err = poolParamsForPort(service, portInfo.name)
+		addErr(err)
+		hcProtocol := portToHCProtocol(ports, portInfo)
+		_, hasMsg := getLabelOrAnnotation(service.ObjectMeta, lbCustomHealthCheckMessagePrefix+portInfo.name)
+		if manageHealthCheck && !explicit && hcProtocol.requiresMsg && !hasMsg {
+			errs = append(errs, fmt.Sprintf("health check of port %s: type %s requires the %s%s annotation", portID(portInfo), hcProtocol.protocol, lbCustomHealthCheckMessagePrefix, portInfo.name))
+		}
+	}
+	for _, prefix := range []string{lbCustomHealthCheckMessagePrefix, lbCustomHealthCheckResponsePrefix} {
+		for _, key := range annotationKeys(service) {
+			if strings.HasPrefix(key, prefix) && !portNames[strings.TrimPrefix(key, prefix)] {
+				errs = append(errs, fmt.Sprintf("annotation %q does not match any port name", key))
+			}
+		}
+	}
+	return errs
+}
+
+// annotationKeys returns the sorted label and annotation keys of the service.
+func annotationKeys(service *v1.Service) []string {
+	var keys []string
+	for _, m := range []map[string]string{service.Labels, service.Annotations} {
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// unknownServiceAnnotations returns the csccm labels and annotations of the
+// service not read by the provider.
+func unknownServiceAnnotations(service *v1.Service) []string {
+	var unknown []string
+	for _, key := range annotationKeys(service) {
+		if !strings.HasPrefix(key, annotationPrefix) || containsString(knownServiceAnnotations, key) {
+			continue
+		}
+		if hasAnyPrefix(key, knownServiceAnnotationPrefixes) || strings.Contains(strings.TrimPrefix(key, annotationPrefix), extraParamSuffix) {
+			continue
+		}
+		unknown = append(unknown, key)
+	}
+	return unknown
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package cloudstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func Test_validateService(t *testing.T) {
+	newService := func(annotations map[string]string, ports ...corev1.ServicePort) *corev1.Service {
+		if len(ports) == 0 {
+			ports = []corev1.ServicePort{{Name: "http", Port: 80, NodePort: 30001, Protocol: corev1.ProtocolTCP}}
+		}
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "svc1",
+				Namespace:   "myns",
+				Annotations: annotations,
+			},
+			Spec: corev1.ServiceSpec{
+				Type:  corev1.ServiceTypeLoadBalancer,
+				Ports: ports,
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		service *corev1.Service
+		errs    []string
+	}{
+		{
+			name: "valid annotations",
+			service: newService(map[string]string{
+				"csccm.cloudprovider.io/remove-loadbalancers-on-delete":          "true",
+				"csccm.cloudprovider.io/loadbalancer-use-targetport":             "",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-type-http":      "HTTP",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-request-http":   "GET /",
+				"csccm.cloudprovider.io/loadbalancer-pool-maxconn-http":          "10",
+				"csccm.cloudprovider.io/assigntoloadbalancerrule-extra-param-id": "x",
+				"other.io/annotation": "any",
+			}, corev1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromString("web"), Protocol: corev1.ProtocolTCP}),
+		},
+		{
+			name: "not a load balancer",
+			service: func() *corev1.Service {
+				svc := newService(map[string]string{"csccm.cloudprovider.io/typo": "1"})
+				svc.Spec.Type = corev1.ServiceTypeClusterIP
+				return svc
+			}(),
+		},
+		{
+			name: "unknown annotation",
+			service: newService(map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healtcheck": "",
+			}),
+			errs: []string{`unknown annotation "csccm.cloudprovider.io/loadbalancer-healtcheck"`},
+		},
+		{
+			name: "invalid values",
+			service: newService(map[string]string{
+				"csccm.cloudprovider.io/remove-loadbalancers-on-delete": "yes",
+				"csccm.cloudprovider.io/loadbalancer-retain-ip":         "sure",
+				"csccm.cloudprovider.io/loadbalancer-proxy-protocol":    "v3",
+				"csccm.cloudprovider.io/loadbalancer-pool-maxconn-http": "-1",
+			}),
+			errs: []string{
+				`invalid value for "csccm.cloudprovider.io/remove-loadbalancers-on-delete": "yes", expected a boolean`,
+				`invalid value for "csccm.cloudprovider.io/loadbalancer-retain-ip": "sure", expected a boolean`,
+				`invalid value for "csccm.cloudprovider.io/loadbalancer-proxy-protocol": "v3", expected "v1" or "v2"`,
+				`invalid value for "csccm.cloudprovider.io/loadbalancer-pool-maxconn-http": "-1", expected a non-negative integer`,
+			},
+		},
+		{
+			name: "IPv6 only",
+			service: newService(map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-ip-families": "IPv6",
+			}),
+			errs: []string{`invalid value for "csccm.cloudprovider.io/loadbalancer-ip-families": "IPv6", IPv6 only load balancers are not supported`},
+		},
+		{
+			name: "health check message without port",
+			service: newService(map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-custom-healthcheck":          "",
+				"csccm.cloudprovider.io/loadbalancer-custom-healthcheck-msg-http": "GET /",
+				"csccm.cloudprovider.io/loadbalancer-custom-healthcheck-msg-htp":  "GET /",
+			}),
+			errs: []string{`annotation "csccm.cloudprovider.io/loadbalancer-custom-healthcheck-msg-htp" does not match any port name`},
+		},
+		{
+			name: "health check requiring message",
+			service: newService(map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-custom-healthcheck": "",
+			}),
+			errs: []string{`health check of port http: type HTTP requires the csccm.cloudprovider.io/loadbalancer-custom-healthcheck-msg-http annotation`},
+		},
+		{
+			name:    "invalid ports",
+			service: newService(nil, corev1.ServicePort{Port: 80, Protocol: corev1.ProtocolSCTP}),
+			errs:    []string{"unsupported load balancer protocol: SCTP"},
+		},
+		{
+			name: "invalid explicit health check",
+			service: newService(map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-type-http": "ICMP",
+			}),
+			errs: []string{`invalid health check type "ICMP" for port http, expected one of HTTP, HTTPS, TCP or UDP`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.errs, validateService(tt.service))
+		})
+	}
+}
+
+func Test_AdmissionHandler(t *testing.T) {
+	srv := httptest.NewServer(AdmissionHandler())
+	defer srv.Close()
+	review := func(svc *corev1.Service) *admissionv1beta1.AdmissionResponse {
+		raw, err := json.Marshal(svc)
+		require.NoError(t, err)
+		data, err := json.Marshal(admissionv1beta1.AdmissionReview{
+			Request: &admissionv1beta1.AdmissionRequest{
+				UID:       "uid-1",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Service"},
+				Namespace: svc.Namespace,
+				Operation: admissionv1beta1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		})
+		require.NoError(t, err)
+		rsp, err := http.Post(srv.URL, "application/json", bytes.NewReader(data))
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+		var result admissionv1beta1.AdmissionReview
+		require.NoError(t, json.NewDecoder(rsp.Body).Decode(&result))
+		require.NotNil(t, result.Response)
+		assert.Equal(t, "uid-1", string(result.Response.UID))
+		return result.Response
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+		},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{{Port: 80, NodePort: 30001, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	assert.True(t, review(svc).Allowed)
+
+	svc.Annotations = map[string]string{
+		"csccm.cloudprovider.io/remove-loadbalancers-on-delete": "yes",
+	}
+	rsp := review(svc)
+	assert.False(t, rsp.Allowed)
+	assert.Equal(t, `invalid custom-cloudstack annotations: invalid value for "csccm.cloudprovider.io/remove-loadbalancers-on-delete": "yes", expected a boolean`, rsp.Result.Message)
+
+	httpRsp, err := http.Post(srv.URL, "application/json", bytes.NewReader([]byte("{}")))
+	require.NoError(t, err)
+	httpRsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, httpRsp.StatusCode)
+}
@@ -25,11 +25,14 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/xanzy/go-cloudstack/v2/cloudstack"
 	"gopkg.in/gcfg.v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -55,6 +58,8 @@ type CSConfig struct {
 	Environment map[string]*environmentConfig `gcfg:"environment"`
 	Command     commandConfig                 `gcfg:"custom-command"`
 	CommandArgs map[string]*commandArgsConfig `gcfg:"custom-command-args"`
+	Hooks       map[string]*hookConfig        `gcfg:"hook"`
+	ExtraParams map[string]*extraParamsConfig `gcfg:"extra-params"`
 }
 
 type globalConfig struct {
@@ -66,26 +71,113 @@ type globalConfig struct {
 	InternalIPIndex    int    `gcfg:"internal-ip-index"`
 	ExternalIPIndex    int    `gcfg:"external-ip-index"`
 	UpdateLBWorkers    int    `gcfg:"update-lb-workers"`
+	MetadataURL        string `gcfg:"metadata-url"`
+	IPFamilies         string `gcfg:"ip-families"`
+
+	LBExcludeNodeSelector  string `gcfg:"lb-exclude-node-selector"`
+	LBExcludeUnschedulable bool   `gcfg:"lb-exclude-unschedulable-nodes"`
+	LBExcludeNotReady      bool   `gcfg:"lb-exclude-not-ready-nodes"`
+
+	// LBDrainDuration is how long removed members stay disabled in the load
+	// balancer before being removed, e.g. "30s". Disabled by default.
+	// Members are disabled using the update-lb-member command, which is
+	// required when this is set as GloboNetwork pools cannot disable members.
+	// The drain start is kept in the rule tags.
+	LBDrainDuration string `gcfg:"lb-drain-duration"`
+
+	// IPPoolFillInterval is how often reserved IP pools are topped up,
+	// defaults to "1m".
+	IPPoolFillInterval string `gcfg:"ip-pool-fill-interval"`
+
+	// RetainedIPTTL is how long IPs retained after their service is deleted
+	// are kept before being released, defaults to "24h".
+	RetainedIPTTL string `gcfg:"retained-ip-ttl"`
+
+	// WebhookURLs is a comma separated list of endpoints notified of load
+	// balancer lifecycle events.
+	WebhookURLs string `gcfg:"webhook-urls"`
+	// WebhookSecret signs the webhook payloads using HMAC-SHA256.
+	WebhookSecret string `gcfg:"webhook-secret"`
+	// WebhookMaxAttempts is how many times each delivery is attempted,
+	// defaults to 5.
+	WebhookMaxAttempts int `gcfg:"webhook-max-attempts"`
+
+	// LBProfiles enables CloudStackLoadBalancerProfile resources, their CRD
+	// must be installed in the cluster.
+	LBProfiles bool `gcfg:"lb-profiles"`
+
+	// LBClass is the load balancer class claimed by the provider, services of
+	// other classes are left to other implementations.
+	LBClass string `gcfg:"lb-class"`
+	// LBClassIgnoreUnset stops claiming services without a load balancer
+	// class.
+	LBClassIgnoreUnset bool `gcfg:"lb-class-ignore-unset"`
 }
 
 type environmentConfig struct {
-	APIURL          string `gcfg:"api-url"`
-	APIKey          string `gcfg:"api-key"`
-	SecretKey       string `gcfg:"secret-key"`
-	LBEnvironmentID string `gcfg:"lb-environment-id"`
-	LBDomain        string `gcfg:"lb-domain"`
-	ProjectID       string `gcfg:"project-id"`
-	SSLNoVerify     bool   `gcfg:"ssl-no-verify"`
-	RemoveLBs       bool   `gcfg:"remove-lbs-on-delete"`
+	APIURL              string `gcfg:"api-url"`
+	APIKey              string `gcfg:"api-key"`
+	SecretKey           string `gcfg:"secret-key"`
+	LBEnvironmentID     string `gcfg:"lb-environment-id"`
+	LBEnvironmentIDIPv6 string `gcfg:"lb-environment-id-ipv6"`
+	LBDomain            string `gcfg:"lb-domain"`
+	ProjectID           string `gcfg:"project-id"`
+	SSLNoVerify         bool   `gcfg:"ssl-no-verify"`
+	RemoveLBs           bool   `gcfg:"remove-lbs-on-delete"`
+	InternalNIC         string `gcfg:"internal-nic"`
+	ExternalNIC         string `gcfg:"external-nic"`
+
+	// IPPoolSize is the number of free IP addresses kept allocated and tagged
+	// in the IP pool network, new services claim IPs from the pool before
+	// allocating new ones. Claims are only serialized within the process, a
+	// single controller replica must be running, e.g. using leader election.
+	IPPoolSize      int    `gcfg:"ip-pool-size"`
+	IPPoolNetworkID string `gcfg:"ip-pool-network-id"`
+	// IPPoolProjects is a comma separated list of project IDs with reserved
+	// IP pools, defaults to the environment project-id.
+	IPPoolProjects string `gcfg:"ip-pool-projects"`
+
+	// DNSProvider manages A and AAAA records for load balancer hostnames,
+	// "rfc2136" is the only supported provider.
+	DNSProvider string `gcfg:"dns-provider"`
+	// DNSServer is the address of the server receiving dynamic updates.
+	DNSServer string `gcfg:"dns-server"`
+	// DNSZone is the zone updated, defaults to lb-domain.
+	DNSZone string `gcfg:"dns-zone"`
+	DNSTTL  int    `gcfg:"dns-ttl"`
+	// DNSTSIGKey, DNSTSIGSecret and DNSTSIGAlgorithm sign the updates,
+	// the algorithm defaults to hmac-sha256.
+	DNSTSIGKey       string `gcfg:"dns-tsig-key"`
+	DNSTSIGSecret    string `gcfg:"dns-tsig-secret"`
+	DNSTSIGAlgorithm string `gcfg:"dns-tsig-algorithm"`
+	// DNSOwnerID identifies this cluster in the TXT records marking the
+	// records it owns, defaults to "default".
+	DNSOwnerID string `gcfg:"dns-owner-id"`
 }
 
 type commandConfig struct {
 	AssociateIP    string `gcfg:"associate-ip"`
 	DisassociateIP string `gcfg:"disassociate-ip"`
+	// AssignNetworks attaches the networks of the members to the rule, e.g.
+	// GloboNetwork's assignNetworkToLBRule. Rules on VPC tiers are extended
+	// to other tiers of the same VPC through it, which requires the command
+	// to accept VPC tiers.
 	AssignNetworks string `gcfg:"assign-networks"`
 	DeleteLBRule   string `gcfg:"delete-lb-rule"`
+	UpdateLBMember string `gcfg:"update-lb-member"`
+	// UpdatePoolMember updates the weight of a member in the GloboNetwork
+	// pools of a rule when no update-lb-member command is configured,
+	// called with the rule id, the pool ids, the zone id, the
+	// virtualmachineid and the weight.
+	UpdatePoolMember string `gcfg:"update-pool-member"`
+	// Command used to enable the PROXY protocol on backends other than
+	// GloboNetwork, called with the rule id and the proxyprotocol version.
+	SetProxyProtocol string `gcfg:"set-proxy-protocol"`
 }
 
+// commandArgsConfig holds extra params sent with a command, values are
+// templates executed with commandArgsData. Params referencing .Service are not
+// sent by commands without a service, e.g. when filling the reserved IP pool.
 type commandArgsConfig struct {
 	gcfg.Idxer
 	Vals map[gcfg.Idx]*string
@@ -107,10 +199,16 @@ func (c *commandArgsConfig) ToMap() map[string]string {
 }
 
 type CSEnvironment struct {
-	client          *cloudstack.CloudStackClient
-	manager         *cloudstackManager
-	lbEnvironmentID string
-	lbDomain        string
+	client              *cloudstack.CloudStackClient
+	manager             *cloudstackManager
+	lbEnvironmentID     string
+	lbEnvironmentIDIPv6 string
+	lbDomain            string
+	internalNIC         *nicSelector
+	externalNIC         *nicSelector
+	ipPool              ipPoolConfig
+	dns                 dnsProvider
+	dnsOwnerID          string
 	// Indicates if LBs should be deleted upon service removal
 	removeLBs bool
 }
@@ -122,8 +220,45 @@ type CSCloud struct {
 	recorder      record.EventRecorder
 	updateLBQueue *updateLBNodeQueue
 	nodeRegistry  *nodeRegistry
+	metadata      *metadataClient
 	config        CSConfig
 
+	// Nodes matching this selector are never load balancer members.
+	lbExcludeSelector labels.Selector
+
+	drainDuration time.Duration
+	drains        *drainRegistry
+
+	ipPoolFillInterval time.Duration
+	// Lock used to serialize claiming and filling reserved IP pools, it does
+	// not protect pools shared by several controller replicas.
+	ipPoolLock sync.Mutex
+
+	retainedIPTTL time.Duration
+
+	// Executables run around load balancer lifecycle steps keyed by step.
+	hooks map[string]hook
+
+	// Templates of the custom-command-args params keyed by command.
+	commandArgs commandArgs
+
+	// Params services may set through extra-param annotations.
+	extraParams extraParamsAllowList
+
+	webhooks *webhookNotifier
+
+	// Load balancer profiles referenced by services.
+	profiles *profileRegistry
+
+	// VPC IDs of networks keyed by environment and network ID.
+	networkVPCs sync.Map
+	// Services of other load balancer classes already checked for load
+	// balancers left behind by the provider.
+	unclaimedChecked sync.Map
+	// Last warning recorded for persistent conditions of services, keyed by
+	// service and event reason.
+	warnings sync.Map
+
 	// Lock used to prevent parallel calls to UpdateLoadBalancer and
 	// EnsureLoadBalancer. See kubernetes/kubernetes#53462 (closed but not
 	// solved) and kubernetes/kubernetes#55336 (this last one was reverted as
@@ -173,10 +308,66 @@ func newCSCloud(cfg *CSConfig) (*CSCloud, error) {
 	cs := &CSCloud{
 		environments: make(map[string]CSEnvironment),
 		svcLock:      &serviceLock{},
+		drains:       newDrainRegistry(),
+		profiles:     newProfileRegistry(),
 		config:       *cfg,
 	}
+	if _, err := parseIPFamilies(cfg.Global.IPFamilies); err != nil {
+		return nil, fmt.Errorf("invalid ip-families config: %v", err)
+	}
+	if cfg.Global.LBExcludeNodeSelector != "" {
+		selector, err := labels.Parse(cfg.Global.LBExcludeNodeSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lb-exclude-node-selector config: %v", err)
+		}
+		cs.lbExcludeSelector = selector
+	}
+	if cfg.Global.LBDrainDuration != "" {
+		duration, err := time.ParseDuration(cfg.Global.LBDrainDuration)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid lb-drain-duration config: %q", cfg.Global.LBDrainDuration)
+		}
+		if duration > 0 && cfg.Command.UpdateLBMember == "" {
+			return nil, fmt.Errorf("lb-drain-duration config requires the update-lb-member command, members cannot be disabled through GloboNetwork pools")
+		}
+		cs.drainDuration = duration
+	}
+	cs.ipPoolFillInterval = defaultIPPoolFillInterval
+	if cfg.Global.IPPoolFillInterval != "" {
+		interval, err := time.ParseDuration(cfg.Global.IPPoolFillInterval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid ip-pool-fill-interval config: %q", cfg.Global.IPPoolFillInterval)
+		}
+		cs.ipPoolFillInterval = interval
+	}
+	cs.retainedIPTTL = defaultRetainedIPTTL
+	if cfg.Global.RetainedIPTTL != "" {
+		ttl, err := time.ParseDuration(cfg.Global.RetainedIPTTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid retained-ip-ttl config: %q", cfg.Global.RetainedIPTTL)
+		}
+		cs.retainedIPTTL = ttl
+	}
+	hooks, err := parseHooks(cfg.Hooks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hook config: %v", err)
+	}
+	cs.hooks = hooks
+	cs.commandArgs, err = parseCommandArgs(cfg.CommandArgs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid custom-command-args config: %v", err)
+	}
+	cs.extraParams = parseExtraParams(cfg.ExtraParams)
+	webhooks, err := newWebhookNotifier(cfg.Global)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook config: %v", err)
+	}
+	cs.webhooks = webhooks
 	cs.nodeRegistry = newNodeRegistry(cs)
 	cs.updateLBQueue = newServiceNodeQueue(cs)
+	if cfg.Global.MetadataURL != "" {
+		cs.metadata = newMetadataClient(cfg.Global.MetadataURL)
+	}
 
 	for k, v := range cfg.Environment {
 		if v.APIURL == "" || v.APIKey == "" || v.SecretKey == "" {
@@ -200,17 +391,43 @@ func newCSCloud(cfg *CSConfig) (*CSCloud, error) {
 				Timeout:   60 * time.Second,
 			}),
 		}
+		internalNIC, err := parseNICSelector(v.InternalNIC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid internal-nic config for environment %q: %v", k, err)
+		}
+		externalNIC, err := parseNICSelector(v.ExternalNIC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid external-nic config for environment %q: %v", k, err)
+		}
+		ipPool, err := newIPPoolConfig(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip pool config for environment %q: %v", k, err)
+		}
+		dnsProvider, err := newDNSProvider(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns config for environment %q: %v", k, err)
+		}
+		dnsOwnerID := v.DNSOwnerID
+		if dnsOwnerID == "" {
+			dnsOwnerID = defaultDNSOwnerID
+		}
 		csCli := cloudstack.NewAsyncClient(v.APIURL, v.APIKey, v.SecretKey, !v.SSLNoVerify, opts...)
 		manager, err := newCloudstackManager(csCli)
 		if err != nil {
 			return nil, err
 		}
 		cs.environments[k] = CSEnvironment{
-			lbEnvironmentID: v.LBEnvironmentID,
-			lbDomain:        v.LBDomain,
-			client:          csCli,
-			manager:         manager,
-			removeLBs:       v.RemoveLBs,
+			lbEnvironmentID:     v.LBEnvironmentID,
+			lbEnvironmentIDIPv6: v.LBEnvironmentIDIPv6,
+			lbDomain:            v.LBDomain,
+			internalNIC:         internalNIC,
+			externalNIC:         externalNIC,
+			ipPool:              ipPool,
+			dns:                 dnsProvider,
+			dnsOwnerID:          dnsOwnerID,
+			client:              csCli,
+			manager:             manager,
+			removeLBs:           v.RemoveLBs,
 		}
 	}
 
@@ -230,7 +447,20 @@ func (cs *CSCloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilde
 		<-stop
 		cancel()
 	}()
-	cs.updateLBQueue.start(ctx)
+	go cs.fillIPPools(ctx)
+	go cs.releaseRetainedIPs(ctx)
+	if !cs.config.Global.LBProfiles {
+		cs.updateLBQueue.start(ctx)
+		return
+	}
+	// Queued services are only processed once profiles are synced, their
+	// settings may change the load balancer.
+	client := dynamic.NewForConfigOrDie(clientBuilder.ConfigOrDie(ProviderName))
+	go func() {
+		if cs.watchProfiles(ctx, client) {
+			cs.updateLBQueue.start(ctx)
+		}
+	}()
 }
 
 func (cs *CSCloud) SetInformers(informerFactory informers.SharedInformerFactory) {
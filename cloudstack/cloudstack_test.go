@@ -40,6 +40,7 @@ func TestReadConfig(t *testing.T) {
  node-label = tsuru.io/pool
  node-name-label = tsuru.io/iaas-id
  environment-label = tsuru.io/datacenter
+ metadata-url = http://10.0.0.1
  
  [environment "prod"]
  api-url				= https://cloudstack.prod.url
@@ -120,6 +121,9 @@ func TestReadConfig(t *testing.T) {
 	if cfg.Global.EnvironmentLabel != "tsuru.io/datacenter" {
 		t.Errorf("incorrect environment-label: %s", cfg.Global.EnvironmentLabel)
 	}
+	if cfg.Global.MetadataURL != "http://10.0.0.1" {
+		t.Errorf("incorrect metadata-url: %s", cfg.Global.MetadataURL)
+	}
 	if cfg.Command.AssociateIP != "acquireIP" {
 		t.Errorf("incorrect associate-ip: %s", cfg.Command.AssociateIP)
 	}
@@ -238,3 +242,70 @@ func Test_newCSCloud(t *testing.T) {
 	assert.NotNil(t, csCloud.environments["env1"].manager)
 	assert.NotNil(t, csCloud.environments["env1"].client)
 }
+
+func Test_newCSCloudInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		hook        func(*CSConfig)
+		expectedErr string
+	}{
+		{
+			name: "invalid ip families",
+			hook: func(cfg *CSConfig) {
+				cfg.Global.IPFamilies = "IPv4,IPv5"
+			},
+			expectedErr: `invalid ip-families config: invalid IP family "IPv5", expected "IPv4" or "IPv6"`,
+		},
+		{
+			name: "invalid lb exclude node selector",
+			hook: func(cfg *CSConfig) {
+				cfg.Global.LBExcludeNodeSelector = "role in master"
+			},
+			expectedErr: `invalid lb-exclude-node-selector config: unable to parse requirement: found 'master' expected: '('`,
+		},
+		{
+			name: "invalid lb drain duration",
+			hook: func(cfg *CSConfig) {
+				cfg.Global.LBDrainDuration = "30"
+			},
+			expectedErr: `invalid lb-drain-duration config: "30"`,
+		},
+		{
+			name: "lb drain duration without update lb member command",
+			hook: func(cfg *CSConfig) {
+				cfg.Global.LBDrainDuration = "30s"
+			},
+			expectedErr: `lb-drain-duration config requires the update-lb-member command, members cannot be disabled through GloboNetwork pools`,
+		},
+		{
+			name: "invalid nic selector",
+			hook: func(cfg *CSConfig) {
+				cfg.Environment["env1"].InternalNIC = "network"
+			},
+			expectedErr: `invalid internal-nic config for environment "env1": invalid NIC selector requirement "network", expected key=value`,
+		},
+		{
+			name: "invalid retained ip ttl",
+			hook: func(cfg *CSConfig) {
+				cfg.Global.RetainedIPTTL = "-1h"
+			},
+			expectedErr: `invalid retained-ip-ttl config: "-1h"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &CSConfig{
+				Environment: map[string]*environmentConfig{
+					"env1": {
+						APIURL:    "http://localhost",
+						APIKey:    "a",
+						SecretKey: "b",
+					},
+				},
+			}
+			tt.hook(cfg)
+			_, err := newCSCloud(cfg)
+			assert.EqualError(t, err, tt.expectedErr)
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package cloudstack
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	v1 "k8s.io/api/core/v1"
+)
+
+const eventReasonInvalidCommandArgs = "LoadBalancerInvalidCommandArgs"
+
+// commandArgs holds the parsed custom-command-args templates keyed by
+// command and param name.
+type commandArgs map[string]map[string]commandArg
+
+type commandArg struct {
+	tmpl *template.Template
+	// usesService is set when the template references .Service, such params
+	// are skipped for commands not bound to a service, like the ones
+	// managing reserved pool IPs and releasing retained IPs.
+	usesService bool
+}
+
+// commandArgsData is the data custom-command-args templates are executed
+// with, e.g. "{{ .Service.Annotations.ticket }}" or "{{ .LBName }}". Service
+// is nil for commands not bound to a service.
+type commandArgsData struct {
+	Service     *commandArgsService
+	LBName      string
+	IP          string
+	Project     string
+	Environment string
+}
+
+type commandArgsService struct {
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+func parseCommandArgs(cfg map[string]*commandArgsConfig) (commandArgs, error) {
+	result := commandArgs{}
+	for command, args := range cfg {
+		for param, value := range args.ToMap() {
+			tmpl, err := template.New(command + "." + param).Option("missingkey=error").Parse(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template for param %q of command %q: %v", param, command, err)
+			}
+			if result[command] == nil {
+				result[command] = map[string]commandArg{}
+			}
+			result[command][param] = commandArg{
+				tmpl:        tmpl,
+				usesService: nodeUsesService(tmpl.Tree.Root),
+			}
+		}
+	}
+	return result, nil
+}
+
+// nodeUsesService returns whether the template node references the
+// .Service field.
+func nodeUsesService(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if nodeUsesService(child) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUsesService(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if nodeUsesService(cmd) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if nodeUsesService(arg) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return nodeUsesService(n.Node)
+	case *parse.FieldNode:
+		return n.Ident[0] == "Service"
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == "Service"
+	case *parse.IfNode:
+		return nodeUsesService(n.Pipe) || nodeUsesService(n.List) || nodeUsesService(n.ElseList)
+	case *parse.RangeNode:
+		return nodeUsesService(n.Pipe) || nodeUsesService(n.List) || nodeUsesService(n.ElseList)
+	case *parse.WithNode:
+		return nodeUsesService(n.Pipe) || nodeUsesService(n.List) || nodeUsesService(n.ElseList)
+	case *parse.TemplateNode:
+		return nodeUsesService(n.Pipe)
+	}
+	return false
+}
+
+// render executes the templates of the command returning the params to be
+// sent. Params referencing .Service are skipped if data has no service.
+func (c commandArgs) render(command string, data commandArgsData) (map[string]string, error) {
+	var params []string
+	for param, arg := range c[command] {
+		if arg.usesService && data.Service == nil {
+			continue
+		}
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	result := make(map[string]string, len(params))
+	for _, param := range params {
+		var buf bytes.Buffer
+		if err := c[command][param].tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("error rendering param %q of command %q: %v", param, command, err)
+		}
+		result[param] = buf.String()
+	}
+	return result, nil
+}
+
+func (pc *projectCloud) commandArgsData(service *v1.Service, lbName, ip string) commandArgsData {
+	data := commandArgsData{
+		LBName:      lbName,
+		IP:          ip,
+		Project:     pc.projectID,
+		Environment: pc.environment,
+	}
+	if service != nil {
+		data.Service = &commandArgsService{
+			Name:        service.Name,
+			Namespace:   service.Namespace,
+			Labels:      service.Labels,
+			Annotations: service.Annotations,
+		}
+	}
+	return data
+}
+
+// applyCommandArgs sets the custom-command-args of the command rendered with
+// data, render errors are reported as events on the service.
+func (pc *projectCloud) applyCommandArgs(command string, service *v1.Service, data commandArgsData, p *cloudstack.CustomServiceParams) error {
+	args, err := pc.commandArgs.render(command, data)
+	if err != nil {
+		if service != nil && pc.recorder != nil {
+			pc.recorder.Eventf(service, v1.EventTypeWarning, eventReasonInvalidCommandArgs, "%v", err)
+		}
+		return err
+	}
+	for k, v := range args {
+		p.SetParam(k, v)
+	}
+	return nil
+}
+
+// applyCommandArgs sets the custom-command-args of the command rendered for
+// the load balancer.
+func (lb *loadBalancer) applyCommandArgs(command string, p *cloudstack.CustomServiceParams) error {
+	return lb.cloud.applyCommandArgs(command, lb.service, lb.cloud.commandArgsData(lb.service, lb.name, lb.ip.address), p)
+}
@@ -0,0 +1,199 @@
+package cloudstack
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_commandArgs_render(t *testing.T) {
+	data := commandArgsData{
+		Service: &commandArgsService{
+			Name:        "svc1",
+			Namespace:   "myns",
+			Labels:      map[string]string{"team": "t1"},
+			Annotations: map[string]string{"ticket": "T-1"},
+		},
+		LBName:      "svc1.test.com",
+		IP:          "10.0.0.1",
+		Project:     "p1",
+		Environment: "env1",
+	}
+	tests := []struct {
+		config   string
+		expected map[string]string
+		err      string
+	}{
+		{
+			config: `
+[custom-command-args "cmd"]
+backend = haproxy
+`,
+			expected: map[string]string{"backend": "haproxy"},
+		},
+		{
+			config: `
+[custom-command-args "cmd"]
+owner = "{{ .Service.Labels.team }}@{{ .Service.Namespace }}/{{ .Service.Name }}"
+ticket = "{{ .Service.Annotations.ticket }}"
+target = "{{ .LBName }}:{{ .IP }}:{{ .Project }}:{{ .Environment }}"
+`,
+			expected: map[string]string{
+				"owner":  "t1@myns/svc1",
+				"ticket": "T-1",
+				"target": "svc1.test.com:10.0.0.1:p1:env1",
+			},
+		},
+		{
+			config: `
+[custom-command-args "cmd"]
+ticket = "{{ .Service.Annotations.missing }}"
+`,
+			err: `error rendering param "ticket" of command "cmd": template: cmd.ticket:1:11: executing "cmd.ticket" at <.Service.Annotations.missing>: map has no entry for key "missing"`,
+		},
+		{
+			config: `
+[custom-command-args "other"]
+backend = haproxy
+`,
+			expected: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		cfg, err := readConfig(strings.NewReader(tt.config))
+		require.NoError(t, err)
+		args, err := parseCommandArgs(cfg.CommandArgs)
+		require.NoError(t, err)
+		result, err := args.render("cmd", data)
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, result)
+	}
+
+	// Params referencing the service are skipped for commands without one.
+	cfg, err := readConfig(strings.NewReader(`
+[custom-command-args "cmd"]
+backend = haproxy
+owner = "{{ .Service.Labels.team }}"
+ticket = "{{ if .IP }}{{ $.Service.Annotations.ticket }}{{ end }}"
+target = "{{ .IP }}:{{ .Project }}"
+`))
+	require.NoError(t, err)
+	args, err := parseCommandArgs(cfg.CommandArgs)
+	require.NoError(t, err)
+	result, err := args.render("cmd", commandArgsData{IP: "10.0.0.1", Project: "p1"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"backend": "haproxy", "target": "10.0.0.1:p1"}, result)
+
+	cfg, err = readConfig(strings.NewReader(`
+[custom-command-args "cmd"]
+ticket = "{{ .Service.Annotations.ticket"
+`))
+	require.NoError(t, err)
+	_, err = parseCommandArgs(cfg.CommandArgs)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid template for param "ticket" of command "cmd"`)
+}
+
+func Test_CSCloud_commandArgs(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	argsCfg, err := readConfig(strings.NewReader(`
+[custom-command-args "associateIpAddress"]
+owner = "{{ .Service.Labels.team }}/{{ .Project }}/{{ .Environment }}"
+name = "{{ .LBName }}"
+
+[custom-command-args "deleteLoadBalancerRule"]
+ticket = "{{ .Service.Annotations.ticket }}/{{ .LBName }}/{{ .IP }}"
+
+[custom-command-args "disassociateIpAddress"]
+address = "{{ .IP }}"
+`))
+	require.NoError(t, err)
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		CommandArgs: argsCfg.CommandArgs,
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				RemoveLBs:       true,
+			},
+		},
+	}, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+				"team":              "t1",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err = cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+	findCall := func(command string) *cloudstackFake.MockAPICall {
+		for _, call := range srv.Calls {
+			if call.Command == command {
+				return &call
+			}
+		}
+		return nil
+	}
+
+	cs.updateLBQueue.start(context.Background())
+	_, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), []*corev1.Node{node})
+	cs.updateLBQueue.stopWait()
+	require.NoError(t, err)
+	call := findCall("associateIpAddress")
+	require.NotNil(t, call)
+	assert.Equal(t, "t1/11111111-2222-3333-4444-555555555555/env1", call.Params.Get("owner"))
+	assert.Equal(t, "svc1.test.com", call.Params.Get("name"))
+
+	srv.Calls = nil
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `error rendering param "ticket" of command "deleteLoadBalancerRule"`)
+	waitAnyEvent(t, `reason: 'LoadBalancerInvalidCommandArgs' error rendering param "ticket" of command "deleteLoadBalancerRule"`)
+	assert.Nil(t, findCall("deleteLoadBalancerRule"))
+
+	svc.Annotations = map[string]string{"ticket": "T-1"}
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc)
+	require.NoError(t, err)
+	call = findCall("deleteLoadBalancerRule")
+	require.NotNil(t, call)
+	assert.Equal(t, "T-1/svc1.test.com/10.0.0.1", call.Params.Get("ticket"))
+	call = findCall("disassociateIpAddress")
+	require.NotNil(t, call)
+	assert.Equal(t, "10.0.0.1", call.Params.Get("address"))
+}
@@ -0,0 +1,410 @@
+package cloudstack
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	dnsProviderRFC2136 = "rfc2136"
+
+	defaultDNSTTL     = 300
+	defaultDNSOwnerID = "default"
+
+	// dnsOwnerHeritage prefixes the TXT records marking address records
+	// as owned by a service, records without it are never changed.
+	dnsOwnerHeritage = "heritage=" + ProviderName
+
+	// dnsHostnameTag records on the rule the hostname whose records are
+	// managed.
+	dnsHostnameTag = "kubernetes_dns_hostname"
+)
+
+// dnsProvider manages the address records of load balancer hostnames.
+type dnsProvider interface {
+	// ensureRecords sets the A and AAAA records of the name to the
+	// addresses, marking them as owned by owner.
+	ensureRecords(name, owner string, addresses []string) error
+	// deleteRecords removes the A and AAAA records of the name if they are
+	// owned by owner.
+	deleteRecords(name, owner string) error
+}
+
+// DNSOwnershipError is returned when the records of a name are not owned by
+// the service.
+type DNSOwnershipError struct {
+	name  string
+	owner string
+}
+
+func (e DNSOwnershipError) Error() string {
+	if e.owner == "" {
+		return fmt.Sprintf("DNS records for %s exist and are not managed by %s", e.name, ProviderName)
+	}
+	return fmt.Sprintf("DNS records for %s are owned by %q", e.name, e.owner)
+}
+
+func newDNSProvider(env *environmentConfig) (dnsProvider, error) {
+	switch env.DNSProvider {
+	case "":
+		return nil, nil
+	case dnsProviderRFC2136:
+		return newRFC2136Provider(env)
+	}
+	return nil, fmt.Errorf("unsupported dns-provider %q, expected %q", env.DNSProvider, dnsProviderRFC2136)
+}
+
+// rfc2136Provider manages records using DNS dynamic updates, optionally
+// signed with TSIG.
+type rfc2136Provider struct {
+	server  string
+	zone    string
+	ttl     uint32
+	keyName string
+	keyAlg  string
+	client  *dns.Client
+}
+
+func newRFC2136Provider(env *environmentConfig) (*rfc2136Provider, error) {
+	if env.DNSServer == "" {
+		return nil, fmt.Errorf("dns-server is required for the %s provider", dnsProviderRFC2136)
+	}
+	server := env.DNSServer
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	zone := env.DNSZone
+	if zone == "" {
+		zone = env.LBDomain
+	}
+	if zone == "" {
+		return nil, fmt.Errorf("dns-zone is required for the %s provider", dnsProviderRFC2136)
+	}
+	p := &rfc2136Provider{
+		server: server,
+		zone:   dns.Fqdn(strings.ToLower(zone)),
+		ttl:    defaultDNSTTL,
+		client: &dns.Client{Timeout: 10 * time.Second},
+	}
+	if env.DNSTTL < 0 {
+		return nil, fmt.Errorf("invalid dns-ttl %d", env.DNSTTL)
+	}
+	if env.DNSTTL > 0 {
+		p.ttl = uint32(env.DNSTTL)
+	}
+	if env.DNSTSIGKey != "" {
+		if env.DNSTSIGSecret == "" {
+			return nil, fmt.Errorf("dns-tsig-secret is required with dns-tsig-key")
+		}
+		p.keyName = dns.Fqdn(strings.ToLower(env.DNSTSIGKey))
+		p.keyAlg = dns.HmacSHA256
+		if env.DNSTSIGAlgorithm != "" {
+			p.keyAlg = dns.Fqdn(strings.ToLower(env.DNSTSIGAlgorithm))
+		}
+		p.client.TsigSecret = map[string]string{p.keyName: env.DNSTSIGSecret}
+	}
+	return p, nil
+}
+
+// dnsRcodeError is returned when the DNS server answers with an error code.
+type dnsRcodeError struct {
+	server string
+	rcode  int
+}
+
+func (e dnsRcodeError) Error() string {
+	return fmt.Sprintf("server %s returned %s", e.server, dns.RcodeToString[e.rcode])
+}
+
+// prerequisiteFailed indicates an update was refused because the records
+// changed since they were checked.
+func (e dnsRcodeError) prerequisiteFailed() bool {
+	return e.rcode == dns.RcodeYXRrset || e.rcode == dns.RcodeNXRrset
+}
+
+func (p *rfc2136Provider) exchange(m *dns.Msg) (*dns.Msg, error) {
+	if p.keyName != "" {
+		m.SetTsig(p.keyName, p.keyAlg, 300, time.Now().Unix())
+	}
+	r, _, err := p.client.Exchange(m, p.server)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, dnsRcodeError{server: p.server, rcode: r.Rcode}
+	}
+	return r, nil
+}
+
+func (p *rfc2136Provider) query(name string, rrType uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, rrType)
+	r, err := p.exchange(m)
+	if err != nil {
+		return nil, fmt.Errorf("error querying %s %s: %v", dns.TypeToString[rrType], name, err)
+	}
+	var result []dns.RR
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == rrType && strings.EqualFold(rr.Header().Name, name) {
+			result = append(result, rr)
+		}
+	}
+	return result, nil
+}
+
+// current returns the address records of the name and the owner marked in
+// its TXT records, empty if the name has no marker.
+func (p *rfc2136Provider) current(name string) (addresses []dns.RR, owner string, err error) {
+	for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		rrs, err := p.query(name, rrType)
+		if err != nil {
+			return nil, "", err
+		}
+		addresses = append(addresses, rrs...)
+	}
+	txts, err := p.query(name, dns.TypeTXT)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, rr := range txts {
+		value := strings.Join(rr.(*dns.TXT).Txt, "")
+		if strings.HasPrefix(value, dnsOwnerHeritage+",") {
+			owner = value
+		}
+	}
+	return addresses, owner, nil
+}
+
+func (p *rfc2136Provider) fqdn(name string) (string, bool) {
+	name = dns.Fqdn(strings.ToLower(name))
+	return name, dns.IsSubDomain(p.zone, name)
+}
+
+func (p *rfc2136Provider) ensureRecords(name, owner string, addresses []string) error {
+	name, ok := p.fqdn(name)
+	if !ok {
+		klog.V(3).Infof("Skipping DNS records for %s, outside of zone %s", name, p.zone)
+		return nil
+	}
+	current, currentOwner, err := p.current(name)
+	if err != nil {
+		return err
+	}
+	if currentOwner != "" && currentOwner != owner {
+		return DNSOwnershipError{name: name, owner: currentOwner}
+	}
+	if currentOwner == "" && len(current) > 0 {
+		return DNSOwnershipError{name: name}
+	}
+
+	var wanted []dns.RR
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: p.ttl}
+		if ip.To4() != nil {
+			hdr.Rrtype = dns.TypeA
+			wanted = append(wanted, &dns.A{Hdr: hdr, A: ip.To4()})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			wanted = append(wanted, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	if currentOwner == owner && sameRecords(current, wanted) {
+		return nil
+	}
+
+	// The prerequisites make the server refuse the update if the records
+	// changed since they were checked: either the owner marker still exists
+	// or, for a new name, no address records were created meanwhile.
+	m := new(dns.Msg)
+	m.SetUpdate(p.zone)
+	if currentOwner == "" {
+		m.RRsetNotUsed(p.addressRRsets(name))
+		m.Insert([]dns.RR{p.ownerRecord(name, owner)})
+	} else {
+		m.Used([]dns.RR{p.ownerPrerequisite(name, owner)})
+	}
+	m.RemoveRRset(p.addressRRsets(name))
+	if len(wanted) > 0 {
+		m.Insert(wanted)
+	}
+	klog.V(3).Infof("Updating DNS records for %s to %v", name, addresses)
+	if _, err = p.exchange(m); err != nil {
+		if rcodeErr, ok := err.(dnsRcodeError); ok && rcodeErr.prerequisiteFailed() {
+			return DNSOwnershipError{name: name}
+		}
+		return fmt.Errorf("error updating DNS records for %s: %v", name, err)
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) deleteRecords(name, owner string) error {
+	name, ok := p.fqdn(name)
+	if !ok {
+		return nil
+	}
+	_, currentOwner, err := p.current(name)
+	if err != nil {
+		return err
+	}
+	if currentOwner != owner {
+		klog.V(3).Infof("Skipping removal of DNS records for %s not owned by %s", name, owner)
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(p.zone)
+	m.Used([]dns.RR{p.ownerPrerequisite(name, owner)})
+	m.RemoveRRset(p.addressRRsets(name))
+	m.Remove([]dns.RR{p.ownerRecord(name, owner)})
+	klog.V(3).Infof("Removing DNS records for %s", name)
+	if _, err = p.exchange(m); err != nil {
+		if rcodeErr, ok := err.(dnsRcodeError); ok && rcodeErr.prerequisiteFailed() {
+			klog.V(3).Infof("Skipping removal of DNS records for %s no longer owned by %s", name, owner)
+			return nil
+		}
+		return fmt.Errorf("error removing DNS records for %s: %v", name, err)
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) ownerRecord(name, owner string) dns.RR {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: p.ttl},
+		Txt: []string{owner},
+	}
+}
+
+// ownerPrerequisite is the owner marker as a prerequisite, which must have a
+// zero TTL.
+func (p *rfc2136Provider) ownerPrerequisite(name, owner string) dns.RR {
+	rr := p.ownerRecord(name, owner)
+	rr.Header().Ttl = 0
+	return rr
+}
+
+func (p *rfc2136Provider) addressRRsets(name string) []dns.RR {
+	return []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET}},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET}},
+	}
+}
+
+func sameRecords(current, wanted []dns.RR) bool {
+	if len(current) != len(wanted) {
+		return false
+	}
+	values := func(rrs []dns.RR) []string {
+		var result []string
+		for _, rr := range rrs {
+			switch r := rr.(type) {
+			case *dns.A:
+				result = append(result, r.A.String())
+			case *dns.AAAA:
+				result = append(result, r.AAAA.String())
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+	a, b := values(current), values(wanted)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dnsOwner returns the TXT marker value of records owned by the service.
+func dnsOwner(ownerID string, service *v1.Service) string {
+	return fmt.Sprintf("%s,owner=%s,resource=service/%s/%s", dnsOwnerHeritage, ownerID, service.Namespace, service.Name)
+}
+
+// dnsAddresses returns the addresses published for the load balancer
+// hostname: the main VIP and its IPv6 VIP. Other additional VIPs and internal
+// load balancers may have private addresses and are not published.
+func (lb *loadBalancer) dnsAddresses() []string {
+	var addresses []string
+	for _, l := range lb.withVIPs() {
+		if (l == lb || l.vip == vipIPv6) && l.ip.address != "" {
+			addresses = append(addresses, l.ip.address)
+		}
+	}
+	return addresses
+}
+
+// dnsHostnames returns the hostname of the load balancer and, if it changed,
+// the previous hostname whose records were managed.
+func (lb *loadBalancer) dnsHostnames() (hostname, previous string) {
+	hostname = lb.hostname()
+	if lb.dnsHostname != hostname {
+		previous = lb.dnsHostname
+	}
+	return hostname, previous
+}
+
+// ensureDNSRecords points the load balancer hostname to its public addresses,
+// removing the records of internal load balancers. The hostname is recorded
+// in the rule so records are removed when it changes.
+func (lb *loadBalancer) ensureDNSRecords() error {
+	env := lb.cloud.environments[lb.cloud.environment]
+	if env.dns == nil {
+		return nil
+	}
+	if lb.internal {
+		return lb.deleteDNSRecords()
+	}
+	hostname, previous := lb.dnsHostnames()
+	owner := dnsOwner(env.dnsOwnerID, lb.service)
+	if previous != "" {
+		klog.V(3).Infof("Removing DNS records of previous hostname %s of %v", previous, lb)
+		if err := env.dns.deleteRecords(previous, owner); err != nil {
+			return fmt.Errorf("error deleting DNS records of %v: %v", lb, err)
+		}
+	}
+	err := env.dns.ensureRecords(hostname, owner, lb.dnsAddresses())
+	if err != nil {
+		return fmt.Errorf("error ensuring DNS records of %v: %v", lb, err)
+	}
+	if lb.rule == nil {
+		return nil
+	}
+	if value, ok := getTag(lb.rule.Tags, dnsHostnameTag); ok && value == hostname {
+		return nil
+	}
+	if err = lb.setRuleTag(dnsHostnameTag, hostname); err != nil {
+		return fmt.Errorf("error recording DNS hostname of %v: %v", lb, err)
+	}
+	lb.dnsHostname = hostname
+	return nil
+}
+
+// deleteDNSRecords removes the records of the load balancer hostname and of
+// its previous hostname.
+func (lb *loadBalancer) deleteDNSRecords() error {
+	env := lb.cloud.environments[lb.cloud.environment]
+	if env.dns == nil {
+		return nil
+	}
+	hostname, previous := lb.dnsHostnames()
+	for _, name := range []string{hostname, previous} {
+		if name == "" {
+			continue
+		}
+		err := env.dns.deleteRecords(name, dnsOwner(env.dnsOwnerID, lb.service))
+		if err != nil {
+			return fmt.Errorf("error deleting DNS records of %v: %v", lb, err)
+		}
+	}
+	return nil
+}
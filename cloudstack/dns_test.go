@@ -0,0 +1,300 @@
+package cloudstack
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testDNSServer is an in memory DNS server accepting TSIG signed dynamic
+// updates.
+type testDNSServer struct {
+	sync.Mutex
+	records []dns.RR
+	updates int
+	// racing are added right before the next update is processed,
+	// simulating a concurrent writer.
+	racing []dns.RR
+	addr   string
+	server *dns.Server
+}
+
+const (
+	testTSIGKey    = "csccm."
+	testTSIGSecret = "c2VjcmV0c2VjcmV0"
+)
+
+func newTestDNSServer(t *testing.T) *testDNSServer {
+	s := &testDNSServer{}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s.addr = pc.LocalAddr().String()
+	started := make(chan struct{})
+	s.server = &dns.Server{
+		PacketConn:        pc,
+		Handler:           s,
+		TsigSecret:        map[string]string{testTSIGKey: testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc:     func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go s.server.ActivateAndServe()
+	<-started
+	return s
+}
+
+func (s *testDNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		m.Rcode = dns.RcodeNotAuth
+		w.WriteMsg(m)
+		return
+	}
+	switch r.Opcode {
+	case dns.OpcodeQuery:
+		for _, q := range r.Question {
+			for _, rr := range s.records {
+				if strings.EqualFold(rr.Header().Name, q.Name) && rr.Header().Rrtype == q.Qtype {
+					m.Answer = append(m.Answer, rr)
+				}
+			}
+		}
+	case dns.OpcodeUpdate:
+		s.updates++
+		s.records = append(s.records, s.racing...)
+		s.racing = nil
+		if rcode := s.checkPrerequisites(r.Answer); rcode != dns.RcodeSuccess {
+			m.Rcode = rcode
+			break
+		}
+		for _, rr := range r.Ns {
+			switch rr.Header().Class {
+			case dns.ClassANY:
+				s.remove(func(existing dns.RR) bool {
+					return strings.EqualFold(existing.Header().Name, rr.Header().Name) && existing.Header().Rrtype == rr.Header().Rrtype
+				})
+			case dns.ClassNONE:
+				target := dns.Copy(rr)
+				target.Header().Class = dns.ClassINET
+				s.remove(func(existing dns.RR) bool {
+					return dns.IsDuplicate(existing, target)
+				})
+			default:
+				s.records = append(s.records, rr)
+			}
+		}
+	}
+	tsig := r.IsTsig()
+	m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	w.WriteMsg(m)
+}
+
+// checkPrerequisites evaluates the RFC2136 prerequisites used by the
+// provider.
+func (s *testDNSServer) checkPrerequisites(prereqs []dns.RR) int {
+	for _, rr := range prereqs {
+		var found bool
+		for _, existing := range s.records {
+			if !strings.EqualFold(existing.Header().Name, rr.Header().Name) {
+				continue
+			}
+			switch rr.Header().Class {
+			case dns.ClassNONE, dns.ClassANY:
+				found = found || rr.Header().Rrtype == dns.TypeANY || existing.Header().Rrtype == rr.Header().Rrtype
+			default:
+				found = found || dns.IsDuplicate(existing, rr)
+			}
+		}
+		if rr.Header().Class == dns.ClassNONE && found {
+			return dns.RcodeYXRrset
+		}
+		if rr.Header().Class != dns.ClassNONE && !found {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// race adds the record right before the next update is processed.
+func (s *testDNSServer) race(t *testing.T, record string) {
+	rr, err := dns.NewRR(record)
+	require.NoError(t, err)
+	s.Lock()
+	defer s.Unlock()
+	s.racing = append(s.racing, rr)
+}
+
+func (s *testDNSServer) remove(match func(dns.RR) bool) {
+	var records []dns.RR
+	for _, rr := range s.records {
+		if !match(rr) {
+			records = append(records, rr)
+		}
+	}
+	s.records = records
+}
+
+func (s *testDNSServer) add(t *testing.T, record string) {
+	rr, err := dns.NewRR(record)
+	require.NoError(t, err)
+	s.Lock()
+	defer s.Unlock()
+	s.records = append(s.records, rr)
+}
+
+func (s *testDNSServer) recordsFor(name string) []string {
+	s.Lock()
+	defer s.Unlock()
+	var result []string
+	for _, rr := range s.records {
+		if strings.EqualFold(rr.Header().Name, name) {
+			result = append(result, rr.String())
+		}
+	}
+	return result
+}
+
+func Test_newDNSProvider(t *testing.T) {
+	tests := []struct {
+		env environmentConfig
+		err string
+	}{
+		{env: environmentConfig{}},
+		{env: environmentConfig{DNSProvider: "route53"}, err: `unsupported dns-provider "route53", expected "rfc2136"`},
+		{env: environmentConfig{DNSProvider: "rfc2136"}, err: "dns-server is required for the rfc2136 provider"},
+		{env: environmentConfig{DNSProvider: "rfc2136", DNSServer: "10.0.0.1"}, err: "dns-zone is required for the rfc2136 provider"},
+		{env: environmentConfig{DNSProvider: "rfc2136", DNSServer: "10.0.0.1", LBDomain: "test.com", DNSTSIGKey: "key"}, err: "dns-tsig-secret is required with dns-tsig-key"},
+		{env: environmentConfig{DNSProvider: "rfc2136", DNSServer: "10.0.0.1", LBDomain: "test.com"}},
+	}
+	for _, tt := range tests {
+		env := tt.env
+		_, err := newDNSProvider(&env)
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err)
+			continue
+		}
+		assert.NoError(t, err)
+	}
+	p, err := newRFC2136Provider(&environmentConfig{DNSServer: "10.0.0.1", LBDomain: "Test.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:53", p.server)
+	assert.Equal(t, "test.com.", p.zone)
+	assert.Equal(t, uint32(defaultDNSTTL), p.ttl)
+}
+
+func Test_CSCloud_dnsRecords(t *testing.T) {
+	dnsSrv := newTestDNSServer(t)
+	defer dnsSrv.server.Shutdown()
+	dnsSrv.add(t, "svc2.test.com. 300 IN A 192.168.0.1")
+
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				RemoveLBs:       true,
+				DNSProvider:     "rfc2136",
+				DNSServer:       dnsSrv.addr,
+				DNSTTL:          60,
+				DNSTSIGKey:      testTSIGKey,
+				DNSTSIGSecret:   testTSIGSecret,
+				DNSOwnerID:      "cluster1",
+			},
+		},
+	}, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+		},
+	}
+	newService := func(name string, annotations map[string]string) *corev1.Service {
+		svc := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "myns",
+				Labels: map[string]string{
+					"environment-label": "env1",
+				},
+				Annotations: annotations,
+			},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{
+					{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+		require.NoError(t, err)
+		return svc
+	}
+	ensure := func(svc *corev1.Service) error {
+		cs.updateLBQueue.start(context.Background())
+		defer cs.updateLBQueue.stopWait()
+		_, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), []*corev1.Node{node})
+		return err
+	}
+
+	svc1 := newService("svc1", map[string]string{
+		lbAdditionalVIPs: "internal=network:net2",
+	})
+	require.NoError(t, ensure(svc1))
+	assert.ElementsMatch(t, []string{
+		"svc1.test.com.\t60\tIN\tA\t10.0.0.1",
+		"svc1.test.com.\t60\tIN\tTXT\t\"heritage=custom-cloudstack,owner=cluster1,resource=service/myns/svc1\"",
+	}, dnsSrv.recordsFor("svc1.test.com."))
+	updates := dnsSrv.updates
+
+	require.NoError(t, ensure(svc1))
+	assert.Equal(t, updates, dnsSrv.updates)
+
+	// Records of the previous hostname are removed when it changes.
+	svc1.Annotations[lbNameLabel] = "web.test.com"
+	require.NoError(t, ensure(svc1))
+	assert.Empty(t, dnsSrv.recordsFor("svc1.test.com."))
+	assert.ElementsMatch(t, []string{
+		"web.test.com.\t60\tIN\tA\t10.0.0.1",
+		"web.test.com.\t60\tIN\tTXT\t\"heritage=custom-cloudstack,owner=cluster1,resource=service/myns/svc1\"",
+	}, dnsSrv.recordsFor("web.test.com."))
+
+	svc2 := newService("svc2", nil)
+	err := ensure(svc2)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "DNS records for svc2.test.com. exist and are not managed by custom-cloudstack")
+	assert.Equal(t, []string{"svc2.test.com.\t300\tIN\tA\t192.168.0.1"}, dnsSrv.recordsFor("svc2.test.com."))
+
+	svc3 := newService("svc3", nil)
+	dnsSrv.race(t, "svc3.test.com. 300 IN A 192.168.0.3")
+	err = ensure(svc3)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "DNS records for svc3.test.com. exist and are not managed by custom-cloudstack")
+	assert.Equal(t, []string{"svc3.test.com.\t300\tIN\tA\t192.168.0.3"}, dnsSrv.recordsFor("svc3.test.com."))
+
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc1)
+	require.NoError(t, err)
+	assert.Empty(t, dnsSrv.recordsFor("web.test.com."))
+}
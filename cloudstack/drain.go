@@ -0,0 +1,267 @@
+package cloudstack
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	"k8s.io/klog"
+)
+
+const (
+	promDrainSubsystem = "lb_drain"
+
+	// memberDrainTagPrefix prefixes the load balancer rule tags holding the
+	// time a member started draining, so draining survives restarts.
+	memberDrainTagPrefix = "kubernetes_member_drain_"
+)
+
+var (
+	drainingMembers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Subsystem: promDrainSubsystem,
+		Name:      "members",
+		Help:      "The number of load balancer members currently draining",
+	}, []string{"namespace", "service"})
+
+	drainedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promDrainSubsystem,
+		Name:      "completed_total",
+		Help:      "The number of load balancer members removed after draining",
+	}, []string{"namespace", "service"})
+
+	drainCanceledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promDrainSubsystem,
+		Name:      "canceled_total",
+		Help:      "The number of load balancer members that were back in service before draining finished",
+	}, []string{"namespace", "service"})
+)
+
+// DrainPendingError is returned when members are still draining and the load
+// balancer must be synced again after the remaining duration.
+type DrainPendingError struct {
+	remaining time.Duration
+}
+
+func (e DrainPendingError) Error() string {
+	return fmt.Sprintf("load balancer members still draining, %v remaining", e.remaining)
+}
+
+type memberKey struct {
+	ruleID string
+	vmID   string
+}
+
+type drainMember struct {
+	start     time.Time
+	namespace string
+	service   string
+}
+
+// drainRegistry keeps track of load balancer members that were disabled and
+// are waiting for the drain duration to elapse before being removed. The rule
+// tags are the source of truth, the registry only tracks the members known to
+// the metrics.
+type drainRegistry struct {
+	sync.Mutex
+	members map[memberKey]drainMember
+}
+
+func newDrainRegistry() *drainRegistry {
+	return &drainRegistry{
+		members: map[memberKey]drainMember{},
+	}
+}
+
+func (r *drainRegistry) get(ruleID, vmID string) (drainMember, bool) {
+	if r == nil {
+		return drainMember{}, false
+	}
+	r.Lock()
+	defer r.Unlock()
+	m, ok := r.members[memberKey{ruleID: ruleID, vmID: vmID}]
+	return m, ok
+}
+
+func (r *drainRegistry) add(ruleID, vmID string, m drainMember) {
+	r.Lock()
+	defer r.Unlock()
+	r.members[memberKey{ruleID: ruleID, vmID: vmID}] = m
+	drainingMembers.WithLabelValues(m.namespace, m.service).Inc()
+}
+
+func (r *drainRegistry) remove(ruleID, vmID string) (drainMember, bool) {
+	r.Lock()
+	defer r.Unlock()
+	key := memberKey{ruleID: ruleID, vmID: vmID}
+	m, ok := r.members[key]
+	if ok {
+		delete(r.members, key)
+		drainingMembers.WithLabelValues(m.namespace, m.service).Dec()
+	}
+	return m, ok
+}
+
+func (r *drainRegistry) forgetRule(ruleID string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	for key, m := range r.members {
+		if key.ruleID == ruleID {
+			delete(r.members, key)
+			drainingMembers.WithLabelValues(m.namespace, m.service).Dec()
+		}
+	}
+}
+
+func memberDrainTag(hostID string) string {
+	return memberDrainTagPrefix + hostID
+}
+
+// drainingMember returns the draining state of the member, loading it from
+// the rule tags if it started draining before a restart.
+func (lb *loadBalancer) drainingMember(hostID string) (drainMember, bool) {
+	drains := lb.cloud.drains
+	if member, ok := drains.get(lb.rule.Id, hostID); ok {
+		return member, true
+	}
+	value, ok := getTag(lb.rule.Tags, memberDrainTag(hostID))
+	if !ok {
+		return drainMember{}, false
+	}
+	start, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		klog.Warningf("Invalid drain start %q for host %v in load balancer %v, draining again: %v", value, hostID, lb, err)
+		start = time.Now()
+	}
+	member := drainMember{
+		start:     start,
+		namespace: lb.service.Namespace,
+		service:   lb.service.Name,
+	}
+	drains.add(lb.rule.Id, hostID, member)
+	return member, true
+}
+
+// drainHosts disables the hosts in the load balancer rule and returns the
+// ones whose drain duration already elapsed and can be removed. The
+// remaining duration for hosts still draining is also returned.
+func (lb *loadBalancer) drainHosts(hostIDs []string) ([]string, time.Duration, error) {
+	duration := lb.cloud.drainDuration
+	if duration == 0 {
+		return hostIDs, 0, nil
+	}
+	drains := lb.cloud.drains
+	var ready []string
+	var pending time.Duration
+	now := time.Now()
+	for _, hostID := range hostIDs {
+		member, ok := lb.drainingMember(hostID)
+		if !ok {
+			klog.V(3).Infof("Draining host %v from load balancer %v for %v", hostID, lb, duration)
+			if err := lb.setMemberEnabled(hostID, false); err != nil {
+				return nil, 0, err
+			}
+			err := lb.cloud.setResourceTags(CloudstackResourceLoadBalancer, lb.rule.Id, map[string]string{
+				memberDrainTag(hostID): now.UTC().Format(time.RFC3339),
+			})
+			if err != nil {
+				return nil, 0, err
+			}
+			member = drainMember{
+				start:     now,
+				namespace: lb.service.Namespace,
+				service:   lb.service.Name,
+			}
+			drains.add(lb.rule.Id, hostID, member)
+		}
+		remaining := duration - now.Sub(member.start)
+		if remaining <= 0 {
+			ready = append(ready, hostID)
+			continue
+		}
+		if pending == 0 || remaining < pending {
+			pending = remaining
+		}
+	}
+	return ready, pending, nil
+}
+
+// drainDone must be called after drained hosts are removed from the rule,
+// their drain tags are removed by removeMemberTags.
+func (lb *loadBalancer) drainDone(hostIDs []string) {
+	for _, hostID := range hostIDs {
+		if m, ok := lb.cloud.drains.remove(lb.rule.Id, hostID); ok {
+			drainedTotal.WithLabelValues(m.namespace, m.service).Inc()
+		}
+	}
+}
+
+// undrainHosts enables again hosts that were draining but are once again
+// wanted as load balancer members.
+func (lb *loadBalancer) undrainHosts(hostIDs []string) error {
+	for _, hostID := range hostIDs {
+		if _, ok := lb.drainingMember(hostID); !ok {
+			continue
+		}
+		klog.V(3).Infof("Canceling drain of host %v from load balancer %v", hostID, lb)
+		if err := lb.setMemberEnabled(hostID, true); err != nil {
+			return err
+		}
+		if err := lb.cloud.deleteResourceTags(CloudstackResourceLoadBalancer, lb.rule.Id, []string{memberDrainTag(hostID)}); err != nil {
+			return err
+		}
+		if m, ok := lb.cloud.drains.remove(lb.rule.Id, hostID); ok {
+			drainCanceledTotal.WithLabelValues(m.namespace, m.service).Inc()
+		}
+	}
+	return nil
+}
+
+// setMemberEnabled enables or disables a load balancer member using the
+// update-lb-member custom command, which is required to enable draining.
+func (lb *loadBalancer) setMemberEnabled(hostID string, enabled bool) error {
+	return lb.updateMember(hostID, map[string]interface{}{"enabled": enabled})
+}
+
+func (lb *loadBalancer) updateMember(hostID string, params map[string]interface{}) error {
+	command := lb.cloud.config.Command.UpdateLBMember
+	if command == "" {
+		return nil
+	}
+	client, err := lb.getClient()
+	if err != nil {
+		return err
+	}
+	p := &cloudstack.CustomServiceParams{}
+	if lb.cloud.projectID != "" {
+		p.SetParam("projectid", lb.cloud.projectID)
+	}
+	p.SetParam("id", lb.rule.Id)
+	p.SetParam("virtualmachineid", hostID)
+	for k, v := range params {
+		p.SetParam(k, v)
+	}
+	if err = lb.applyCommandArgs(command, p); err != nil {
+		return err
+	}
+	var result struct {
+		JobID string `json:"jobid"`
+	}
+	if err = client.Custom.CustomRequest(command, p, &result); err != nil {
+		return fmt.Errorf("error updating member %v of %v using cmd %q: %v", hostID, lb, command, err)
+	}
+	if result.JobID != "" {
+		if err = waitJob(client, result.JobID, nil); err != nil {
+			return fmt.Errorf("error waiting for member %v update of %v: %v", hostID, lb, err)
+		}
+	}
+	return nil
+}
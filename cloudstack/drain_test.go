@@ -0,0 +1,219 @@
+package cloudstack
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_CSCloud_drainRemovedNodes(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+			LBDrainDuration:  "200ms",
+		},
+		Command: commandConfig{
+			UpdateLBMember: "updateLBMember",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+			},
+		},
+	}, nil)
+	require.Equal(t, 200*time.Millisecond, cs.drainDuration)
+
+	node := func(name string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					"my/project-label":  "11111111-2222-3333-4444-555555555555",
+					"environment-label": "env1",
+				},
+			},
+		}
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	ensure := func(nodes ...*corev1.Node) {
+		cs.updateLBQueue.start(context.Background())
+		lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+		cs.updateLBQueue.stopWait()
+		require.NoError(t, err)
+		svc.Status.LoadBalancer = *lbStatus
+	}
+	flush := func() {
+		cs.updateLBQueue.start(context.Background())
+		cs.updateLBQueue.stopWait()
+	}
+
+	ensure(node("n1"))
+	srv.Calls = nil
+
+	ensure(node("n2"))
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listVirtualMachines", Params: url.Values{"name": []string{"n2"}}},
+		{Command: "listLoadBalancerRules"},
+		{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"lbrule-1"}}},
+		{Command: "assignToLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineids": []string{"vm2"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "updateLBMember", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineid": []string{"vm1"}, "enabled": []string{"false"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_member_drain_vm1"}}},
+		{Command: "queryAsyncJobResult"},
+	})
+	_, draining := cs.drains.get("lbrule-1", "vm1")
+	assert.True(t, draining)
+	srv.Calls = nil
+
+	// Still draining, nothing is removed.
+	flush()
+	srv.HasCalls(t, nil)
+
+	time.Sleep(250 * time.Millisecond)
+	flush()
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listLoadBalancerRules"},
+		{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"lbrule-1"}}},
+		{Command: "removeFromLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineids": []string{"vm1"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "deleteTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_member_drain_vm1"}}},
+		{Command: "queryAsyncJobResult"},
+	})
+	_, draining = cs.drains.get("lbrule-1", "vm1")
+	assert.False(t, draining)
+}
+
+func Test_CSCloud_drainCanceledWhenNodeReturns(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+			LBDrainDuration:  "1m",
+		},
+		Command: commandConfig{
+			UpdateLBMember: "updateLBMember",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+			},
+		},
+	}, nil)
+
+	lb := &loadBalancer{
+		cloud: &projectCloud{CSCloud: cs, environment: "env1"},
+		rule: &loadBalancerRule{LoadBalancerRule: &cloudstack.LoadBalancerRule{
+			Id: "lbrule-1",
+		}},
+		service: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "svc1", Namespace: "myns"}},
+	}
+
+	ready, pending, err := lb.drainHosts([]string{"vm1"})
+	require.NoError(t, err)
+	assert.Nil(t, ready)
+	assert.True(t, pending > 0 && pending <= time.Minute)
+
+	err = lb.undrainHosts([]string{"vm1", "vm2"})
+	require.NoError(t, err)
+	_, draining := cs.drains.get("lbrule-1", "vm1")
+	assert.False(t, draining)
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "updateLBMember", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineid": []string{"vm1"}, "enabled": []string{"false"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_member_drain_vm1"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "updateLBMember", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineid": []string{"vm1"}, "enabled": []string{"true"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "deleteTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_member_drain_vm1"}}},
+		{Command: "queryAsyncJobResult"},
+	})
+}
+
+func Test_CSCloud_drainStateFromRuleTags(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+			LBDrainDuration:  "1m",
+		},
+		Command: commandConfig{
+			UpdateLBMember: "updateLBMember",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+			},
+		},
+	}, nil)
+
+	// Members drained before a restart are only known from the rule tags.
+	lb := &loadBalancer{
+		cloud: &projectCloud{CSCloud: cs, environment: "env1"},
+		rule: &loadBalancerRule{LoadBalancerRule: &cloudstack.LoadBalancerRule{
+			Id: "lbrule-1",
+			Tags: []cloudstack.Tags{
+				{Key: "kubernetes_member_drain_vm1", Value: time.Now().Add(-2 * time.Minute).UTC().Format(time.RFC3339)},
+				{Key: "kubernetes_member_drain_vm2", Value: time.Now().UTC().Format(time.RFC3339)},
+			},
+		}},
+		service: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "svc1", Namespace: "myns"}},
+	}
+
+	ready, pending, err := lb.drainHosts([]string{"vm1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vm1"}, ready)
+	assert.Equal(t, time.Duration(0), pending)
+
+	err = lb.undrainHosts([]string{"vm2"})
+	require.NoError(t, err)
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "updateLBMember", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineid": []string{"vm2"}, "enabled": []string{"true"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "deleteTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_member_drain_vm2"}}},
+		{Command: "queryAsyncJobResult"},
+	})
+}
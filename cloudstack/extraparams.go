@@ -0,0 +1,117 @@
+package cloudstack
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	annotationPrefix = "csccm.cloudprovider.io/"
+	extraParamSuffix = "-extra-param-"
+
+	eventReasonExtraParamNotAllowed = "LoadBalancerExtraParamNotAllowed"
+)
+
+// unrestrictedExtraParamCommands accept any extra param unless an allow-list
+// is configured for them, other commands only accept allowed params.
+var unrestrictedExtraParamCommands = []string{"associateIpAddress", "createLoadBalancerRule"}
+
+// extraParamsConfig restricts the params services may set on a command
+// through extra-param labels and annotations.
+type extraParamsConfig struct {
+	// Allowed is a comma separated list of param names, "*" allows any
+	// param.
+	Allowed string `gcfg:"allowed"`
+}
+
+// extraParamsAllowList holds the allowed params keyed by command.
+type extraParamsAllowList map[string]map[string]bool
+
+func parseExtraParams(cfg map[string]*extraParamsConfig) extraParamsAllowList {
+	result := extraParamsAllowList{}
+	for command, c := range cfg {
+		allowed := map[string]bool{}
+		if c != nil {
+			for _, param := range strings.Split(c.Allowed, ",") {
+				if param = strings.TrimSpace(param); param != "" {
+					allowed[param] = true
+				}
+			}
+		}
+		result[command] = allowed
+	}
+	return result
+}
+
+func (a extraParamsAllowList) allowed(command, param string) bool {
+	params, ok := a[command]
+	if !ok {
+		return containsString(unrestrictedExtraParamCommands, command)
+	}
+	return params["*"] || params[param]
+}
+
+// commandExtraParamPrefix returns the prefix of the labels and annotations
+// setting extra params on the command, e.g.
+// csccm.cloudprovider.io/assigntoloadbalancerrule-extra-param-<param>.
+func commandExtraParamPrefix(command string) string {
+	switch command {
+	case "associateIpAddress":
+		return associateIPAddressExtraParamPrefix
+	case "createLoadBalancerRule":
+		return createLoadBalancerExtraParamPrefix
+	case "createLoadBalancer":
+		return createInternalLoadBalancerExtraParamPrefix
+	}
+	return annotationPrefix + strings.ToLower(command) + extraParamSuffix
+}
+
+// newCommandParams returns the params of the command with the extra params
+// of the service set, callers set their own params on the result so extra
+// params never override them.
+func (pc *projectCloud) newCommandParams(command string, service *v1.Service) *cloudstack.CustomServiceParams {
+	params := &cloudstack.CustomServiceParams{}
+	pc.setExtraParams(command, service, params)
+	return params
+}
+
+// setExtraParams sets the params of the command from the service labels and
+// annotations, labels take precedence. Params not allowed by the config are
+// ignored and reported as events. Only associateIpAddress and
+// createLoadBalancerRule set them after their own params, services have
+// always been able to override those, e.g. to allocate the IP in another
+// network.
+func (pc *projectCloud) setExtraParams(command string, service *v1.Service, params *cloudstack.CustomServiceParams) {
+	if service == nil {
+		return
+	}
+	prefix := commandExtraParamPrefix(command)
+	values := map[string]string{}
+	for _, m := range []map[string]string{service.Annotations, service.Labels} {
+		for key, value := range m {
+			if strings.HasPrefix(key, prefix) {
+				values[strings.TrimPrefix(key, prefix)] = value
+			}
+		}
+	}
+	var denied []string
+	for param, value := range values {
+		if !pc.extraParams.allowed(command, param) {
+			denied = append(denied, param)
+			continue
+		}
+		params.SetParam(param, value)
+	}
+	if len(denied) == 0 {
+		return
+	}
+	sort.Strings(denied)
+	klog.Warningf("Ignoring extra params %v of %s for service %s/%s: not allowed", denied, command, service.Namespace, service.Name)
+	if pc.recorder != nil {
+		pc.recorder.Eventf(service, v1.EventTypeWarning, eventReasonExtraParamNotAllowed, "Ignoring extra params %s of %s: not allowed", strings.Join(denied, ", "), command)
+	}
+}
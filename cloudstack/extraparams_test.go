@@ -0,0 +1,157 @@
+package cloudstack
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_extraParamsAllowList_allowed(t *testing.T) {
+	cfg, err := readConfig(strings.NewReader(`
+[extra-params "assignToLoadBalancerRule"]
+allowed = owner, ticket
+
+[extra-params "updateGloboNetworkPool"]
+allowed = *
+
+[extra-params "associateIpAddress"]
+allowed = owner
+`))
+	require.NoError(t, err)
+	allowList := parseExtraParams(cfg.ExtraParams)
+	tests := []struct {
+		command string
+		param   string
+		allowed bool
+	}{
+		{command: "assignToLoadBalancerRule", param: "owner", allowed: true},
+		{command: "assignToLoadBalancerRule", param: "ticket", allowed: true},
+		{command: "assignToLoadBalancerRule", param: "id", allowed: false},
+		{command: "updateGloboNetworkPool", param: "anything", allowed: true},
+		{command: "associateIpAddress", param: "owner", allowed: true},
+		{command: "associateIpAddress", param: "networkid", allowed: false},
+		{command: "createLoadBalancerRule", param: "dsr", allowed: true},
+		{command: "createLoadBalancer", param: "dsr", allowed: false},
+		{command: "disassociateIpAddress", param: "owner", allowed: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, allowList.allowed(tt.command, tt.param), "%s %s", tt.command, tt.param)
+	}
+}
+
+func Test_commandExtraParamPrefix(t *testing.T) {
+	assert.Equal(t, "csccm.cloudprovider.io/associateipaddress-extra-param-", commandExtraParamPrefix("associateIpAddress"))
+	assert.Equal(t, "csccm.cloudprovider.io/createloadbalancer-extra-param-", commandExtraParamPrefix("createLoadBalancerRule"))
+	assert.Equal(t, "csccm.cloudprovider.io/createinternalloadbalancer-extra-param-", commandExtraParamPrefix("createLoadBalancer"))
+	assert.Equal(t, "csccm.cloudprovider.io/assigntoloadbalancerrule-extra-param-", commandExtraParamPrefix("assignToLoadBalancerRule"))
+}
+
+func Test_CSCloud_extraParams(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	extraCfg, err := readConfig(strings.NewReader(`
+[extra-params "assignToLoadBalancerRule"]
+allowed = owner
+
+[extra-params "deleteLoadBalancerRule"]
+allowed = ticket
+
+[extra-params "updateLoadBalancerRule"]
+allowed = id
+`))
+	require.NoError(t, err)
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		ExtraParams: extraCfg.ExtraParams,
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				RemoveLBs:       true,
+			},
+		},
+	}, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{
+				"csccm.cloudprovider.io/assigntoloadbalancerrule-extra-param-owner":   "t1",
+				"csccm.cloudprovider.io/assigntoloadbalancerrule-extra-param-id":      "other-rule",
+				"csccm.cloudprovider.io/createloadbalancer-extra-param-dsr":           "true",
+				"csccm.cloudprovider.io/updateloadbalancerrule-extra-param-id":        "other-rule",
+				"csccm.cloudprovider.io/deleteloadbalancerrule-extra-param-ticket":    "T-1",
+				"csccm.cloudprovider.io/disassociateipaddress-extra-param-forced":     "true",
+				"csccm.cloudprovider.io/updateloadbalancerrule-extra-param-algorithm": "leastconn",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err = cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+	findCall := func(command string) cloudstackFake.MockAPICall {
+		for _, call := range srv.Calls {
+			if call.Command == command {
+				return call
+			}
+		}
+		t.Fatalf("call %q not found", command)
+		return cloudstackFake.MockAPICall{}
+	}
+
+	cs.updateLBQueue.start(context.Background())
+	_, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), []*corev1.Node{node})
+	cs.updateLBQueue.stopWait()
+	require.NoError(t, err)
+	assert.Equal(t, "true", findCall("createLoadBalancerRule").Params.Get("dsr"))
+	assign := findCall("assignToLoadBalancerRule")
+	assert.Equal(t, "t1", assign.Params.Get("owner"))
+	assert.Equal(t, "lbrule-1", assign.Params.Get("id"))
+	waitAnyEvent(t, `reason: 'LoadBalancerExtraParamNotAllowed' Ignoring extra params id of assignToLoadBalancerRule: not allowed`)
+
+	srv.Calls = nil
+	svc.Spec.SessionAffinity = corev1.ServiceAffinityClientIP
+	cs.updateLBQueue.start(context.Background())
+	_, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), []*corev1.Node{node})
+	cs.updateLBQueue.stopWait()
+	require.NoError(t, err)
+	update := findCall("updateLoadBalancerRule")
+	assert.Equal(t, "source", update.Params.Get("algorithm"))
+	assert.Equal(t, "lbrule-1", update.Params.Get("id"))
+	waitAnyEvent(t, `reason: 'LoadBalancerExtraParamNotAllowed' Ignoring extra params algorithm of updateLoadBalancerRule: not allowed`)
+
+	srv.Calls = nil
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc)
+	require.NoError(t, err)
+	assert.Equal(t, "T-1", findCall("deleteLoadBalancerRule").Params.Get("ticket"))
+	assert.Equal(t, "", findCall("disassociateIpAddress").Params.Get("forced"))
+	waitAnyEvent(t, `reason: 'LoadBalancerExtraParamNotAllowed' Ignoring extra params forced of disassociateIpAddress: not allowed`)
+}
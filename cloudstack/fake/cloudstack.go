@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -41,6 +42,13 @@ type globoNetworkPool struct {
 	HealthCheckType     string `json:"healthchecktype"`
 	HealthCheck         string `json:"healthcheck"`
 	HealthCheckExpected string `json:"healthcheckexpect"`
+	HealthCheckInterval int    `json:"healthcheckinterval"`
+	HealthCheckTimeout  int    `json:"healthchecktimeout"`
+	ProxyProtocol       string `json:"proxyprotocol"`
+	MaxConn             int    `json:"maxconn"`
+	L4Protocol          string `json:"l4protocol"`
+	L7Protocol          string `json:"l7protocol"`
+	ServiceDownAction   string `json:"servicedownaction"`
 	Id                  int    `json:"id"`
 }
 
@@ -54,6 +62,10 @@ type CloudstackServer struct {
 	lbRules map[string]*LoadBalancerRule
 	ips     map[string]*cloudstack.PublicIpAddress
 	vms     map[string][]*cloudstack.VirtualMachine
+
+	internalLBs        map[string]map[string]interface{}
+	ipv6LBEnvironments map[string]struct{}
+	vmZones            map[string]string
 }
 
 func NewCloudstackServer() *CloudstackServer {
@@ -64,6 +76,10 @@ func NewCloudstackServer() *CloudstackServer {
 		tags:    make(map[string][]cloudstack.Tags),
 		ips:     make(map[string]*cloudstack.PublicIpAddress),
 		vms:     make(map[string][]*cloudstack.VirtualMachine),
+
+		internalLBs:        make(map[string]map[string]interface{}),
+		ipv6LBEnvironments: make(map[string]struct{}),
+		vmZones:            make(map[string]string),
 	}
 	cloudstackSrv.Server = httptest.NewServer(cloudstackSrv)
 	return cloudstackSrv
@@ -87,6 +103,17 @@ func (s *CloudstackServer) AddIP(ip cloudstack.PublicIpAddress) {
 	s.ips[ip.Id] = &ip
 }
 
+// SetIPv6LBEnvironment makes IP addresses associated with the lb environment
+// ID to be IPv6 addresses.
+func (s *CloudstackServer) SetIPv6LBEnvironment(lbEnvironmentID string) {
+	s.ipv6LBEnvironments[lbEnvironmentID] = struct{}{}
+}
+
+// SetVMZone sets the zone reported for the virtual machine with the name.
+func (s *CloudstackServer) SetVMZone(vmName, zoneID string) {
+	s.vmZones[vmName] = zoneID
+}
+
 func (s *CloudstackServer) AddLBRule(lbName string, lbRule LoadBalancerRule) {
 	s.lbRules[lbName] = &lbRule
 }
@@ -185,10 +212,11 @@ func (s *CloudstackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"count": 1,
 			"virtualmachine": []map[string]interface{}{
 				{
-					"name": name,
-					"id":   fmt.Sprintf("vm%d", number),
+					"name":   name,
+					"id":     fmt.Sprintf("vm%d", number),
+					"zoneid": s.vmZones[name],
 					"nic": []map[string]interface{}{
-						{"networkid": fmt.Sprintf("net%d", number)},
+						{"networkid": fmt.Sprintf("net%d", number), "ipaddress": fmt.Sprintf("192.168.%d.10", number)},
 					},
 				},
 			},
@@ -258,14 +286,16 @@ func (s *CloudstackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 			includeIP := len(tags) == 0
+			ipCopy := *ip
+			ipCopy.Tags = append([]cloudstack.Tags(nil), ip.Tags...)
 			for _, tag := range s.tags[ip.Id] {
 				if tags[tag.Key] == tag.Value {
 					includeIP = true
 				}
-				ip.Tags = append(ip.Tags, tag)
+				ipCopy.Tags = append(ipCopy.Tags, tag)
 			}
 			if includeIP {
-				ips = append(ips, ip)
+				ips = append(ips, &ipCopy)
 			}
 		}
 		w.Write(MarshalResponse("listPublicIpAddressesResponse", cloudstack.ListPublicIpAddressesResponse{
@@ -282,8 +312,12 @@ func (s *CloudstackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Networkid: r.FormValue("networkid"),
 		}
 		w.Write(MarshalResponse("associateIpAddressResponse", obj))
+		_, isIPv6 := s.ipv6LBEnvironments[r.FormValue("lbenvironmentid")]
 		s.Jobs[obj.JobID] = func() interface{} {
 			obj.Ipaddress = fmt.Sprintf("10.0.0.%d", ipIdx)
+			if isIPv6 {
+				obj.Ipaddress = fmt.Sprintf("fd00::%d", ipIdx)
+			}
 			s.ips[ipID] = &cloudstack.PublicIpAddress{
 				Id:        obj.Id,
 				Ipaddress: obj.Ipaddress,
@@ -335,6 +369,13 @@ func (s *CloudstackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		healthCheckType := r.FormValue("healthchecktype")
 		healthCheckProtocol := r.FormValue("healthcheck")
 		healthCheckExpected := r.FormValue("expectedhealthcheck")
+		healthCheckInterval, _ := strconv.Atoi(r.FormValue("healthcheckinterval"))
+		healthCheckTimeout, _ := strconv.Atoi(r.FormValue("healthchecktimeout"))
+		proxyProtocol, hasProxyProtocol := r.Form["proxyprotocol"]
+		maxConn, _ := strconv.Atoi(r.FormValue("maxconn"))
+		l4Protocol := r.FormValue("l4protocol")
+		l7Protocol := r.FormValue("l7protocol")
+		serviceDownAction := r.FormValue("servicedownaction")
 
 		lbName := s.lbNameByID(lbRuleID)
 		if lbName == "" {
@@ -358,6 +399,25 @@ func (s *CloudstackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					s.lbRules[lbName].Pools[idx].HealthCheck = healthCheckProtocol
 					s.lbRules[lbName].Pools[idx].HealthCheckType = healthCheckType
 					s.lbRules[lbName].Pools[idx].HealthCheckExpected = healthCheckExpected
+					if healthCheckInterval > 0 {
+						s.lbRules[lbName].Pools[idx].HealthCheckInterval = healthCheckInterval
+					}
+					if healthCheckTimeout > 0 {
+						s.lbRules[lbName].Pools[idx].HealthCheckTimeout = healthCheckTimeout
+					}
+					if hasProxyProtocol {
+						s.lbRules[lbName].Pools[idx].ProxyProtocol = proxyProtocol[0]
+					}
+					s.lbRules[lbName].Pools[idx].MaxConn = maxConn
+					if l4Protocol != "" {
+						s.lbRules[lbName].Pools[idx].L4Protocol = l4Protocol
+					}
+					if l7Protocol != "" {
+						s.lbRules[lbName].Pools[idx].L7Protocol = l7Protocol
+					}
+					if serviceDownAction != "" {
+						s.lbRules[lbName].Pools[idx].ServiceDownAction = serviceDownAction
+					}
 					return s.lbRules[lbName]
 				}
 				return
@@ -441,8 +501,17 @@ func (s *CloudstackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		s.Jobs[response.JobID] = func() interface{} {
 			ids := r.Form["resourceids"]
+			tagKeys := parseTags(r.Form)
 			for _, id := range ids {
-				delete(s.tags, id)
+				if len(tagKeys) == 0 {
+					delete(s.tags, id)
+					continue
+				}
+				var keys []string
+				for k := range tagKeys {
+					keys = append(keys, k)
+				}
+				s.DeleteTags(id, keys)
 			}
 			response.Success = true
 			return response
@@ -455,6 +524,9 @@ func (s *CloudstackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if vms != "" {
 			vmIDs = strings.Split(vms, ",")
 		}
+		for i := 0; r.FormValue(fmt.Sprintf("vmidipmap[%d].vmid", i)) != ""; i++ {
+			vmIDs = append(vmIDs, r.FormValue(fmt.Sprintf("vmidipmap[%d].vmid", i)))
+		}
 		hostAssignIdx := s.newID(cmd)
 		obj := cloudstack.AssignToLoadBalancerRuleResponse{
 			JobID: fmt.Sprintf("job-host-assign-%d", hostAssignIdx),
@@ -496,16 +568,26 @@ func (s *CloudstackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	case "listTags":
 		keyFilter := r.FormValue("key")
-		tags := s.tags[r.FormValue("resourceid")]
+		resourceIDs := []string{r.FormValue("resourceid")}
+		if resourceIDs[0] == "" {
+			resourceIDs = nil
+			for id := range s.tags {
+				resourceIDs = append(resourceIDs, id)
+			}
+			sort.Strings(resourceIDs)
+		}
 		var ptrTags []*cloudstack.Tag
-		for _, tag := range tags {
-			if keyFilter != "" && tag.Key != keyFilter {
-				continue
+		for _, id := range resourceIDs {
+			for _, tag := range s.tags[id] {
+				if keyFilter != "" && tag.Key != keyFilter {
+					continue
+				}
+				ptrTags = append(ptrTags, &cloudstack.Tag{
+					Key:        tag.Key,
+					Value:      tag.Value,
+					Resourceid: id,
+				})
 			}
-			ptrTags = append(ptrTags, &cloudstack.Tag{
-				Key:   tag.Key,
-				Value: tag.Value,
-			})
 		}
 		w.Write(MarshalResponse("listTagsResponse", cloudstack.ListTagsResponse{
 			Count: len(ptrTags),
@@ -526,6 +608,90 @@ func (s *CloudstackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return obj
 		}
 
+	case "listLoadBalancers":
+		name := r.FormValue("name")
+		queryTags := parseTags(r.Form)
+		var lbs []map[string]interface{}
+		for lbName, lb := range s.internalLBs {
+			lbTags := s.tags[lb["id"].(string)]
+			matchTags := false
+			for _, tag := range lbTags {
+				if queryTags[tag.Key] == tag.Value {
+					matchTags = true
+				}
+			}
+			if matchTags || (name != "" && lbName == name) {
+				lb["tags"] = lbTags
+				lbs = append(lbs, lb)
+			}
+		}
+		w.Write(MarshalResponse("listLoadBalancersResponse", map[string]interface{}{
+			"count":        len(lbs),
+			"loadbalancer": lbs,
+		}))
+
+	case "createLoadBalancer":
+		lbName := r.FormValue("name")
+		if _, ok := s.internalLBs[lbName]; ok {
+			w.WriteHeader(http.StatusConflict)
+			w.Write(ErrorResponse("createLoadBalancerResponse", fmt.Sprintf("lb already exists with name %v", lbName)))
+			return
+		}
+		lbIdx := s.newID(cmd)
+		jobID := fmt.Sprintf("job-internal-lb-%d", lbIdx)
+		sourcePort, _ := strconv.Atoi(r.FormValue("sourceport"))
+		instancePort, _ := strconv.Atoi(r.FormValue("instanceport"))
+		sourceIP := r.FormValue("sourceipaddress")
+		if sourceIP == "" {
+			sourceIP = fmt.Sprintf("10.1.0.%d", lbIdx)
+		}
+		obj := map[string]interface{}{
+			"id":                       fmt.Sprintf("internal-lb-%d", lbIdx),
+			"name":                     lbName,
+			"algorithm":                r.FormValue("algorithm"),
+			"networkid":                r.FormValue("networkid"),
+			"sourceipaddress":          sourceIP,
+			"sourceipaddressnetworkid": r.FormValue("sourceipaddressnetworkid"),
+			"loadbalancerrule": []map[string]interface{}{
+				{"sourceport": sourcePort, "instanceport": instancePort},
+			},
+		}
+		w.Write(MarshalResponse("createLoadBalancerResponse", map[string]interface{}{
+			"id":    obj["id"],
+			"jobid": jobID,
+		}))
+		s.Jobs[jobID] = func() interface{} {
+			s.internalLBs[lbName] = obj
+			return obj
+		}
+
+	case "deleteLoadBalancer":
+		lbID := r.FormValue("id")
+		deleteIdx := s.newID(cmd)
+		obj := cloudstack.DeleteLoadBalancerResponse{
+			JobID: fmt.Sprintf("job-delete-internal-lb-%d", deleteIdx),
+		}
+		w.Write(MarshalResponse("deleteLoadBalancerResponse", obj))
+		s.Jobs[obj.JobID] = func() interface{} {
+			for name, lb := range s.internalLBs {
+				if lb["id"] == lbID {
+					delete(s.internalLBs, name)
+				}
+			}
+			delete(s.tags, lbID)
+			return obj
+		}
+
+	case "updateLBMember", "updateGloboNetworkPoolMember":
+		memberIdx := s.newID(cmd)
+		obj := map[string]interface{}{
+			"jobid": fmt.Sprintf("job-member-update-%d", memberIdx),
+		}
+		w.Write(MarshalResponse(cmd+"Response", obj))
+		s.Jobs[obj["jobid"].(string)] = func() interface{} {
+			return obj
+		}
+
 	case "listLoadBalancerRuleInstances":
 		page, _ := strconv.Atoi(r.FormValue("page"))
 		if page > 1 {
@@ -0,0 +1,149 @@
+package cloudstack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Explicit per port health check annotations, suffixed by the port name
+	// or number. They take precedence over the protocol inferred from the
+	// port name prefix.
+	lbHealthCheckTypePrefix     = "csccm.cloudprovider.io/loadbalancer-healthcheck-type-"
+	lbHealthCheckRequestPrefix  = "csccm.cloudprovider.io/loadbalancer-healthcheck-request-"
+	lbHealthCheckExpectPrefix   = "csccm.cloudprovider.io/loadbalancer-healthcheck-expect-"
+	lbHealthCheckIntervalPrefix = "csccm.cloudprovider.io/loadbalancer-healthcheck-interval-"
+	lbHealthCheckTimeoutPrefix  = "csccm.cloudprovider.io/loadbalancer-healthcheck-timeout-"
+
+	eventReasonInvalidHealthCheck = "LoadBalancerInvalidHealthCheck"
+)
+
+var healthCheckPrefixes = []string{
+	lbHealthCheckTypePrefix,
+	lbHealthCheckRequestPrefix,
+	lbHealthCheckExpectPrefix,
+	lbHealthCheckIntervalPrefix,
+	lbHealthCheckTimeoutPrefix,
+}
+
+// supportedHCProtocols maps the health check protocols to whether they
+// require a request message.
+var supportedHCProtocols = map[string]bool{
+	"HTTP":  true,
+	"HTTPS": true,
+	"TCP":   false,
+	"UDP":   false,
+}
+
+// healthCheck is the health check requested for a port.
+type healthCheck struct {
+	protocol string
+	request  string
+	expect   string
+	// interval and timeout in seconds, zero when unmanaged.
+	interval int
+	timeout  int
+}
+
+// hasAnnotationPrefix indicates whether any label or annotation of the
+// service starts with one of the prefixes.
+func hasAnnotationPrefix(service *v1.Service, prefixes []string) bool {
+	for _, key := range annotationKeys(service) {
+		if hasAnyPrefix(key, prefixes) {
+			return true
+		}
+	}
+	return false
+}
+
+// portID returns the port name, or its number for unnamed ports.
+func portID(portInfo lbPortInfo) string {
+	if portInfo.name != "" {
+		return portInfo.name
+	}
+	return strconv.Itoa(portInfo.publicPort)
+}
+
+// portAnnotation returns the value of the annotation for the port, looked up
+// by the port name and then by the port number.
+func portAnnotation(service *v1.Service, prefix string, portInfo lbPortInfo) (string, bool) {
+	if portInfo.name != "" {
+		if value, ok := getLabelOrAnnotation(service.ObjectMeta, prefix+portInfo.name); ok {
+			return value, true
+		}
+	}
+	return getLabelOrAnnotation(service.ObjectMeta, prefix+strconv.Itoa(portInfo.publicPort))
+}
+
+// explicitHealthCheck returns the health check set by annotations for the
+// port, ok is false if the port has no health check annotations.
+func explicitHealthCheck(service *v1.Service, ports lbPorts, portInfo lbPortInfo) (hc healthCheck, ok bool, err error) {
+	hcType, hasType := portAnnotation(service, lbHealthCheckTypePrefix, portInfo)
+	request, hasRequest := portAnnotation(service, lbHealthCheckRequestPrefix, portInfo)
+	expect, hasExpect := portAnnotation(service, lbHealthCheckExpectPrefix, portInfo)
+	interval, hasInterval := portAnnotation(service, lbHealthCheckIntervalPrefix, portInfo)
+	timeout, hasTimeout := portAnnotation(service, lbHealthCheckTimeoutPrefix, portInfo)
+	if !hasType && !hasRequest && !hasExpect && !hasInterval && !hasTimeout {
+		return hc, false, nil
+	}
+
+	protocol := portToHCProtocol(ports, portInfo)
+	if hasType {
+		hcType = strings.ToUpper(strings.TrimSpace(hcType))
+		requiresMsg, supported := supportedHCProtocols[hcType]
+		if !supported {
+			return hc, true, fmt.Errorf("invalid health check type %q for port %s, expected one of HTTP, HTTPS, TCP or UDP", hcType, portID(portInfo))
+		}
+		protocol = hcPortInfo{protocol: hcType, requiresMsg: requiresMsg}
+	}
+	if protocol.requiresMsg && request == "" {
+		return hc, true, fmt.Errorf("health check type %s for port %s requires a request", protocol.protocol, portID(portInfo))
+	}
+	if expect != "" && request == "" {
+		return hc, true, fmt.Errorf("health check expected response for port %s requires a request", portID(portInfo))
+	}
+	if protocol.requiresMsg && strings.HasPrefix(request, "/") {
+		request = fmt.Sprintf("GET %s HTTP/1.0", request)
+	}
+	hc = healthCheck{
+		protocol: protocol.protocol,
+		request:  request,
+		expect:   expect,
+	}
+	if hasInterval {
+		hc.interval, err = parseHealthCheckSeconds(lbHealthCheckIntervalPrefix, portInfo, interval)
+		if err != nil {
+			return hc, true, err
+		}
+	}
+	if hasTimeout {
+		hc.timeout, err = parseHealthCheckSeconds(lbHealthCheckTimeoutPrefix, portInfo, timeout)
+		if err != nil {
+			return hc, true, err
+		}
+	}
+	if hc.interval > 0 && hc.timeout >= hc.interval {
+		return hc, true, fmt.Errorf("health check timeout %ds for port %s must be lower than its interval %ds", hc.timeout, portID(portInfo), hc.interval)
+	}
+	return hc, true, nil
+}
+
+func parseHealthCheckSeconds(prefix string, portInfo lbPortInfo, value string) (int, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid value for %q: %q, expected a duration of at least 1s", prefix+portID(portInfo), value)
+	}
+	return int(d / time.Second), nil
+}
+
+// healthCheckWarning reports an invalid health check of the service.
+func (lb *loadBalancer) healthCheckWarning(format string, args ...interface{}) {
+	if lb.cloud.recorder == nil {
+		return
+	}
+	lb.cloud.recorder.Eventf(lb.service, v1.EventTypeWarning, eventReasonInvalidHealthCheck, format, args...)
+}
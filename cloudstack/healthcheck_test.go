@@ -0,0 +1,218 @@
+package cloudstack
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_explicitHealthCheck(t *testing.T) {
+	ports := lbPorts{protocol: corev1.ProtocolTCP, ports: []lbPortInfo{{publicPort: 8080, privatePort: 30001, name: "web"}}}
+	tests := []struct {
+		name        string
+		portName    string
+		annotations map[string]string
+		expected    healthCheck
+		explicit    bool
+		err         string
+	}{
+		{
+			name: "no annotations",
+		},
+		{
+			name: "http path",
+			annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-type-web":     "http",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-request-web":  "/healthz",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-expect-web":   "200 OK",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-interval-web": "10s",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-timeout-web":  "2s",
+			},
+			expected: healthCheck{protocol: "HTTP", request: "GET /healthz HTTP/1.0", expect: "200 OK", interval: 10, timeout: 2},
+			explicit: true,
+		},
+		{
+			name:     "by port number",
+			portName: "-",
+			annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-type-8080": "TCP",
+			},
+			expected: healthCheck{protocol: "TCP"},
+			explicit: true,
+		},
+		{
+			name: "port name takes precedence",
+			annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-type-8080": "UDP",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-type-web":  "TCP",
+			},
+			expected: healthCheck{protocol: "TCP"},
+			explicit: true,
+		},
+		{
+			name: "tcp payload",
+			annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-request-web": "PING",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-expect-web":  "PONG",
+			},
+			expected: healthCheck{protocol: "TCP", request: "PING", expect: "PONG"},
+			explicit: true,
+		},
+		{
+			name: "unknown type",
+			annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-type-web": "ICMP",
+			},
+			explicit: true,
+			err:      `invalid health check type "ICMP" for port web, expected one of HTTP, HTTPS, TCP or UDP`,
+		},
+		{
+			name: "http without request",
+			annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-type-web": "HTTPS",
+			},
+			explicit: true,
+			err:      "health check type HTTPS for port web requires a request",
+		},
+		{
+			name: "expect without request",
+			annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-expect-web": "200",
+			},
+			explicit: true,
+			err:      "health check expected response for port web requires a request",
+		},
+		{
+			name: "invalid interval",
+			annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-interval-web": "10",
+			},
+			explicit: true,
+			err:      `invalid value for "csccm.cloudprovider.io/loadbalancer-healthcheck-interval-web": "10", expected a duration of at least 1s`,
+		},
+		{
+			name: "timeout above interval",
+			annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-interval-web": "5s",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-timeout-web":  "5s",
+			},
+			explicit: true,
+			err:      "health check timeout 5s for port web must be lower than its interval 5s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			portInfo := ports.ports[0]
+			if tt.portName == "-" {
+				portInfo.name = ""
+			}
+			svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			assert.Equal(t, len(tt.annotations) > 0, hasAnnotationPrefix(svc, healthCheckPrefixes))
+			hc, explicit, err := explicitHealthCheck(svc, ports, portInfo)
+			assert.Equal(t, tt.explicit, explicit)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, hc)
+		})
+	}
+}
+
+func Test_CSCloud_explicitHealthCheck(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+			},
+		},
+	}, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-type-web":     "HTTP",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-request-web":  "/healthz",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-expect-web":   "200 OK",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-interval-web": "10s",
+				"csccm.cloudprovider.io/loadbalancer-healthcheck-timeout-web":  "2s",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "web", Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	ensure := func() {
+		srv.Calls = nil
+		cs.updateLBQueue.start(context.Background())
+		_, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), []*corev1.Node{node})
+		cs.updateLBQueue.stopWait()
+		require.NoError(t, err)
+		var calls []cloudstackFake.MockAPICall
+		for _, call := range srv.Calls {
+			if call.Command == "listGloboNetworkPools" || call.Command == "updateGloboNetworkPool" {
+				calls = append(calls, call)
+			}
+		}
+		srv.Calls = calls
+	}
+
+	ensure()
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listGloboNetworkPools"},
+		{Command: "updateGloboNetworkPool", Params: url.Values{
+			"healthchecktype":     []string{"HTTP"},
+			"healthcheck":         []string{"GET /healthz HTTP/1.0"},
+			"expectedhealthcheck": []string{"200 OK"},
+			"healthcheckinterval": []string{"10"},
+			"healthchecktimeout":  []string{"2"},
+		}},
+	})
+
+	ensure()
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listGloboNetworkPools"},
+	})
+
+	svc.Annotations["csccm.cloudprovider.io/loadbalancer-healthcheck-type-web"] = "ICMP"
+	ensure()
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listGloboNetworkPools"},
+	})
+	waitAnyEvent(t, `reason: 'LoadBalancerInvalidHealthCheck' Ignoring health check of port web: invalid health check type "ICMP"`)
+}
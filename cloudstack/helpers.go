@@ -14,8 +14,45 @@ func vmCacheKey(name, projectID string) string {
 	return strings.Join([]string{name, projectID}, "\x00")
 }
 
+func nicTagsCacheKey(nicID string) string {
+	return strings.Join([]string{"nic-tags", nicID}, "\x00")
+}
+
 var ErrVMNotFound = errors.New("vm not found in cloudstack")
 
+const (
+	ipFamilyIPv4 = "IPv4"
+	ipFamilyIPv6 = "IPv6"
+)
+
+// parseIPFamilies parses a comma separated list of IP families, e.g.
+// "IPv4,IPv6", keeping the order in which they were declared.
+func parseIPFamilies(value string) ([]string, error) {
+	var families []string
+	seen := map[string]struct{}{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var family string
+		switch strings.ToLower(part) {
+		case "ipv4":
+			family = ipFamilyIPv4
+		case "ipv6":
+			family = ipFamilyIPv6
+		default:
+			return nil, fmt.Errorf("invalid IP family %q, expected %q or %q", part, ipFamilyIPv4, ipFamilyIPv6)
+		}
+		if _, ok := seen[family]; ok {
+			continue
+		}
+		seen[family] = struct{}{}
+		families = append(families, family)
+	}
+	return families, nil
+}
+
 type cloudstackManager struct {
 	client *cloudstack.CloudStackClient
 	cache  *ristretto.Cache
@@ -75,6 +112,30 @@ func (m *cloudstackManager) virtualMachineByName(name, projectID string) (*cloud
 	return vm, nil
 }
 
+func (m *cloudstackManager) nicTags(nicID, projectID string) (map[string]string, error) {
+	key := nicTagsCacheKey(nicID)
+	if tags, found := m.cache.Get(key); found {
+		return tags.(map[string]string), nil
+	}
+	p := m.client.Resourcetags.NewListTagsParams()
+	p.SetResourcetype("Nic")
+	p.SetResourceid(nicID)
+	p.SetListall(true)
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	tagsResponse, err := m.client.Resourcetags.ListTags(p)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(tagsResponse.Tags))
+	for _, t := range tagsResponse.Tags {
+		tags[t.Key] = t.Value
+	}
+	m.cache.Set(key, tags, 0)
+	return tags, nil
+}
+
 type pageParams interface {
 	SetPagesize(int)
 	SetPage(int)
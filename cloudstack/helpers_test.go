@@ -39,3 +39,28 @@ func Test_cloudstackManager_virtualMachineByName(t *testing.T) {
 	}
 	assert.Less(t, len(srv.Calls), 100)
 }
+
+func Test_parseIPFamilies(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []string
+		err      string
+	}{
+		{value: "", expected: nil},
+		{value: "IPv4", expected: []string{"IPv4"}},
+		{value: "ipv6, IPv4", expected: []string{"IPv6", "IPv4"}},
+		{value: "IPv4,IPv4,IPv6", expected: []string{"IPv4", "IPv6"}},
+		{value: "IPv5", err: `invalid IP family "IPv5", expected "IPv4" or "IPv6"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			families, err := parseIPFamilies(tt.value)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, families)
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package cloudstack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// hookStepIPAllocated also runs when IPs are claimed from the reserved
+	// pool or reclaimed after being retained.
+	hookStepIPAllocated    = "ip-allocated"
+	hookStepRuleCreated    = "rule-created"
+	hookStepMembersChanged = "members-changed"
+	hookStepRuleDeleted    = "rule-deleted"
+
+	hookPhaseBefore = "before"
+	hookPhaseAfter  = "after"
+
+	defaultHookTimeout = 30 * time.Second
+
+	// hostnameTag records on the rule the hostname returned by a hook,
+	// reported in the load balancer status instead of the rule name.
+	hostnameTag = "kubernetes_hostname"
+
+	eventReasonHookFailed = "LoadBalancerHookFailed"
+)
+
+var hookSteps = []string{hookStepIPAllocated, hookStepRuleCreated, hookStepMembersChanged, hookStepRuleDeleted}
+
+// hookConfig configures the executables run before and after a load
+// balancer lifecycle step, they receive a hookRequest as JSON on stdin and
+// may write a hookResponse as JSON to stdout.
+type hookConfig struct {
+	Before  string `gcfg:"before"`
+	After   string `gcfg:"after"`
+	Timeout string `gcfg:"timeout"`
+}
+
+type hook struct {
+	before  []string
+	after   []string
+	timeout time.Duration
+}
+
+// hookRequest is written to the stdin of hooks.
+type hookRequest struct {
+	Step         string           `json:"step"`
+	Phase        string           `json:"phase"`
+	Service      hookService      `json:"service"`
+	LoadBalancer hookLoadBalancer `json:"loadBalancer"`
+	Members      *hookMembers     `json:"members,omitempty"`
+}
+
+type hookService struct {
+	Namespace   string            `json:"namespace"`
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type hookLoadBalancer struct {
+	Name        string `json:"name,omitempty"`
+	Environment string `json:"environment"`
+	ProjectID   string `json:"projectID,omitempty"`
+	VIP         string `json:"vip,omitempty"`
+	NetworkID   string `json:"networkID,omitempty"`
+	IPAddress   string `json:"ipAddress,omitempty"`
+	IPID        string `json:"ipID,omitempty"`
+	RuleID      string `json:"ruleID,omitempty"`
+}
+
+type hookMembers struct {
+	Assign []string `json:"assign,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// hookResponse is read from the stdout of hooks. Params patch the CloudStack
+// command params and are only honored by before hooks, status patches the
+// load balancer status and is only honored by after hooks of steps with a
+// rule.
+type hookResponse struct {
+	Params hookParams  `json:"params"`
+	Status *hookStatus `json:"status"`
+}
+
+type hookStatus struct {
+	Hostname string `json:"hostname"`
+}
+
+func parseHooks(cfg map[string]*hookConfig) (map[string]hook, error) {
+	hooks := map[string]hook{}
+	for step, c := range cfg {
+		if !containsString(hookSteps, step) {
+			return nil, fmt.Errorf("unknown step %q, expected one of %s", step, strings.Join(hookSteps, ", "))
+		}
+		h := hook{
+			before:  strings.Fields(c.Before),
+			after:   strings.Fields(c.After),
+			timeout: defaultHookTimeout,
+		}
+		if c.Timeout != "" {
+			timeout, err := time.ParseDuration(c.Timeout)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("invalid timeout for step %q: %q", step, c.Timeout)
+			}
+			h.timeout = timeout
+		}
+		hooks[step] = h
+	}
+	return hooks, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// runHook runs the hook configured for the step and phase, returning a nil
+// response if there is none.
+func (cs *CSCloud) runHook(req hookRequest) (*hookResponse, error) {
+	h, ok := cs.hooks[req.Step]
+	if !ok {
+		return nil, nil
+	}
+	command := h.before
+	if req.Phase == hookPhaseAfter {
+		command = h.after
+	}
+	if len(command) == 0 {
+		return nil, nil
+	}
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	klog.V(4).Infof("Running %s %s hook %q for service %s/%s", req.Phase, req.Step, command[0], req.Service.Namespace, req.Service.Name)
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("error running %s %s hook %q: %v: %s", req.Phase, req.Step, command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	var resp hookResponse
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return &resp, nil
+	}
+	err = json.Unmarshal(stdout.Bytes(), &resp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response from %s %s hook %q: %v", req.Phase, req.Step, command[0], err)
+	}
+	return &resp, nil
+}
+
+// hookParams are the params returned by a before hook, set on the commands
+// of the step.
+type hookParams map[string]string
+
+func (h hookParams) apply(p *cloudstack.CustomServiceParams) {
+	for k, v := range h {
+		p.SetParam(k, v)
+	}
+}
+
+// beforeHook runs the before hook of the step, a failure aborts the step.
+func (cs *CSCloud) beforeHook(req hookRequest) (hookParams, error) {
+	req.Phase = hookPhaseBefore
+	resp, err := cs.runHook(req)
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	return resp.Params, nil
+}
+
+// afterHook runs the after hook of the step. The step already happened so
+// failures are only reported as events on the service.
+func (cs *CSCloud) afterHook(req hookRequest, service *v1.Service) *hookResponse {
+	req.Phase = hookPhaseAfter
+	resp, err := cs.runHook(req)
+	if err != nil {
+		klog.Errorf("Unable to run hook for service %s/%s: %v", service.Namespace, service.Name, err)
+		if cs.recorder != nil {
+			cs.recorder.Eventf(service, v1.EventTypeWarning, eventReasonHookFailed, "Error running hook: %v", err)
+		}
+		return nil
+	}
+	return resp
+}
+
+// ipAllocatedRequest returns the request for the ip-allocated hooks of an IP
+// for the load balancer of the service.
+func (pc *projectCloud) ipAllocatedRequest(service *v1.Service, lbName, networkID, vip string) hookRequest {
+	req := newHookRequest(hookStepIPAllocated, service)
+	req.LoadBalancer = hookLoadBalancer{
+		Name:        lbName,
+		Environment: pc.environment,
+		ProjectID:   pc.projectID,
+		VIP:         vip,
+		NetworkID:   networkID,
+	}
+	return req
+}
+
+// claimIPWithHooks runs the ip-allocated hooks around the claim of an
+// existing IP, like reserved pool IPs and retained IPs, which is not
+// associated with the associate command. The IP is already known by the
+// before hook and the params returned by it are ignored as no command is
+// sent.
+func (pc *projectCloud) claimIPWithHooks(service *v1.Service, lbName, networkID, vip string, ip *cloudstackIP, claim func() error) error {
+	req := pc.ipAllocatedRequest(service, lbName, networkID, vip)
+	req.LoadBalancer.IPAddress = ip.address
+	req.LoadBalancer.IPID = ip.id
+	if _, err := pc.beforeHook(req); err != nil {
+		return err
+	}
+	if err := claim(); err != nil {
+		return err
+	}
+	pc.afterHook(req, service)
+	return nil
+}
+
+func newHookRequest(step string, service *v1.Service) hookRequest {
+	return hookRequest{
+		Step: step,
+		Service: hookService{
+			Namespace:   service.Namespace,
+			Name:        service.Name,
+			Labels:      service.Labels,
+			Annotations: service.Annotations,
+		},
+	}
+}
+
+// hookRequest returns the request for hooks of the step on the load
+// balancer.
+func (lb *loadBalancer) hookRequest(step string) hookRequest {
+	req := newHookRequest(step, lb.service)
+	req.LoadBalancer = hookLoadBalancer{
+		Name:        lb.name,
+		Environment: lb.cloud.environment,
+		ProjectID:   lb.cloud.projectID,
+		VIP:         lb.vip,
+		NetworkID:   lb.mainNetworkID,
+		IPAddress:   lb.ip.address,
+		IPID:        lb.ip.id,
+	}
+	if lb.rule != nil {
+		req.LoadBalancer.RuleID = lb.rule.Id
+	}
+	return req
+}
+
+// afterRuleHook runs the after hook of a step on the rule and records the
+// hostname returned by it.
+func (lb *loadBalancer) afterRuleHook(req hookRequest) error {
+	resp := lb.cloud.afterHook(req, lb.service)
+	if resp == nil || resp.Status == nil || resp.Status.Hostname == "" || lb.rule == nil {
+		return nil
+	}
+	if resp.Status.Hostname == lb.hostname() {
+		return nil
+	}
+	err := lb.setRuleTag(hostnameTag, resp.Status.Hostname)
+	if err != nil {
+		return fmt.Errorf("error recording hostname of %v: %v", lb, err)
+	}
+	return nil
+}
+
+// changeMembers runs the members-changed hooks around the assignment or
+// removal of members.
+func (lb *loadBalancer) changeMembers(members hookMembers, change func(hookParams) error) error {
+	req := lb.hookRequest(hookStepMembersChanged)
+	req.Members = &members
+	extraParams, err := lb.cloud.beforeHook(req)
+	if err != nil {
+		return err
+	}
+	if err = change(extraParams); err != nil {
+		return err
+	}
+	return lb.afterRuleHook(req)
+}
+
+// hostname returns the hostname reported in the load balancer status.
+func (lb *loadBalancer) hostname() string {
+	if lb.rule != nil {
+		if hostname, ok := getTag(lb.rule.Tags, hostnameTag); ok && hostname != "" {
+			return hostname
+		}
+	}
+	return lb.name
+}
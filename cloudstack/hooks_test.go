@@ -0,0 +1,320 @@
+package cloudstack
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_parseHooks(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected map[string]hook
+		err      string
+	}{
+		{
+			config:   "",
+			expected: map[string]hook{},
+		},
+		{
+			config: `
+[hook "rule-created"]
+before = /bin/ipam --create
+timeout = 5s
+`,
+			expected: map[string]hook{
+				"rule-created": {before: []string{"/bin/ipam", "--create"}, after: []string{}, timeout: 5 * time.Second},
+			},
+		},
+		{
+			config: `
+[hook "rule-updated"]
+after = /bin/dns
+`,
+			err: `unknown step "rule-updated", expected one of ip-allocated, rule-created, members-changed, rule-deleted`,
+		},
+		{
+			config: `
+[hook "rule-deleted"]
+after = /bin/dns
+timeout = 5
+`,
+			err: `invalid timeout for step "rule-deleted": "5"`,
+		},
+	}
+	for _, tt := range tests {
+		cfg, err := readConfig(strings.NewReader(tt.config))
+		require.NoError(t, err)
+		hooks, err := parseHooks(cfg.Hooks)
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, hooks)
+	}
+}
+
+func writeHookScript(t *testing.T, dir, name, script string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755)
+	require.NoError(t, err)
+	return path
+}
+
+func Test_CSCloud_hooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	record := func(name, output string) string {
+		return writeHookScript(t, dir, name, "cat > "+filepath.Join(dir, name+".json")+"\necho '"+output+"'\n")
+	}
+	readRequest := func(name string) hookRequest {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name+".json"))
+		require.NoError(t, err)
+		var req hookRequest
+		require.NoError(t, json.Unmarshal(data, &req))
+		return req
+	}
+
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Hooks: map[string]*hookConfig{
+			"ip-allocated": {
+				Before: record("ip-before", `{"params": {"ipam": "reserved"}}`),
+				After:  record("ip-after", ""),
+			},
+			"rule-created": {
+				Before: record("rule-before", `{"params": {"foo": "bar"}}`),
+				After:  record("rule-after", `{"status": {"hostname": "svc1.custom.com"}}`),
+			},
+			"members-changed": {
+				After: record("members-after", ""),
+			},
+			"rule-deleted": {
+				Before: writeHookScript(t, dir, "delete-before", "echo 'dns error' >&2\nexit 1\n"),
+			},
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				RemoveLBs:       true,
+			},
+		},
+	}, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err = cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	ensure := func() *corev1.LoadBalancerStatus {
+		srv.Calls = nil
+		cs.updateLBQueue.start(context.Background())
+		lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), []*corev1.Node{node})
+		cs.updateLBQueue.stopWait()
+		require.NoError(t, err)
+		return lbStatus
+	}
+	findCall := func(command string) cloudstackFake.MockAPICall {
+		for _, call := range srv.Calls {
+			if call.Command == command {
+				return call
+			}
+		}
+		t.Fatalf("call %q not found", command)
+		return cloudstackFake.MockAPICall{}
+	}
+
+	lbStatus := ensure()
+	assert.Equal(t, &corev1.LoadBalancerStatus{
+		Ingress: []corev1.LoadBalancerIngress{{IP: "10.0.0.1", Hostname: "svc1.custom.com"}},
+	}, lbStatus)
+	assert.Equal(t, "reserved", findCall("associateIpAddress").Params.Get("ipam"))
+	assert.Equal(t, "bar", findCall("createLoadBalancerRule").Params.Get("foo"))
+
+	req := readRequest("ip-before")
+	assert.Equal(t, hookStepIPAllocated, req.Step)
+	assert.Equal(t, hookPhaseBefore, req.Phase)
+	assert.Equal(t, "myns", req.Service.Namespace)
+	assert.Equal(t, "svc1", req.Service.Name)
+	assert.Equal(t, "env1", req.Service.Labels["environment-label"])
+	assert.Equal(t, "env1", req.LoadBalancer.Environment)
+	req = readRequest("ip-after")
+	assert.Equal(t, hookPhaseAfter, req.Phase)
+	assert.Equal(t, "10.0.0.1", req.LoadBalancer.IPAddress)
+	assert.Equal(t, "ip-1", req.LoadBalancer.IPID)
+	req = readRequest("rule-after")
+	assert.Equal(t, "svc1.test.com", req.LoadBalancer.Name)
+	assert.Equal(t, "lbrule-1", req.LoadBalancer.RuleID)
+	req = readRequest("members-after")
+	assert.Equal(t, hookStepMembersChanged, req.Step)
+	assert.Equal(t, &hookMembers{Assign: []string{"vm1"}}, req.Members)
+
+	lbStatus = ensure()
+	assert.Equal(t, "svc1.custom.com", lbStatus.Ingress[0].Hostname)
+
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `error running before rule-deleted hook`)
+	assert.Contains(t, err.Error(), "dns error")
+}
+
+func Test_shouldManageLB_hookHostname(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "svc1", Namespace: "myns"},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: "10.0.0.1", Hostname: "svc1.custom.com"}},
+			},
+		},
+	}
+	lb := &loadBalancer{
+		name:    "svc1.test.com",
+		service: svc,
+		rule: &loadBalancerRule{LoadBalancerRule: &cloudstack.LoadBalancerRule{
+			Id:   "lbrule-1",
+			Tags: []cloudstack.Tags{{Key: "kubernetes_hostname", Value: "svc1.custom.com"}},
+		}},
+	}
+	assert.NoError(t, shouldManageLB(lb))
+
+	lb.rule.Tags = nil
+	assert.Error(t, shouldManageLB(lb))
+}
+
+func Test_CSCloud_hooksForPoolIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	record := func(name string) string {
+		return writeHookScript(t, dir, name, "cat > "+filepath.Join(dir, name+".json")+"\n")
+	}
+	readRequest := func(name string) hookRequest {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name+".json"))
+		require.NoError(t, err)
+		var req hookRequest
+		require.NoError(t, json.Unmarshal(data, &req))
+		return req
+	}
+
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	projectID := "11111111-2222-3333-4444-555555555555"
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Hooks: map[string]*hookConfig{
+			"ip-allocated": {
+				Before: record("ip-before"),
+				After:  record("ip-after"),
+			},
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				IPPoolSize:      1,
+				IPPoolNetworkID: "net1",
+				IPPoolProjects:  projectID,
+			},
+		},
+	}, nil)
+	pc := &projectCloud{CSCloud: cs, environment: "env1", projectID: projectID}
+	err = pc.fillIPPool()
+	require.NoError(t, err)
+	srv.Calls = nil
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  projectID,
+				"environment-label": "env1",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err = cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	cs.updateLBQueue.start(context.Background())
+	_, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*corev1.Node{node})
+	cs.updateLBQueue.stopWait()
+	require.NoError(t, err)
+	for _, call := range srv.Calls {
+		assert.NotEqual(t, "associateIpAddress", call.Command)
+	}
+
+	for _, name := range []string{"ip-before", "ip-after"} {
+		req := readRequest(name)
+		assert.Equal(t, hookStepIPAllocated, req.Step)
+		assert.Equal(t, "svc1", req.Service.Name)
+		assert.Equal(t, "svc1.test.com", req.LoadBalancer.Name)
+		assert.Equal(t, "net1", req.LoadBalancer.NetworkID)
+		assert.Equal(t, "10.0.0.1", req.LoadBalancer.IPAddress)
+		assert.Equal(t, "ip-1", req.LoadBalancer.IPID)
+	}
+	assert.Equal(t, hookPhaseAfter, readRequest("ip-after").Phase)
+}
@@ -57,7 +57,7 @@ func (cs *CSCloud) NodeAddresses(ctx context.Context, name types.NodeName) ([]v1
 		}
 		return nil, fmt.Errorf("error retrieving node addresses: %v", err)
 	}
-	return cs.nodeAddresses(instance)
+	return cs.nodeAddresses(instance, node.environment)
 }
 
 // NodeAddressesByProviderID returns the addresses of the specified instance.
@@ -66,28 +66,42 @@ func (cs *CSCloud) NodeAddressesByProviderID(ctx context.Context, providerID str
 	if providerID == "" {
 		return nil, fmt.Errorf("empty providerID")
 	}
+	nodeIDData, err := parseProviderID(providerID)
+	if err != nil {
+		return nil, err
+	}
 	instance, err := cs.instanceByProviderID(providerID)
 	if err != nil {
 		return nil, err
 	}
-	return cs.nodeAddresses(instance)
+	return cs.nodeAddresses(instance, nodeIDData.environment)
 }
 
-func (cs *CSCloud) nodeAddresses(instance *cloudstack.VirtualMachine) ([]v1.NodeAddress, error) {
+func (cs *CSCloud) nodeAddresses(instance *cloudstack.VirtualMachine, environment string) ([]v1.NodeAddress, error) {
 	if len(instance.Nic) == 0 {
 		return nil, errors.New("instance does not have an internal IP")
 	}
 
 	var addresses []v1.NodeAddress
 
-	var internalAddr string
-	internalIndex := cs.config.Global.InternalIPIndex
+	families := cs.nodeIPFamilies()
+
+	internalIndex, err := cs.internalNICIndex(instance, environment)
+	if err != nil {
+		return nil, err
+	}
 	if internalIndex < 0 || internalIndex >= len(instance.Nic) {
 		klog.V(4).Infof("Unable to use index %v for internal IP, only %v NICs available, falling back to index 0", internalIndex, len(instance.Nic))
 		internalIndex = 0
 	}
-	internalAddr = instance.Nic[internalIndex].Ipaddress
-	addresses = append(addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: internalAddr})
+	internalAddrs := nicAddresses(instance.Nic[internalIndex], families)
+	if len(internalAddrs) == 0 {
+		return nil, fmt.Errorf("instance does not have an internal IP for families %v", families)
+	}
+	for _, addr := range internalAddrs {
+		addresses = append(addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: addr})
+	}
+	internalAddr := internalAddrs[0]
 
 	if instance.Hostname != "" {
 		addresses = append(addresses, v1.NodeAddress{Type: v1.NodeHostName, Address: instance.Hostname})
@@ -108,9 +122,14 @@ func (cs *CSCloud) nodeAddresses(instance *cloudstack.VirtualMachine) ([]v1.Node
 		}
 	}
 
-	externalIndex := cs.config.Global.ExternalIPIndex
+	externalIndex, err := cs.externalNICIndex(instance, environment)
+	if err != nil {
+		return nil, err
+	}
 	if externalIndex != internalIndex && externalIndex >= 0 && externalIndex < len(instance.Nic) {
-		addresses = append(addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: instance.Nic[externalIndex].Ipaddress})
+		for _, addr := range nicAddresses(instance.Nic[externalIndex], families) {
+			addresses = append(addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: addr})
+		}
 	} else {
 		klog.V(4).Infof("Unable to use index %v for external IP, only %v NICs available and %v is internal IP, ignoring", externalIndex, len(instance.Nic), internalIndex)
 	}
@@ -126,6 +145,33 @@ func (cs *CSCloud) nodeAddresses(instance *cloudstack.VirtualMachine) ([]v1.Node
 	return addresses, nil
 }
 
+// nicAddresses returns the NIC addresses for each of the IP families in the
+// order they were requested. Families without an address are ignored.
+func nicAddresses(nic cloudstack.Nic, families []string) []string {
+	var addrs []string
+	for _, family := range families {
+		var addr string
+		switch family {
+		case ipFamilyIPv4:
+			addr = nic.Ipaddress
+		case ipFamilyIPv6:
+			addr = nic.Ip6address
+		}
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (cs *CSCloud) nodeIPFamilies() []string {
+	families, err := parseIPFamilies(cs.config.Global.IPFamilies)
+	if err != nil || len(families) == 0 {
+		return []string{ipFamilyIPv4}
+	}
+	return families
+}
+
 // InstanceID returns the cloud provider ID of the specified instance.
 func (cs *CSCloud) InstanceID(ctx context.Context, name types.NodeName) (string, error) {
 	klog.V(4).Infof("InstanceID(%v)", name)
@@ -218,7 +264,18 @@ func (cs *CSCloud) AddSSHKeyToAllInstances(ctx context.Context, user string, key
 // CurrentNodeName returns the name of the node we are currently running on.
 func (cs *CSCloud) CurrentNodeName(ctx context.Context, hostname string) (types.NodeName, error) {
 	klog.V(4).Infof("CurrentNodeName(%v)", hostname)
-	return types.NodeName(hostname), nil
+	if cs.metadata == nil {
+		return types.NodeName(hostname), nil
+	}
+	localHostname, err := cs.metadata.localHostname(ctx)
+	if err != nil {
+		klog.Errorf("Unable to retrieve local hostname from metadata, using %q: %v", hostname, err)
+		return types.NodeName(hostname), nil
+	}
+	if localHostname == "" {
+		return types.NodeName(hostname), nil
+	}
+	return types.NodeName(localHostname), nil
 }
 
 // InstanceExistsByProviderID returns if the instance still exists.
@@ -1,7 +1,10 @@
 package cloudstack
 
 import (
+	"context"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -9,13 +12,16 @@ import (
 	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
 	"github.com/xanzy/go-cloudstack/v2/cloudstack"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 func Test_CSCloud_nodeAddresses(t *testing.T) {
 	tests := []struct {
-		config   globalConfig
-		vm       cloudstack.VirtualMachine
-		expected []v1.NodeAddress
+		config      globalConfig
+		internalNIC string
+		externalNIC string
+		vm          cloudstack.VirtualMachine
+		expected    []v1.NodeAddress
 	}{
 		{
 			vm: cloudstack.VirtualMachine{
@@ -132,6 +138,115 @@ func Test_CSCloud_nodeAddresses(t *testing.T) {
 				{Type: v1.NodeHostName, Address: "host1"},
 			},
 		},
+		{
+			config: globalConfig{
+				IPFamilies: "IPv4,IPv6",
+			},
+			vm: cloudstack.VirtualMachine{
+				Id:       "vm1",
+				Hostname: "host1",
+				Nic: []cloudstack.Nic{
+					{Ipaddress: "10.0.0.1", Ip6address: "fd00::1"},
+				},
+				Publicip: "200.0.0.1",
+			},
+			expected: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+				{Type: v1.NodeInternalIP, Address: "fd00::1"},
+				{Type: v1.NodeHostName, Address: "host1"},
+				{Type: v1.NodeExternalIP, Address: "200.0.0.1"},
+			},
+		},
+		{
+			config: globalConfig{
+				IPFamilies:      "IPv6,IPv4",
+				InternalIPIndex: 1,
+				ExternalIPIndex: 0,
+			},
+			vm: cloudstack.VirtualMachine{
+				Id:       "vm1",
+				Hostname: "host1",
+				Nic: []cloudstack.Nic{
+					{Ipaddress: "10.0.0.1", Ip6address: "2001:db8::1"},
+					{Ipaddress: "192.0.0.1", Ip6address: "fd00::1"},
+				},
+			},
+			expected: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "fd00::1"},
+				{Type: v1.NodeInternalIP, Address: "192.0.0.1"},
+				{Type: v1.NodeHostName, Address: "host1"},
+				{Type: v1.NodeExternalIP, Address: "2001:db8::1"},
+				{Type: v1.NodeExternalIP, Address: "10.0.0.1"},
+			},
+		},
+		{
+			config: globalConfig{
+				IPFamilies: "IPv4,IPv6",
+			},
+			vm: cloudstack.VirtualMachine{
+				Id:       "vm1",
+				Hostname: "host1",
+				Nic: []cloudstack.Nic{
+					{Ipaddress: "10.0.0.1"},
+				},
+			},
+			expected: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+				{Type: v1.NodeHostName, Address: "host1"},
+			},
+		},
+		{
+			internalNIC: "network-name=internal",
+			externalNIC: "traffic-type=public",
+			vm: cloudstack.VirtualMachine{
+				Id:       "vm1",
+				Hostname: "host1",
+				Nic: []cloudstack.Nic{
+					{Ipaddress: "10.0.0.1", Networkname: "other", Traffictype: "Public"},
+					{Ipaddress: "192.0.0.1", Networkname: "internal", Traffictype: "Guest"},
+				},
+			},
+			expected: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "192.0.0.1"},
+				{Type: v1.NodeHostName, Address: "host1"},
+				{Type: v1.NodeExternalIP, Address: "10.0.0.1"},
+			},
+		},
+		{
+			config: globalConfig{
+				InternalIPIndex: 1,
+			},
+			internalNIC: "network-id=net9",
+			vm: cloudstack.VirtualMachine{
+				Id:       "vm1",
+				Hostname: "host1",
+				Nic: []cloudstack.Nic{
+					{Ipaddress: "10.0.0.1", Networkid: "net1"},
+					{Ipaddress: "192.0.0.1", Networkid: "net2"},
+				},
+			},
+			expected: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "192.0.0.1"},
+				{Type: v1.NodeHostName, Address: "host1"},
+				{Type: v1.NodeExternalIP, Address: "10.0.0.1"},
+			},
+		},
+		{
+			internalNIC: "tag.role=internal",
+			vm: cloudstack.VirtualMachine{
+				Id:       "vm1",
+				Hostname: "host1",
+				Nic: []cloudstack.Nic{
+					{Id: "nic1", Ipaddress: "10.0.0.1"},
+					{Id: "nic-internal", Ipaddress: "192.0.0.1"},
+				},
+			},
+			expected: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "192.0.0.1"},
+				{Type: v1.NodeHostName, Address: "host1"},
+				{Type: v1.NodeExternalIP, Address: "10.0.0.1"},
+			},
+		},
 		{
 			config: globalConfig{},
 			vm: cloudstack.VirtualMachine{
@@ -157,6 +272,7 @@ func Test_CSCloud_nodeAddresses(t *testing.T) {
 		t.Run("", func(t *testing.T) {
 			srv := cloudstackFake.NewCloudstackServer()
 			defer srv.Close()
+			srv.AddTags("nic-internal", []cloudstack.Tags{{Key: "role", Value: "internal"}})
 			csCloud, err := newCSCloud(&CSConfig{
 				Global: tt.config,
 				Environment: map[string]*environmentConfig{
@@ -166,13 +282,41 @@ func Test_CSCloud_nodeAddresses(t *testing.T) {
 						SecretKey:       "b",
 						LBEnvironmentID: "1",
 						LBDomain:        "test.com",
+						InternalNIC:     tt.internalNIC,
+						ExternalNIC:     tt.externalNIC,
 					},
 				},
 			})
 			require.NoError(t, err)
-			addrs, err := csCloud.nodeAddresses(&tt.vm)
+			addrs, err := csCloud.nodeAddresses(&tt.vm, "env1")
 			require.NoError(t, err)
 			assert.Equal(t, tt.expected, addrs)
 		})
 	}
 }
+
+func Test_CSCloud_CurrentNodeName(t *testing.T) {
+	metadataSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/meta-data/local-hostname" {
+			w.Write([]byte("vm-host1"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer metadataSrv.Close()
+
+	cs := &CSCloud{}
+	name, err := cs.CurrentNodeName(context.Background(), "myhost")
+	require.NoError(t, err)
+	assert.Equal(t, types.NodeName("myhost"), name)
+
+	cs.metadata = newMetadataClient(metadataSrv.URL)
+	name, err = cs.CurrentNodeName(context.Background(), "myhost")
+	require.NoError(t, err)
+	assert.Equal(t, types.NodeName("vm-host1"), name)
+
+	metadataSrv.Close()
+	name, err = cs.CurrentNodeName(context.Background(), "myhost")
+	require.NoError(t, err)
+	assert.Equal(t, types.NodeName("myhost"), name)
+}
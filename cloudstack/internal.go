@@ -0,0 +1,226 @@
+package cloudstack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// lbScheme selects the CloudStack load balancer scheme, "Public" (the
+	// default) uses load balancer rules on public IPs while "Internal" uses
+	// internal load balancers on VPC tiers.
+	lbScheme = "csccm.cloudprovider.io/loadbalancer-scheme"
+	// lbSourceNetwork is the tier where the source IP of internal load
+	// balancers is allocated, defaults to the network of the nodes.
+	lbSourceNetwork = "csccm.cloudprovider.io/loadbalancer-source-network"
+	// createInternalLoadBalancerExtraParamPrefix sets extra params on the
+	// createLoadBalancer command, which shares its name with the legacy
+	// createLoadBalancerRule prefix.
+	createInternalLoadBalancerExtraParamPrefix = "csccm.cloudprovider.io/createinternalloadbalancer-extra-param-"
+
+	lbSchemePublic   = "Public"
+	lbSchemeInternal = "Internal"
+)
+
+type listLoadBalancersResponse struct {
+	Count         int                        `json:"count"`
+	LoadBalancers []*cloudstack.LoadBalancer `json:"loadbalancer"`
+}
+
+// isInternalLB indicates whether the service requests an internal load
+// balancer.
+func isInternalLB(service *v1.Service) (bool, error) {
+	value, _ := getLabelOrAnnotation(service.ObjectMeta, lbScheme)
+	switch {
+	case value == "" || strings.EqualFold(value, lbSchemePublic):
+		return false, nil
+	case strings.EqualFold(value, lbSchemeInternal):
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid value for %q: %q, expected %q or %q", lbScheme, value, lbSchemePublic, lbSchemeInternal)
+}
+
+// withoutScheme returns a copy of the service without the scheme label or
+// annotation.
+func withoutScheme(service *v1.Service) *v1.Service {
+	service = service.DeepCopy()
+	delete(service.Labels, lbScheme)
+	delete(service.Annotations, lbScheme)
+	return service
+}
+
+// loadPreviousSchemeRule looks up the rule of the other scheme tagged for the
+// service, left behind when the scheme of the service changes. It is recorded
+// as stale to be deleted.
+func (lb *loadBalancer) loadPreviousSchemeRule(client *cloudstack.CloudStackClient) error {
+	previous := &loadBalancer{
+		cloud:    lb.cloud,
+		name:     lb.name,
+		service:  lb.service,
+		internal: !lb.internal,
+	}
+	err := previous.loadRule(client)
+	if err != nil {
+		return err
+	}
+	if previous.rule == nil {
+		return nil
+	}
+	if previous.internal {
+		// The source IP of internal load balancers is released with them.
+		previous.ip = cloudstackIP{}
+	}
+	klog.V(3).Infof("Found load balancer %v of the previous scheme of service %s/%s", previous, lb.service.Namespace, lb.service.Name)
+	lb.stale = append(lb.stale, previous)
+	return nil
+}
+
+// getInternalLoadBalancer retrieves the internal load balancer by name or by
+// the service tags. Internal load balancers are mapped into load balancer
+// rules with the source IP and ports as the public ones.
+func getInternalLoadBalancer(client *cloudstack.CloudStackClient, service *v1.Service, lbName, projectID string) (*loadBalancerRule, error) {
+	p := &cloudstack.CustomServiceParams{}
+	p.SetParam("name", lbName)
+	p.SetParam("listall", true)
+	if projectID != "" {
+		p.SetParam("projectid", projectID)
+	}
+	var result listLoadBalancersResponse
+	err := client.Custom.CustomRequest("listLoadBalancers", p, &result)
+	if err != nil {
+		return nil, err
+	}
+	var matches []*cloudstack.LoadBalancer
+	for _, l := range result.LoadBalancers {
+		if l.Name == lbName {
+			matches = append(matches, l)
+		}
+	}
+
+	if len(matches) == 0 {
+		p = &cloudstack.CustomServiceParams{}
+		p.SetParam("listall", true)
+		if projectID != "" {
+			p.SetParam("projectid", projectID)
+		}
+		tags := tagsForService(service)
+		p.SetParam("tags[0].key", serviceTag)
+		p.SetParam("tags[0].value", tags[serviceTag])
+		result = listLoadBalancersResponse{}
+		err = client.Custom.CustomRequest("listLoadBalancers", p, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range result.LoadBalancers {
+			if matchAllTags(l.Tags, tags) && matchVIP(l.Tags, "") {
+				matches = append(matches, l)
+			}
+		}
+	}
+
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("internal lb %q too many load balancers associated: %#v", lbName, matches)
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	return internalLBToRule(matches[0]), nil
+}
+
+func internalLBToRule(l *cloudstack.LoadBalancer) *loadBalancerRule {
+	rule := &loadBalancerRule{
+		LoadBalancerRule: &cloudstack.LoadBalancerRule{
+			Id:        l.Id,
+			Algorithm: l.Algorithm,
+			Name:      l.Name,
+			Networkid: l.Networkid,
+			Publicip:  l.Sourceipaddress,
+			Protocol:  string(v1.ProtocolTCP),
+			Tags:      l.Tags,
+		},
+	}
+	if len(l.Loadbalancerrule) > 0 {
+		rule.Publicport = strconv.Itoa(l.Loadbalancerrule[0].Sourceport)
+		rule.Privateport = strconv.Itoa(l.Loadbalancerrule[0].Instanceport)
+	}
+	return rule
+}
+
+// internalNeedsRecreate indicates whether the internal load balancer must be
+// created again as its algorithm and source IP cannot be updated.
+func (lb *loadBalancer) internalNeedsRecreate() bool {
+	if !lb.internal || lb.rule == nil {
+		return false
+	}
+	if lb.rule.Algorithm != lb.algorithm {
+		return true
+	}
+	sourceIP := lb.service.Spec.LoadBalancerIP
+	return sourceIP != "" && sourceIP != lb.rule.Publicip
+}
+
+// createInternalLoadBalancer creates an internal load balancer in the tier of
+// the nodes. Internal load balancers support a single TCP port.
+func (lb *loadBalancer) createInternalLoadBalancer() (*loadBalancerRule, error) {
+	client, err := lb.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ports, err := serviceToLBPorts(lb)
+	if err != nil {
+		return nil, err
+	}
+	if ports.protocol != v1.ProtocolTCP {
+		return nil, fmt.Errorf("unsupported protocol %v for internal load balancer %v", ports.protocol, lb)
+	}
+	if len(ports.additionalPorts()) > 0 {
+		return nil, fmt.Errorf("internal load balancer %v supports a single port, got %d", lb, len(ports.additionalPorts())+1)
+	}
+
+	sourceNetworkID, _ := getLabelOrAnnotation(lb.service.ObjectMeta, lbSourceNetwork)
+	if sourceNetworkID == "" {
+		sourceNetworkID = lb.mainNetworkID
+	}
+
+	p := lb.cloud.newCommandParams("createLoadBalancer", lb.service)
+	p.SetParam("algorithm", lb.algorithm)
+	p.SetParam("name", lb.name)
+	p.SetParam("scheme", lbSchemeInternal)
+	p.SetParam("sourceport", ports.publicPort())
+	p.SetParam("instanceport", ports.privatePort())
+	p.SetParam("networkid", lb.mainNetworkID)
+	p.SetParam("sourceipaddressnetworkid", sourceNetworkID)
+	if lb.service.Spec.LoadBalancerIP != "" {
+		p.SetParam("sourceipaddress", lb.service.Spec.LoadBalancerIP)
+	}
+	if lb.cloud.projectID != "" {
+		p.SetParam("projectid", lb.cloud.projectID)
+	}
+
+	hookParams, err := lb.cloud.beforeHook(lb.hookRequest(hookStepRuleCreated))
+	if err != nil {
+		return nil, err
+	}
+	hookParams.apply(p)
+
+	var r cloudstack.LoadBalancer
+	err = client.Custom.CustomRequest("createLoadBalancer", p, &r)
+	if err != nil {
+		return nil, fmt.Errorf("error creating internal load balancer for %v: %v", lb, err)
+	}
+	if r.JobID != "" {
+		err = waitJob(client, r.JobID, &r)
+		if err != nil {
+			return nil, fmt.Errorf("error waiting for internal load balancer job for %v: %v", lb, err)
+		}
+	}
+	klog.V(4).Infof("Created internal load balancer %v with source IP %v", lb, r.Sourceipaddress)
+
+	return internalLBToRule(&r), nil
+}
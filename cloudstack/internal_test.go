@@ -0,0 +1,294 @@
+package cloudstack
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_isInternalLB(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected bool
+		err      string
+	}{
+		{value: "", expected: false},
+		{value: "Public", expected: false},
+		{value: "internal", expected: true},
+		{value: "Internal", expected: true},
+		{value: "private", err: `invalid value for "csccm.cloudprovider.io/loadbalancer-scheme": "private", expected "Public" or "Internal"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+			if tt.value != "" {
+				svc.Annotations["csccm.cloudprovider.io/loadbalancer-scheme"] = tt.value
+			}
+			internal, err := isInternalLB(svc)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, internal)
+		})
+	}
+}
+
+func Test_CSCloud_internalLoadBalancer(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Command: commandConfig{
+			AssignNetworks: "assignNetworkToLBRule",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				RemoveLBs:       true,
+			},
+		},
+	}, nil)
+
+	nodes := []*corev1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "n1",
+				Labels: map[string]string{
+					"my/project-label":  "11111111-2222-3333-4444-555555555555",
+					"environment-label": "env1",
+				},
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-scheme": "Internal",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			LoadBalancerIP: "10.1.1.5",
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	ensure := func() *corev1.LoadBalancerStatus {
+		srv.Calls = nil
+		cs.updateLBQueue.start(context.Background())
+		lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), nodes)
+		cs.updateLBQueue.stopWait()
+		require.NoError(t, err)
+		return lbStatus
+	}
+
+	lbStatus := ensure()
+	assert.Equal(t, &corev1.LoadBalancerStatus{
+		Ingress: []corev1.LoadBalancerIngress{{IP: "10.1.1.5", Hostname: "svc1.test.com"}},
+	}, lbStatus)
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listVirtualMachines"},
+		{Command: "listLoadBalancers", Params: url.Values{"name": []string{"svc1.test.com"}}},
+		{Command: "listLoadBalancers", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+		{Command: "createLoadBalancer", Params: url.Values{
+			"name":                     []string{"svc1.test.com"},
+			"scheme":                   []string{"Internal"},
+			"sourceport":               []string{"8080"},
+			"instanceport":             []string{"30001"},
+			"networkid":                []string{"net1"},
+			"sourceipaddressnetworkid": []string{"net1"},
+			"sourceipaddress":          []string{"10.1.1.5"},
+		}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "createTags", Params: url.Values{"resourceids": []string{"internal-lb-1"}, "resourcetype": []string{"LoadBalancer"}, "tags[0].key": []string{"cloudprovider"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "createTags", Params: url.Values{"resourceids": []string{"internal-lb-1"}, "resourcetype": []string{"LoadBalancer"}, "tags[0].key": []string{"kubernetes_namespace"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "createTags", Params: url.Values{"resourceids": []string{"internal-lb-1"}, "resourcetype": []string{"LoadBalancer"}, "tags[0].key": []string{"kubernetes_service"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"internal-lb-1"}}},
+		{Command: "assignToLoadBalancerRule", Params: url.Values{"id": []string{"internal-lb-1"}, "virtualmachineids": []string{"vm1"}}},
+		{Command: "queryAsyncJobResult"},
+	})
+
+	lbStatus = ensure()
+	assert.Equal(t, "10.1.1.5", lbStatus.Ingress[0].IP)
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listLoadBalancers", Params: url.Values{"name": []string{"svc1.test.com"}}},
+		{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"internal-lb-1"}}},
+	})
+
+	srv.Calls = nil
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc)
+	require.NoError(t, err)
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listLoadBalancers", Params: url.Values{"name": []string{"svc1.test.com"}}},
+		{Command: "deleteLoadBalancer", Params: url.Values{"id": []string{"internal-lb-1"}}},
+		{Command: "queryAsyncJobResult"},
+	})
+}
+
+func Test_CSCloud_internalLoadBalancerMultiplePorts(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+			},
+		},
+	}, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-scheme": "Internal",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+				{Port: 8443, NodePort: 30002, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+	_, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*corev1.Node{node})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "supports a single port, got 2")
+}
+
+func Test_CSCloud_internalLoadBalancerSchemeChange(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				RemoveLBs:       true,
+			},
+		},
+	}, nil)
+
+	nodes := []*corev1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "n1",
+				Labels: map[string]string{
+					"my/project-label":  "11111111-2222-3333-4444-555555555555",
+					"environment-label": "env1",
+				},
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	ensure := func() {
+		srv.Calls = nil
+		cs.updateLBQueue.start(context.Background())
+		lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), nodes)
+		cs.updateLBQueue.stopWait()
+		require.NoError(t, err)
+		svc.Status.LoadBalancer = *lbStatus
+	}
+	deleteCalls := func() []cloudstackFake.MockAPICall {
+		var calls []cloudstackFake.MockAPICall
+		for _, call := range srv.Calls {
+			switch call.Command {
+			case "deleteLoadBalancerRule", "deleteLoadBalancer", "disassociateIpAddress":
+				calls = append(calls, call)
+			}
+		}
+		return calls
+	}
+
+	ensure()
+	assert.Equal(t, "10.0.0.1", svc.Status.LoadBalancer.Ingress[0].IP)
+
+	svc.Annotations["csccm.cloudprovider.io/loadbalancer-scheme"] = "Internal"
+	ensure()
+	assert.Equal(t, "10.1.0.1", svc.Status.LoadBalancer.Ingress[0].IP)
+	srv.Calls = deleteCalls()
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "deleteLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}}},
+		{Command: "disassociateIpAddress", Params: url.Values{"id": []string{"ip-1"}}},
+	})
+
+	srv.Calls = nil
+	svc.Annotations["csccm.cloudprovider.io/loadbalancer-scheme"] = "private"
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc)
+	require.NoError(t, err)
+	srv.Calls = deleteCalls()
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "deleteLoadBalancer", Params: url.Values{"id": []string{"internal-lb-1"}}},
+	})
+}
@@ -0,0 +1,282 @@
+package cloudstack
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	ipPoolTag = "kubernetes_ip_pool"
+
+	ipPoolFree    = "free"
+	ipPoolClaimed = "claimed"
+
+	defaultIPPoolFillInterval = time.Minute
+
+	promIPPoolSubsystem = "ip_pool"
+)
+
+var (
+	ipPoolFreeIPs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Subsystem: promIPPoolSubsystem,
+		Name:      "free",
+		Help:      "The number of free IP addresses in the reserved IP pool",
+	}, []string{"environment", "project"})
+
+	ipPoolClaimedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promIPPoolSubsystem,
+		Name:      "claimed_total",
+		Help:      "The number of IP addresses claimed from the reserved IP pool",
+	}, []string{"environment", "project"})
+
+	ipPoolReturnedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promIPPoolSubsystem,
+		Name:      "returned_total",
+		Help:      "The number of IP addresses returned to the reserved IP pool",
+	}, []string{"environment", "project"})
+)
+
+type ipPoolConfig struct {
+	size      int
+	networkID string
+	projects  []string
+}
+
+func newIPPoolConfig(env *environmentConfig) (ipPoolConfig, error) {
+	if env.IPPoolSize <= 0 {
+		return ipPoolConfig{}, nil
+	}
+	if env.IPPoolNetworkID == "" {
+		return ipPoolConfig{}, fmt.Errorf("ip-pool-network-id is required when ip-pool-size is set")
+	}
+	cfg := ipPoolConfig{
+		size:      env.IPPoolSize,
+		networkID: env.IPPoolNetworkID,
+	}
+	for _, project := range strings.Split(env.IPPoolProjects, ",") {
+		project = strings.TrimSpace(project)
+		if project != "" {
+			cfg.projects = append(cfg.projects, project)
+		}
+	}
+	if len(cfg.projects) == 0 {
+		cfg.projects = []string{env.ProjectID}
+	}
+	return cfg, nil
+}
+
+func (c ipPoolConfig) hasProject(projectID string) bool {
+	for _, project := range c.projects {
+		if project == projectID {
+			return true
+		}
+	}
+	return false
+}
+
+// ipPoolEnabled indicates whether the environment and project have a reserved
+// IP pool.
+func (pc *projectCloud) ipPoolEnabled() bool {
+	pool := pc.environments[pc.environment].ipPool
+	return pool.size > 0 && pool.hasProject(pc.projectID)
+}
+
+// listPoolIPs returns the free IP addresses in the pool for the network,
+// sorted by address.
+func (pc *projectCloud) listPoolIPs(networkID string) ([]cloudstackIP, error) {
+	client, err := pc.getClient()
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{
+		cloudProviderTag: ProviderName,
+		ipPoolTag:        ipPoolFree,
+	}
+	p := client.Address.NewListPublicIpAddressesParams()
+	p.SetListall(true)
+	p.SetTags(map[string]string{
+		ipPoolTag: ipPoolFree,
+	})
+	if pc.projectID != "" {
+		p.SetProjectid(pc.projectID)
+	}
+	publicIPAddresses, err := listAllIPPages(client, p)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving pool IP addresses: %v", err)
+	}
+	var ips []cloudstackIP
+	for _, publicIP := range publicIPAddresses {
+		if !matchAllTags(publicIP.Tags, tags) || publicIP.Networkid != networkID {
+			continue
+		}
+		// IPs claimed by a service that failed to complete the claim are
+		// left out of the pool.
+		if _, ok := getTag(publicIP.Tags, serviceTag); ok {
+			continue
+		}
+		ips = append(ips, cloudstackIP{
+			id:        publicIP.Id,
+			address:   publicIP.Ipaddress,
+			networkid: publicIP.Networkid,
+		})
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return ips[i].address < ips[j].address
+	})
+	return ips, nil
+}
+
+// claimPoolIP claims a free IP from the reserved IP pool tagging it for the
+// service. If the pool is disabled or empty it returns nil with no error.
+//
+// The service tags are added before the IP is marked as claimed so that an
+// interrupted claim leaves the IP owned by the service instead of free.
+func (pc *projectCloud) claimPoolIP(service *v1.Service, lbName, networkID, vip string) (*cloudstackIP, error) {
+	if vip != "" || !pc.ipPoolEnabled() {
+		return nil, nil
+	}
+	pc.ipPoolLock.Lock()
+	defer pc.ipPoolLock.Unlock()
+	ips, err := pc.listPoolIPs(networkID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		klog.V(3).Infof("No free IP in pool for environment %q project %q network %q, allocating a new IP", pc.environment, pc.projectID, networkID)
+		return nil, nil
+	}
+	ip := ips[0]
+	klog.V(4).Infof("Claiming pool IP %v for service (%v, %v)", ip, service.Namespace, service.Name)
+	err = pc.claimIPWithHooks(service, lbName, networkID, vip, &ip, func() error {
+		err := pc.assignTagsToIP(&ip, service, vip)
+		if err != nil {
+			return err
+		}
+		return pc.setPoolTag(ip.id, ipPoolClaimed)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ipPoolClaimedTotal.WithLabelValues(pc.environment, pc.projectID).Inc()
+	ipPoolFreeIPs.WithLabelValues(pc.environment, pc.projectID).Set(float64(len(ips) - 1))
+	return &ip, nil
+}
+
+// returnPoolIP returns a claimed IP to the reserved IP pool instead of
+// releasing it. Surplus free IPs are released when the pool is filled.
+//
+// The service tags are removed before the IP is marked as free so that an
+// interrupted return leaves the IP out of the pool instead of free and still
+// owned by the service.
+func (pc *projectCloud) returnPoolIP(ip cloudstackIP) error {
+	klog.V(4).Infof("Returning IP %s to pool", ip)
+	pc.ipPoolLock.Lock()
+	defer pc.ipPoolLock.Unlock()
+	err := pc.deleteResourceTags(CloudstackResourceIPAdress, ip.id, []string{serviceTag, namespaceTag, vipTag})
+	if err != nil {
+		return err
+	}
+	err = pc.setPoolTag(ip.id, ipPoolFree)
+	if err != nil {
+		return err
+	}
+	ipPoolReturnedTotal.WithLabelValues(pc.environment, pc.projectID).Inc()
+	return nil
+}
+
+func (pc *projectCloud) setPoolTag(ipID, value string) error {
+	err := pc.deleteResourceTags(CloudstackResourceIPAdress, ipID, []string{ipPoolTag})
+	if err != nil {
+		return err
+	}
+	return pc.setResourceTags(CloudstackResourceIPAdress, ipID, map[string]string{
+		ipPoolTag: value,
+	})
+}
+
+// fillIPPool allocates IPs in the pool network until the pool has the
+// configured number of free IPs. Surplus free IPs, returned by deleted
+// services, are released starting from the highest address.
+func (pc *projectCloud) fillIPPool() error {
+	pool := pc.environments[pc.environment].ipPool
+	pc.ipPoolLock.Lock()
+	defer pc.ipPoolLock.Unlock()
+	ips, err := pc.listPoolIPs(pool.networkID)
+	if err != nil {
+		return err
+	}
+	free := len(ips)
+	defer func() {
+		ipPoolFreeIPs.WithLabelValues(pc.environment, pc.projectID).Set(float64(free))
+	}()
+	for ; free > pool.size; free-- {
+		ip := ips[free-1]
+		err = pc.releaseLoadBalancerIP(ip, nil)
+		if err != nil {
+			return err
+		}
+		klog.V(3).Infof("Released surplus IP %s from pool for environment %q project %q", ip, pc.environment, pc.projectID)
+	}
+	for ; free < pool.size; free++ {
+		ip, err := pc.associateIP(nil, "", pool.networkID, "", nil)
+		if err != nil {
+			return err
+		}
+		err = pc.setResourceTags(CloudstackResourceIPAdress, ip.id, map[string]string{
+			cloudProviderTag: ProviderName,
+			ipPoolTag:        ipPoolFree,
+		})
+		if err != nil {
+			rollbackErr := pc.releaseLoadBalancerIP(*ip, nil)
+			if rollbackErr != nil {
+				err = fmt.Errorf("%v: error rolling back IP address: %v", err, rollbackErr)
+			}
+			return err
+		}
+		klog.V(3).Infof("Added IP %s to pool for environment %q project %q", ip, pc.environment, pc.projectID)
+	}
+	return nil
+}
+
+// fillIPPools keeps every configured reserved IP pool topped up until the
+// context is done.
+func (cs *CSCloud) fillIPPools(ctx context.Context) {
+	var envNames []string
+	for name, env := range cs.environments {
+		if env.ipPool.size > 0 {
+			envNames = append(envNames, name)
+		}
+	}
+	if len(envNames) == 0 {
+		return
+	}
+	sort.Strings(envNames)
+	ticker := time.NewTicker(cs.ipPoolFillInterval)
+	defer ticker.Stop()
+	for {
+		for _, name := range envNames {
+			for _, projectID := range cs.environments[name].ipPool.projects {
+				pc := &projectCloud{CSCloud: cs, environment: name, projectID: projectID}
+				if err := pc.fillIPPool(); err != nil {
+					klog.Errorf("Unable to fill IP pool for environment %q project %q: %v", name, projectID, err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
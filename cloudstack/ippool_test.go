@@ -0,0 +1,176 @@
+package cloudstack
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_newIPPoolConfig(t *testing.T) {
+	tests := []struct {
+		env      environmentConfig
+		expected ipPoolConfig
+		err      string
+	}{
+		{env: environmentConfig{}, expected: ipPoolConfig{}},
+		{
+			env:      environmentConfig{IPPoolSize: 2, IPPoolNetworkID: "net1", ProjectID: "p1"},
+			expected: ipPoolConfig{size: 2, networkID: "net1", projects: []string{"p1"}},
+		},
+		{
+			env:      environmentConfig{IPPoolSize: 2, IPPoolNetworkID: "net1", ProjectID: "p1", IPPoolProjects: "p2, p3,"},
+			expected: ipPoolConfig{size: 2, networkID: "net1", projects: []string{"p2", "p3"}},
+		},
+		{
+			env: environmentConfig{IPPoolSize: 2},
+			err: "ip-pool-network-id is required when ip-pool-size is set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			cfg, err := newIPPoolConfig(&tt.env)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, cfg)
+		})
+	}
+}
+
+func Test_CSCloud_ipPoolClaimAndReturn(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	projectID := "11111111-2222-3333-4444-555555555555"
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				RemoveLBs:       true,
+				IPPoolSize:      2,
+				IPPoolNetworkID: "net1",
+				IPPoolProjects:  projectID,
+			},
+		},
+	}, nil)
+	pc := &projectCloud{CSCloud: cs, environment: "env1", projectID: projectID}
+
+	err := pc.fillIPPool()
+	require.NoError(t, err)
+	ips, err := pc.listPoolIPs("net1")
+	require.NoError(t, err)
+	require.Len(t, ips, 2)
+	assert.Equal(t, "10.0.0.1", ips[0].address)
+	assert.Equal(t, "10.0.0.2", ips[1].address)
+
+	// Pool is full, nothing is allocated.
+	srv.Calls = nil
+	err = pc.fillIPPool()
+	require.NoError(t, err)
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listPublicIpAddresses", Params: url.Values{"projectid": []string{projectID}}},
+	})
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  projectID,
+				"environment-label": "env1",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err = cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	cs.updateLBQueue.start(context.Background())
+	lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*corev1.Node{node})
+	cs.updateLBQueue.stopWait()
+	require.NoError(t, err)
+	assert.Equal(t, []corev1.LoadBalancerIngress{{IP: "10.0.0.1", Hostname: "svc1.test.com"}}, lbStatus.Ingress)
+	for _, call := range srv.Calls {
+		assert.NotEqual(t, "associateIpAddress", call.Command)
+	}
+	ips, err = pc.listPoolIPs("net1")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, "10.0.0.2", ips[0].address)
+	ip, err := pc.tryPublicIPAddressByTags(svc, "")
+	require.NoError(t, err)
+	require.NotNil(t, ip)
+	assert.Equal(t, "10.0.0.1", ip.address)
+
+	err = pc.fillIPPool()
+	require.NoError(t, err)
+	ips, err = pc.listPoolIPs("net1")
+	require.NoError(t, err)
+	require.Len(t, ips, 2)
+
+	srv.Calls = nil
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc)
+	require.NoError(t, err)
+	var returnCalls []cloudstackFake.MockAPICall
+	for _, call := range srv.Calls {
+		assert.NotEqual(t, "disassociateIpAddress", call.Command)
+		if call.Command == "createTags" || call.Command == "deleteTags" {
+			returnCalls = append(returnCalls, call)
+		}
+	}
+	srv.Calls = returnCalls
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "deleteTags", Params: url.Values{"resourceids": []string{"ip-1"}}},
+		{Command: "deleteTags", Params: url.Values{"resourceids": []string{"ip-1"}, "tags[0].key": []string{"kubernetes_ip_pool"}}},
+		{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-1"}, "tags[0].key": []string{"kubernetes_ip_pool"}, "tags[0].value": []string{"free"}}},
+	})
+	ips, err = pc.listPoolIPs("net1")
+	require.NoError(t, err)
+	require.Len(t, ips, 3)
+	assert.Equal(t, "10.0.0.1", ips[0].address)
+	ip, err = pc.tryPublicIPAddressByTags(svc, "")
+	require.NoError(t, err)
+	assert.Nil(t, ip)
+
+	// Surplus IPs are released when the pool is filled.
+	srv.Calls = nil
+	err = pc.fillIPPool()
+	require.NoError(t, err)
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listPublicIpAddresses", Params: url.Values{"projectid": []string{projectID}}},
+		{Command: "disassociateIpAddress", Params: url.Values{"id": []string{"ip-3"}}},
+		{Command: "queryAsyncJobResult"},
+	})
+	ips, err = pc.listPoolIPs("net1")
+	require.NoError(t, err)
+	require.Len(t, ips, 2)
+	assert.Equal(t, "10.0.0.1", ips[0].address)
+	assert.Equal(t, "10.0.0.2", ips[1].address)
+}
@@ -0,0 +1,31 @@
+package cloudstack
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// lbClass is the load balancer class of the service, replacing the
+	// spec.loadBalancerClass field missing in the Kubernetes version
+	// supported. Unlike the field it may change, services moving to another
+	// class have their load balancer deleted.
+	lbClass = "csccm.cloudprovider.io/loadbalancer-class"
+)
+
+// loadBalancerClass returns the load balancer class of the service.
+func loadBalancerClass(service *v1.Service) string {
+	class, _ := getLabelOrAnnotation(service.ObjectMeta, lbClass)
+	return class
+}
+
+// claimsService returns whether the load balancer of the service is managed
+// by the provider. Services without a class are claimed unless
+// lb-class-ignore-unset is set, services with a class only if it matches
+// lb-class.
+func (cs *CSCloud) claimsService(service *v1.Service) bool {
+	class := loadBalancerClass(service)
+	if class == "" {
+		return !cs.config.Global.LBClassIgnoreUnset
+	}
+	return class == cs.config.Global.LBClass
+}
@@ -0,0 +1,240 @@
+package cloudstack
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_CSCloud_claimsService(t *testing.T) {
+	tests := []struct {
+		name        string
+		global      globalConfig
+		labels      map[string]string
+		annotations map[string]string
+		expected    bool
+	}{
+		{
+			name:     "no class",
+			expected: true,
+		},
+		{
+			name:        "other class",
+			annotations: map[string]string{lbClass: "metallb"},
+			expected:    false,
+		},
+		{
+			name:        "configured class",
+			global:      globalConfig{LBClass: "csccm"},
+			annotations: map[string]string{lbClass: "csccm"},
+			expected:    true,
+		},
+		{
+			name:     "configured class from label",
+			global:   globalConfig{LBClass: "csccm"},
+			labels:   map[string]string{lbClass: "csccm"},
+			expected: true,
+		},
+		{
+			name:     "no class with configured class",
+			global:   globalConfig{LBClass: "csccm"},
+			expected: true,
+		},
+		{
+			name:     "no class ignored",
+			global:   globalConfig{LBClass: "csccm", LBClassIgnoreUnset: true},
+			expected: false,
+		},
+		{
+			name:        "configured class with no class ignored",
+			global:      globalConfig{LBClass: "csccm", LBClassIgnoreUnset: true},
+			annotations: map[string]string{lbClass: "csccm"},
+			expected:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := &CSCloud{config: CSConfig{Global: tt.global}}
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "svc1",
+					Namespace:   "myns",
+					Labels:      tt.labels,
+					Annotations: tt.annotations,
+				},
+			}
+			assert.Equal(t, tt.expected, cs.claimsService(svc))
+		})
+	}
+}
+
+func Test_CSCloud_otherLoadBalancerClass(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+			LBClass:          "csccm",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				RemoveLBs:       true,
+			},
+		},
+	}, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{lbClass: "metallb"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: "192.168.0.10"}},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	lookupCalls := []cloudstackFake.MockAPICall{
+		{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"svc1.test.com"}}},
+		{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+	}
+
+	cs.updateLBQueue.start(context.Background())
+	lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*corev1.Node{node})
+	require.NoError(t, err)
+	assert.Equal(t, &svc.Status.LoadBalancer, lbStatus)
+	err = cs.UpdateLoadBalancer(context.Background(), "kubernetes", svc, []*corev1.Node{node})
+	require.NoError(t, err)
+	cs.updateLBQueue.stopWait()
+	_, exists, err := cs.GetLoadBalancer(context.Background(), "kubernetes", svc)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc)
+	require.NoError(t, err)
+	// The service is only checked once.
+	srv.HasCalls(t, lookupCalls)
+	srv.Calls = nil
+
+	otherEnv := svc.DeepCopy()
+	otherEnv.Labels["environment-label"] = "env2"
+	lbStatus, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", otherEnv, []*corev1.Node{node})
+	require.NoError(t, err)
+	assert.Equal(t, &otherEnv.Status.LoadBalancer, lbStatus)
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", otherEnv)
+	require.NoError(t, err)
+	assert.Empty(t, srv.Calls)
+
+	svc.Annotations[lbClass] = "csccm"
+	cs.updateLBQueue.start(context.Background())
+	lbStatus, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*corev1.Node{node})
+	cs.updateLBQueue.stopWait()
+	require.NoError(t, err)
+	assert.Equal(t, "svc1.test.com", lbStatus.Ingress[0].Hostname)
+	srv.Calls = nil
+
+	svc.Annotations[lbClass] = "metallb"
+	lbStatus, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*corev1.Node{node})
+	require.NoError(t, err)
+	assert.Equal(t, &svc.Status.LoadBalancer, lbStatus)
+	srv.HasCalls(t, append(lookupCalls[:1:1],
+		cloudstackFake.MockAPICall{Command: "deleteLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}}},
+		cloudstackFake.MockAPICall{Command: "queryAsyncJobResult"},
+		cloudstackFake.MockAPICall{Command: "listPublicIpAddresses", Params: url.Values{"id": []string{"ip-1"}}},
+		cloudstackFake.MockAPICall{Command: "disassociateIpAddress", Params: url.Values{"id": []string{"ip-1"}}},
+		cloudstackFake.MockAPICall{Command: "queryAsyncJobResult"},
+	))
+}
+
+func Test_CSCloud_otherLoadBalancerClassUntaggedRule(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	srv.AddLBRule("svc1.test.com", cloudstackFake.LoadBalancerRule{Rule: map[string]interface{}{
+		"id":         "lbrule-1",
+		"name":       "svc1.test.com",
+		"publicip":   "10.0.0.1",
+		"publicipid": "ip-1",
+		"networkid":  "net1",
+	}})
+	srv.AddIP(cloudstack.PublicIpAddress{Id: "ip-1", Ipaddress: "10.0.0.1"})
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+			LBClass:          "csccm",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				RemoveLBs:       true,
+			},
+		},
+	}, nil)
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{lbClass: "metallb"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{Hostname: "svc1.test.com"}},
+			},
+		},
+	}
+
+	// A rule not tagged for the service is not deleted even if the status
+	// hostname matches its name.
+	lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nil)
+	require.NoError(t, err)
+	assert.Equal(t, &svc.Status.LoadBalancer, lbStatus)
+	for _, call := range srv.Calls {
+		assert.NotEqual(t, "deleteLoadBalancerRule", call.Command)
+	}
+}
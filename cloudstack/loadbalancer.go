@@ -21,7 +21,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -39,6 +41,12 @@ const (
 	lbNameLabel     = "csccm.cloudprovider.io/loadbalancer-name"
 	lbNameSuffix    = "csccm.cloudprovider.io/loadbalancer-name-suffix"
 	lbUseTargetPort = "csccm.cloudprovider.io/loadbalancer-use-targetport"
+	lbIPFamilies    = "csccm.cloudprovider.io/loadbalancer-ip-families"
+	lbNodeSelector  = "csccm.cloudprovider.io/loadbalancer-node-selector"
+	// lbAdditionalVIPs lists additional VIPs for the service as comma
+	// separated name=network:<network-id> or name=ip:<address> entries.
+	lbAdditionalVIPs = "csccm.cloudprovider.io/loadbalancer-additional-vips"
+	lbRetainIP       = "csccm.cloudprovider.io/loadbalancer-retain-ip"
 
 	associateIPAddressExtraParamPrefix = "csccm.cloudprovider.io/associateipaddress-extra-param-"
 	createLoadBalancerExtraParamPrefix = "csccm.cloudprovider.io/createloadbalancer-extra-param-"
@@ -52,6 +60,9 @@ const (
 	serviceTag             = "kubernetes_service"
 	namespaceTag           = "kubernetes_namespace"
 	cloudProviderIgnoreTag = "cloudprovider-ignore"
+	vipTag                 = "kubernetes_vip"
+
+	vipIPv6 = "ipv6"
 
 	CloudstackResourceIPAdress     = "PublicIpAddress"
 	CloudstackResourceLoadBalancer = "LoadBalancer"
@@ -72,12 +83,46 @@ type loadBalancer struct {
 	ip            cloudstackIP
 	rule          *loadBalancerRule
 	service       *v1.Service
+
+	// vip identifies an additional VIP exposing the same service, it is
+	// empty for the main load balancer. Additional VIPs have their own IP
+	// address and rule, sharing the members of the main load balancer.
+	vip  string
+	vips []*loadBalancer
+	// vipAddress is the IP address requested for an additional VIP.
+	vipAddress string
+	// vipNetworkID is the network requested for an additional VIP, if empty
+	// the network of the main load balancer is used.
+	vipNetworkID string
+	// stale are load balancers with resources tagged for the service which
+	// are no longer requested by it: removed additional VIPs and the rule of
+	// the previous scheme.
+	stale []*loadBalancer
+
+	// internal indicates the service uses a CloudStack internal load
+	// balancer, its rule is the internal load balancer and its IP the
+	// source IP in the VPC tier.
+	internal bool
+
+	// zoneNetworks holds the networks of the members keyed by zone.
+	zoneNetworks map[string][]string
+
+	// networkNodes holds the number of members in each network, used to
+	// choose the VPC tier of new rules.
+	networkNodes map[string]int
+
+	// dnsHostname is the hostname whose DNS records are managed, loaded
+	// from the rule tags before the rule is updated or created again.
+	dnsHostname string
 }
 
 type cloudstackIP struct {
 	id        string
 	address   string
 	networkid string
+	zoneid    string
+	// Indicates the IP was retained after its service was deleted.
+	retained bool
 }
 
 type loadBalancerRule struct {
@@ -96,6 +141,13 @@ type globoNetworkPool struct {
 	HealthCheckType     string `json:"healthchecktype"`
 	HealthCheck         string `json:"healthcheck"`
 	HealthCheckExpected string `json:"healthcheckexpect"`
+	HealthCheckInterval int    `json:"healthcheckinterval"`
+	HealthCheckTimeout  int    `json:"healthchecktimeout"`
+	ProxyProtocol       string `json:"proxyprotocol"`
+	MaxConn             int    `json:"maxconn"`
+	L4Protocol          string `json:"l4protocol"`
+	L7Protocol          string `json:"l7protocol"`
+	ServiceDownAction   string `json:"servicedownaction"`
 	Id                  int    `json:"id"`
 }
 
@@ -112,6 +164,15 @@ func (e IPNotFoundError) Error() string {
 	return fmt.Sprintf("could not find IP address %v", e.ip)
 }
 
+type VIPNotSupportedError struct {
+	vip       string
+	networkID string
+}
+
+func (e VIPNotSupportedError) Error() string {
+	return fmt.Sprintf("vip %q is not supported by network %v", e.vip, e.networkID)
+}
+
 func (lb *loadBalancer) String() string {
 	if lb == nil {
 		return "lb(nil)"
@@ -147,6 +208,10 @@ func (cs *CSCloud) GetLoadBalancer(ctx context.Context, clusterName string, serv
 	if service == nil {
 		return nil, false, fmt.Errorf("GetLoadBalancer: service cannot be nil")
 	}
+	if !cs.claimsService(service) {
+		return nil, false, nil
+	}
+	service = cs.withProfile(service)
 
 	klog.V(4).Infof("GetLoadBalancer(%v, %v, %v)", clusterName, service.Namespace, service.Name)
 	cs.svcLock.Lock(service)
@@ -165,13 +230,7 @@ func (cs *CSCloud) GetLoadBalancer(ctx context.Context, clusterName string, serv
 
 	klog.V(4).Infof("Found a load balancer %v", lb)
 
-	status := &v1.LoadBalancerStatus{}
-	status.Ingress = append(status.Ingress, v1.LoadBalancerIngress{
-		IP:       lb.ip.address,
-		Hostname: lb.name,
-	})
-
-	return status, true, nil
+	return lb.status(), true, nil
 }
 
 // EnsureLoadBalancer creates a new load balancer, or updates the existing one. Returns the status of the balancer.
@@ -179,6 +238,20 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 	if service == nil {
 		return nil, fmt.Errorf("EnsureLoadBalancer: service cannot be nil")
 	}
+	if err := cs.profilesSynced(service); err != nil {
+		return nil, err
+	}
+	if !cs.claimsService(service) {
+		// The status belongs to the implementation claiming the service and
+		// is returned unchanged.
+		err := cs.deleteUnclaimedLoadBalancer(service)
+		if err != nil {
+			return nil, err
+		}
+		return &service.Status.LoadBalancer, nil
+	}
+	service = cs.withProfile(service)
+	cs.unclaimedChecked.Delete(svcKey(service))
 
 	klog.V(4).Infof("EnsureLoadBalancer(%v, %v, %v, %v, ports: %d, nodes: %d)", clusterName, service.Namespace, service.Name, service.Spec.LoadBalancerIP, len(service.Spec.Ports), len(nodes))
 	cs.svcLock.Lock(service)
@@ -193,16 +266,18 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 		return nil, err
 	}
 
-	_, networkIDs, projectID, err := cs.nodeRegistry.idsForService(service)
+	nodeInfos, err := cs.nodeRegistry.nodesForService(service)
 	if err != nil {
 		return nil, err
 	}
+	_, networkIDs, projectID := idsForNodes(nodeInfos)
 
 	// Get the load balancer details and existing rules.
 	lb, err := cs.getLoadBalancer(service, projectID, networkIDs)
 	if err != nil {
 		return nil, err
 	}
+	lb.networkNodes = nodeCountByNetwork(nodeInfos)
 
 	if lb.cloud.projectID != "" && cs.config.Global.ProjectIDLabel != "" && service.Labels[cs.config.Global.ProjectIDLabel] == "" {
 		service.Labels[cs.config.Global.ProjectIDLabel] = lb.cloud.projectID
@@ -235,8 +310,8 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 		return nil, err
 	}
 
-	if service.Spec.LoadBalancerIP != "" && lb.ip.address != service.Spec.LoadBalancerIP {
-		err = lb.updateLoadBalancerIP()
+	if !lb.internal && service.Spec.LoadBalancerIP != "" && lb.ip.address != service.Spec.LoadBalancerIP {
+		err = lb.updateLoadBalancerIP(service.Spec.LoadBalancerIP)
 		if err != nil {
 			return nil, err
 		}
@@ -244,56 +319,166 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 
 	klog.V(4).Infof("Load balancer has associated IP %v", lb)
 
+	changed, err := lb.ensureLoadBalancerRule()
+	if err != nil {
+		return nil, err
+	}
+
+	vipsChanged, err := lb.ensureVIPs()
+	if err != nil {
+		return nil, err
+	}
+	changed = changed || vipsChanged || len(lb.stale) > 0
+
+	err = lb.deleteStale()
+	if err != nil {
+		return nil, err
+	}
+
+	err = lb.ensureDNSRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cs.updateLBQueue.push(queueEntry{
+		service:    service,
+		lb:         lb,
+		start:      time.Now(),
+		updatePool: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Subscribers are only notified when a rule was created or changed, not
+	// on every resync.
+	if changed {
+		var lbs []webhookLoadBalancer
+		for _, l := range lb.withVIPs() {
+			lbs = append(lbs, l.webhookLoadBalancer())
+		}
+		cs.webhooks.notify(service, webhookEventEnsured, lbs)
+	}
+
+	return lb.status(), nil
+}
+
+// ensureLoadBalancerRule creates the load balancer rule, or updates the
+// existing one, using the IP address already loaded. Changed indicates
+// whether the rule was created or updated.
+func (lb *loadBalancer) ensureLoadBalancerRule() (changed bool, err error) {
 	// If the load balancer rule exists and is up-to-date, we move on to the next rule.
 	result, err := lb.checkLoadBalancerRule()
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
 	if result.needsUpdate {
 		klog.V(4).Infof("Updating load balancer: %v", lb)
 		if err = lb.updateLoadBalancerRule(); err != nil {
-			return nil, err
+			return false, err
 		}
 	}
 
 	if result.needsTags {
 		if err = lb.assignTagsToRule(); err != nil {
-			return nil, err
+			return false, err
 		}
 	}
 
-	status := &v1.LoadBalancerStatus{
-		Ingress: []v1.LoadBalancerIngress{{
-			IP:       lb.ip.address,
-			Hostname: lb.name,
-		}},
-	}
-
 	if !result.exists {
 		klog.V(4).Infof("Creating load balancer rule: %v", lb)
-		lb.rule, err = lb.createLoadBalancerRule()
+		if lb.internal {
+			lb.rule, err = lb.createInternalLoadBalancer()
+		} else {
+			lb.rule, err = lb.createLoadBalancerRule()
+		}
 		if err != nil {
-			return nil, err
+			return false, err
+		}
+		if lb.internal {
+			lb.ip = cloudstackIP{address: lb.rule.Publicip, networkid: lb.rule.Networkid}
 		}
 
 		klog.V(4).Infof("Assigning tag to load balancer rule: %v", lb)
 		if err = lb.assignTagsToRule(); err != nil {
-			return nil, err
+			return false, err
+		}
+
+		if err = lb.afterRuleHook(lb.hookRequest(hookStepRuleCreated)); err != nil {
+			return false, err
 		}
 	}
 
-	err = cs.updateLBQueue.push(queueEntry{
-		service:    service,
-		lb:         lb,
-		start:      time.Now(),
-		updatePool: true,
-	})
-	if err != nil {
-		return nil, err
+	return result.needsUpdate || result.needsTags || !result.exists, nil
+}
+
+// ensureVIPs ensures the IP address and rule for each additional VIP
+// requested by the service. VIPs not supported by the network are dropped and
+// an event is recorded. Changed indicates whether a VIP rule was created or
+// updated.
+func (lb *loadBalancer) ensureVIPs() (changed bool, err error) {
+	var vips []*loadBalancer
+	for _, vipLB := range lb.vips {
+		err = shouldManageLB(vipLB)
+		if err != nil {
+			klog.V(3).Infof("Skipping VIP %v: %v", vipLB, err)
+			continue
+		}
+		if vipLB.rule == nil && vipLB.vipNetworkID == "" {
+			vipLB.mainNetworkID = lb.mainNetworkID
+		}
+		err = vipLB.loadLoadBalancerIP()
+		if err != nil {
+			if _, ok := err.(VIPNotSupportedError); ok {
+				klog.V(3).Infof("Skipping VIP %v: %v", vipLB, err)
+				lb.cloud.recorder.Eventf(lb.service, v1.EventTypeWarning, eventReasonVIPNotSupported, "Skipping VIP %q: %v", vipLB.vip, err)
+				continue
+			}
+			return false, err
+		}
+		if vipLB.vipAddress != "" && vipLB.ip.address != vipLB.vipAddress {
+			err = vipLB.updateLoadBalancerIP(vipLB.vipAddress)
+			if err != nil {
+				return false, err
+			}
+		}
+		klog.V(4).Infof("Load balancer VIP has associated IP %v", vipLB)
+		vipChanged, err := vipLB.ensureLoadBalancerRule()
+		if err != nil {
+			return false, err
+		}
+		changed = changed || vipChanged
+		vips = append(vips, vipLB)
 	}
+	lb.vips = vips
+	return changed, nil
+}
 
-	return status, nil
+// withVIPs returns the load balancer followed by each additional VIP with an
+// existing rule.
+func (lb *loadBalancer) withVIPs() []*loadBalancer {
+	result := []*loadBalancer{lb}
+	for _, vipLB := range lb.vips {
+		if vipLB.rule != nil {
+			result = append(result, vipLB)
+		}
+	}
+	return result
+}
+
+func (lb *loadBalancer) status() *v1.LoadBalancerStatus {
+	status := &v1.LoadBalancerStatus{}
+	for _, l := range lb.withVIPs() {
+		if l != lb && !l.ip.isValid() {
+			continue
+		}
+		status.Ingress = append(status.Ingress, v1.LoadBalancerIngress{
+			IP:       l.ip.address,
+			Hostname: lb.hostname(),
+		})
+	}
+	return status
 }
 
 // UpdateLoadBalancer updates hosts under the specified load balancer.
@@ -301,6 +486,14 @@ func (cs *CSCloud) UpdateLoadBalancer(ctx context.Context, clusterName string, s
 	if service == nil {
 		return fmt.Errorf("UpdateLoadBalancer: service cannot be nil")
 	}
+	if err := cs.profilesSynced(service); err != nil {
+		return err
+	}
+	if !cs.claimsService(service) {
+		klog.V(4).Infof("Ignoring service %s/%s of load balancer class %q", service.Namespace, service.Name, loadBalancerClass(service))
+		return nil
+	}
+	service = cs.withProfile(service)
 
 	klog.V(4).Infof("UpdateLoadBalancer(%v, %v, %v, %#v)", clusterName, service.Namespace, service.Name, nodes)
 
@@ -321,46 +514,124 @@ func (cs *CSCloud) EnsureLoadBalancerDeleted(ctx context.Context, clusterName st
 	if service == nil {
 		return fmt.Errorf("EnsureLoadBalancerDeleted: service cannot be nil")
 	}
+	if err := cs.profilesSynced(service); err != nil {
+		return err
+	}
+	if !cs.claimsService(service) {
+		err := cs.deleteUnclaimedLoadBalancer(service)
+		cs.unclaimedChecked.Delete(svcKey(service))
+		return err
+	}
+	service = cs.withProfile(service)
 
 	klog.V(4).Infof("EnsureLoadBalancerDeleted(%v, %v, %v)", clusterName, service.Namespace, service.Name)
+	_, err := cs.deleteLoadBalancer(service)
+	return err
+}
+
+// deleteUnclaimedLoadBalancer deletes the load balancer of a service not
+// claimed by the provider, e.g. after its load balancer class changed. Only
+// rules tagged for the service are deleted, the status written by other
+// implementations is ignored so their load balancers are left untouched.
+// Each service is checked once until it is claimed again.
+func (cs *CSCloud) deleteUnclaimedLoadBalancer(service *v1.Service) error {
+	if _, ok := cs.environments[cs.environmentForMeta(service.ObjectMeta)]; !ok {
+		klog.V(4).Infof("Ignoring service %s/%s of load balancer class %q", service.Namespace, service.Name, loadBalancerClass(service))
+		return nil
+	}
+	key := svcKey(service)
+	if _, checked := cs.unclaimedChecked.Load(key); checked {
+		klog.V(4).Infof("Ignoring service %s/%s of load balancer class %q", service.Namespace, service.Name, loadBalancerClass(service))
+		return nil
+	}
+	klog.V(4).Infof("Checking for load balancer of service %s/%s of load balancer class %q", service.Namespace, service.Name, loadBalancerClass(service))
+	unclaimed := cs.withProfile(service).DeepCopy()
+	unclaimed.Status = v1.ServiceStatus{}
+	if _, err := cs.deleteLoadBalancer(unclaimed); err != nil {
+		return err
+	}
+	cs.unclaimedChecked.Store(key, struct{}{})
+	return nil
+}
+
+// deleteLoadBalancer deletes the rules and releases the IPs of the service
+// load balancer, returning whether it was deleted.
+func (cs *CSCloud) deleteLoadBalancer(service *v1.Service) (bool, error) {
 	cs.svcLock.Lock(service)
 	defer cs.svcLock.Unlock(service)
 
+	if _, err := isInternalLB(service); err != nil {
+		klog.V(3).Infof("Deleting load balancer of service %s/%s found by its tags: %v", service.Namespace, service.Name, err)
+		service = withoutScheme(service)
+	}
+
 	// Get the load balancer details and existing rules.
 	lb, err := cs.getLoadBalancer(service, "", nil)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	if lb.rule == nil {
+	if lb.rule == nil && len(lb.stale) == 0 {
 		klog.V(3).Infof("Skipping EnsureLoadBalancerDeleted; LoadBalancerRule not found for service %s/%s", service.Namespace, service.Name)
-		return nil
+		return false, nil
 	}
 
 	if !isLBRemovalEnabled(lb, service) {
 		klog.V(3).Infof("Skipping deletion of load balancer %s: service or environment has removals disabled.", lb)
-		return nil
+		return false, nil
 	}
 
 	err = shouldManageLB(lb)
 	if err != nil {
 		klog.V(3).Infof("Skipping EnsureLoadBalancerDeleted for service %s/%s: %v", service.Namespace, service.Name, err)
-		return nil
+		return false, nil
 	}
 
-	klog.V(4).Infof("Deleting load balancer rule: %v", lb)
-	if err := lb.deleteLoadBalancerRule(); err != nil {
-		return err
+	err = lb.deleteDNSRecords()
+	if err != nil {
+		return false, err
 	}
 
-	if lb.ip.id != "" {
-		klog.V(4).Infof("Releasing load balancer IP: %v", lb)
-		if err := lb.cloud.releaseIPIfManaged(lb.ip, service); err != nil {
-			return err
+	var deleted []webhookLoadBalancer
+	defer func() {
+		if len(deleted) > 0 {
+			cs.webhooks.notify(service, webhookEventDeleted, deleted)
+		}
+	}()
+
+	for _, l := range append(lb.withVIPs(), lb.stale...) {
+		if l != lb {
+			err = shouldManageLB(l)
+			if err != nil {
+				klog.V(3).Infof("Skipping deletion of VIP %v: %v", l, err)
+				continue
+			}
+		}
+
+		// Stale VIPs may be left with an IP and no rule.
+		if l.rule != nil {
+			klog.V(4).Infof("Deleting load balancer rule: %v", l)
+			deletedLB := l.webhookLoadBalancer()
+			if err := l.deleteLoadBalancerRule(); err != nil {
+				return false, err
+			}
+			deleted = append(deleted, deletedLB)
+		}
+
+		if l.ip.id != "" && shouldRetainIP(service) {
+			klog.V(4).Infof("Retaining load balancer IP: %v", l)
+			if err := l.cloud.retainIPIfManaged(l.ip, service); err != nil {
+				return false, err
+			}
+		} else if l.ip.id != "" {
+			klog.V(4).Infof("Releasing load balancer IP: %v", l)
+			if err := l.cloud.releaseIPIfManaged(l.ip, service); err != nil {
+				return false, err
+			}
 		}
 	}
 
-	return nil
+	return true, nil
 }
 
 // isLBRemovalEnabled indicates whether the configurations for load balancer
@@ -368,10 +639,10 @@ func (cs *CSCloud) EnsureLoadBalancerDeleted(ctx context.Context, clusterName st
 func isLBRemovalEnabled(lb *loadBalancer, service *v1.Service) bool {
 	klog.V(4).Infof("isLBRemovalEnabled(%v, %v, %v)", lb, service.Namespace, service.Name)
 
-	if removeLBFlag, ok := getLabelOrAnnotation(service.ObjectMeta, removeLBsOnDeleteLabelKey); ok {
-		klog.V(4).Infof("LB removal flag %q has been found on %q Service labels/annotations", removeLBFlag, service)
-		if b, err := strconv.ParseBool(removeLBFlag); err == nil {
-			return b
+	if removeLBFlag, ok, err := lbRemovalFlag(service); ok {
+		klog.V(4).Infof("LB removal flag %v has been found on %q Service labels/annotations", removeLBFlag, service)
+		if err == nil {
+			return removeLBFlag
 		}
 	}
 
@@ -379,6 +650,20 @@ func isLBRemovalEnabled(lb *loadBalancer, service *v1.Service) bool {
 	return lb.cloud.environments[lb.cloud.environment].removeLBs
 }
 
+// lbRemovalFlag returns the value of the remove-loadbalancers-on-delete label
+// or annotation, ok is false if the service does not set it.
+func lbRemovalFlag(service *v1.Service) (enabled, ok bool, err error) {
+	value, ok := getLabelOrAnnotation(service.ObjectMeta, removeLBsOnDeleteLabelKey)
+	if !ok {
+		return false, false, nil
+	}
+	enabled, err = strconv.ParseBool(value)
+	if err != nil {
+		return false, true, fmt.Errorf("invalid value for %q: %q, expected a boolean", removeLBsOnDeleteLabelKey, value)
+	}
+	return enabled, true, nil
+}
+
 // getLoadBalancer retrieves the IP address and ID and all the existing rules it can find.
 func (cs *CSCloud) getLoadBalancer(service *v1.Service, projectID string, networkIDs []string) (*loadBalancer, error) {
 	environment := cs.environmentForMeta(service.ObjectMeta)
@@ -401,15 +686,165 @@ func (cs *CSCloud) getLoadBalancer(service *v1.Service, projectID string, networ
 	if len(networkIDs) > 0 {
 		lb.mainNetworkID = networkIDs[0]
 	}
+	var err error
+	lb.internal, err = isInternalLB(service)
+	if err != nil {
+		return nil, err
+	}
 
 	client, err := lb.getClient()
 	if err != nil {
 		return nil, err
 	}
 
-	lb.rule, err = getLoadBalancerRule(client, service, lb.name, projectID)
+	err = lb.loadRule(client)
+	if err != nil {
+		return nil, err
+	}
+
+	// The rule of the previous scheme is only looked up if the service had
+	// a load balancer.
+	if lb.rule == nil && len(service.Status.LoadBalancer.Ingress) > 0 {
+		err = lb.loadPreviousSchemeRule(client)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	vips, err := vipsForService(service)
 	if err != nil {
-		return nil, fmt.Errorf("load balancer %s for service %v/%v get rule error: %v", lb.name, service.Namespace, service.Name, err)
+		return nil, err
+	}
+	if lb.internal && len(vips) > 0 {
+		return nil, fmt.Errorf("additional VIPs are not supported by internal load balancer %v", lb)
+	}
+	for _, vip := range vips {
+		vipLB := lb.newVIP(vip.name)
+		vipLB.vipAddress = vip.address
+		if vip.networkID != "" {
+			vipLB.vipNetworkID = vip.networkID
+			vipLB.mainNetworkID = vip.networkID
+		}
+		err = vipLB.loadRule(client)
+		if err != nil {
+			return nil, err
+		}
+		lb.vips = append(lb.vips, vipLB)
+	}
+
+	// Removed VIPs are only looked up if the service may have had any, their
+	// addresses are reported in the service status.
+	if !lb.internal && (len(vips) > 0 || len(service.Status.LoadBalancer.Ingress) > 1) {
+		err = lb.loadStaleVIPs(client, vips)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return lb, nil
+}
+
+// loadStaleVIPs loads the rules and IPs tagged for additional VIPs of the
+// service not in vips. Retained IPs are left to be released once expired.
+func (lb *loadBalancer) loadStaleVIPs(client *cloudstack.CloudStackClient, vips []vipSpec) error {
+	wanted := map[string]struct{}{}
+	for _, vip := range vips {
+		wanted[vip.name] = struct{}{}
+	}
+	tags := tagsForService(lb.service)
+	stale := map[string]*loadBalancer{}
+	staleVIP := func(csTags []cloudstack.Tags) *loadBalancer {
+		vip, _ := getTag(csTags, vipTag)
+		if _, ok := wanted[vip]; vip == "" || ok || !matchAllTags(csTags, tags) {
+			return nil
+		}
+		if stale[vip] == nil {
+			stale[vip] = lb.newVIP(vip)
+			lb.stale = append(lb.stale, stale[vip])
+		}
+		return stale[vip]
+	}
+
+	rules, err := listLoadBalancerRulesByTags(client, lb.service, lb.cloud.projectID)
+	if err != nil {
+		return fmt.Errorf("load balancer %s for service %v/%v get stale VIPs error: %v", lb.name, lb.service.Namespace, lb.service.Name, err)
+	}
+	for _, rule := range rules {
+		if vipLB := staleVIP(rule.Tags); vipLB != nil {
+			vipLB.rule = rule
+			vipLB.ip = cloudstackIP{
+				address:   rule.Publicip,
+				id:        rule.Publicipid,
+				networkid: rule.Networkid,
+			}
+		}
+	}
+
+	p := client.Address.NewListPublicIpAddressesParams()
+	p.SetListall(true)
+	p.SetTags(map[string]string{
+		serviceTag: tags[serviceTag],
+	})
+	if lb.cloud.projectID != "" {
+		p.SetProjectid(lb.cloud.projectID)
+	}
+	publicIPAddresses, err := listAllIPPages(client, p)
+	if err != nil {
+		return fmt.Errorf("error retrieving IP address: %v", err)
+	}
+	for _, publicIP := range publicIPAddresses {
+		if _, retained := getTag(publicIP.Tags, retainedForTag); retained {
+			continue
+		}
+		if vipLB := staleVIP(publicIP.Tags); vipLB != nil && !vipLB.ip.isValid() {
+			vipLB.ip = cloudstackIP{
+				id:        publicIP.Id,
+				address:   publicIP.Ipaddress,
+				networkid: publicIP.Networkid,
+			}
+		}
+	}
+	return nil
+}
+
+// deleteStale deletes the rules and releases the IPs of the stale load
+// balancers of the service.
+func (lb *loadBalancer) deleteStale() error {
+	for _, staleLB := range lb.stale {
+		err := shouldManageLB(staleLB)
+		if err != nil {
+			klog.V(3).Infof("Skipping deletion of stale load balancer %v: %v", staleLB, err)
+			continue
+		}
+		if staleLB.rule != nil {
+			klog.V(3).Infof("Deleting rule of stale load balancer %v", staleLB)
+			err = staleLB.deleteLoadBalancerRule()
+			if err != nil {
+				return err
+			}
+			staleLB.rule = nil
+		}
+		if staleLB.ip.id != "" {
+			klog.V(3).Infof("Releasing IP of stale load balancer %v", staleLB)
+			err = lb.cloud.releaseIPIfManaged(staleLB.ip, lb.service)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	lb.stale = nil
+	return nil
+}
+
+func (lb *loadBalancer) loadRule(client *cloudstack.CloudStackClient) error {
+	var err error
+	if lb.internal {
+		lb.rule, err = getInternalLoadBalancer(client, lb.service, lb.name, lb.cloud.projectID)
+	} else {
+		lb.rule, err = getLoadBalancerRule(client, lb.service, lb.name, lb.cloud.projectID, lb.vip)
+	}
+	if err != nil {
+		return fmt.Errorf("load balancer %s for service %v/%v get rule error: %v", lb.name, lb.service.Namespace, lb.service.Name, err)
 	}
 
 	if lb.rule != nil {
@@ -417,17 +852,101 @@ func (cs *CSCloud) getLoadBalancer(service *v1.Service, projectID string, networ
 			address:   lb.rule.Publicip,
 			id:        lb.rule.Publicipid,
 			networkid: lb.rule.Networkid,
+			zoneid:    lb.rule.Zoneid,
 		}
 		lb.mainNetworkID = lb.rule.Networkid
+		lb.dnsHostname, _ = getTag(lb.rule.Tags, dnsHostnameTag)
 	}
+	return nil
+}
 
-	return lb, nil
+// newVIP returns the load balancer for an additional VIP of the service, its
+// rule is named after the vip and the main load balancer name.
+func (lb *loadBalancer) newVIP(vip string) *loadBalancer {
+	return &loadBalancer{
+		cloud:         lb.cloud,
+		name:          fmt.Sprintf("%s.%s", vip, lb.name),
+		algorithm:     lb.algorithm,
+		mainNetworkID: lb.mainNetworkID,
+		service:       lb.service,
+		vip:           vip,
+	}
+}
+
+type vipSpec struct {
+	name      string
+	networkID string
+	address   string
 }
 
-func getLoadBalancerRule(client *cloudstack.CloudStackClient, service *v1.Service, lbName, projectID string) (*loadBalancerRule, error) {
+// vipsForService returns the additional VIPs requested by the service.
+func vipsForService(service *v1.Service) ([]vipSpec, error) {
+	var vips []vipSpec
+	value, _ := getLabelOrAnnotation(service.ObjectMeta, lbIPFamilies)
+	families, err := parseIPFamilies(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %q: %v", lbIPFamilies, err)
+	}
+	// The main load balancer is always IPv4, IPv6 is an additional VIP.
+	if len(families) > 0 && !containsString(families, ipFamilyIPv4) {
+		return nil, fmt.Errorf("invalid value for %q: %q, IPv6 only load balancers are not supported", lbIPFamilies, value)
+	}
+	for _, family := range families {
+		if family == ipFamilyIPv6 {
+			vips = append(vips, vipSpec{name: vipIPv6})
+		}
+	}
+	value, _ = getLabelOrAnnotation(service.ObjectMeta, lbAdditionalVIPs)
+	additional, err := parseAdditionalVIPs(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %q: %v", lbAdditionalVIPs, err)
+	}
+	return append(vips, additional...), nil
+}
+
+var vipNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// parseAdditionalVIPs parses comma separated name=network:<network-id> or
+// name=ip:<address> entries.
+func parseAdditionalVIPs(value string) ([]vipSpec, error) {
+	var vips []vipSpec
+	names := map[string]struct{}{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid VIP %q, expected name=network:<network-id> or name=ip:<address>", entry)
+		}
+		name := strings.TrimSpace(parts[0])
+		if !vipNameRegexp.MatchString(name) || name == vipIPv6 {
+			return nil, fmt.Errorf("invalid VIP name %q", name)
+		}
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("duplicated VIP name %q", name)
+		}
+		names[name] = struct{}{}
+		spec := vipSpec{name: name}
+		target := strings.TrimSpace(parts[1])
+		switch {
+		case strings.HasPrefix(target, "network:") && len(target) > len("network:"):
+			spec.networkID = strings.TrimPrefix(target, "network:")
+		case strings.HasPrefix(target, "ip:") && net.ParseIP(strings.TrimPrefix(target, "ip:")) != nil:
+			spec.address = strings.TrimPrefix(target, "ip:")
+		default:
+			return nil, fmt.Errorf("invalid VIP %q, expected name=network:<network-id> or name=ip:<address>", entry)
+		}
+		vips = append(vips, spec)
+	}
+	return vips, nil
+}
+
+func getLoadBalancerRule(client *cloudstack.CloudStackClient, service *v1.Service, lbName, projectID, vip string) (*loadBalancerRule, error) {
 	lb, err := getLoadBalancerRuleByName(client, lbName, projectID)
 	if lb == nil && err == nil {
-		lb, err = getLoadBalancerByTags(client, service, projectID)
+		lb, err = getLoadBalancerByTags(client, service, projectID, vip)
 	}
 	if err != nil {
 		return nil, err
@@ -475,43 +994,26 @@ func getLoadBalancerRuleByName(client *cloudstack.CloudStackClient, lbName, proj
 	return lbResult, nil
 }
 
-func getLoadBalancerByTags(client *cloudstack.CloudStackClient, service *v1.Service, projectID string) (*loadBalancerRule, error) {
-	pc := &cloudstack.CustomServiceParams{}
-
-	pc.SetParam("listall", true)
-	if projectID != "" {
-		pc.SetParam("projectid", projectID)
-	}
-	tags := tagsForService(service)
-	// Use only service name in query, as we'll filter the result by all tags a
-	// few lines down. Setting more tags would actually be worse than setting a
-	// single one because cloudstack will OR the tags instead of AND.
-	pc.SetParam("tags[0].key", serviceTag)
-	pc.SetParam("tags[0].value", tags[serviceTag])
-
-	var result struct {
-		Count             int                 `json:"count"`
-		LoadBalancerRules []*loadBalancerRule `json:"loadbalancerrule"`
-	}
-
-	err := client.Custom.CustomRequest("listLoadBalancerRules", pc, &result)
+func getLoadBalancerByTags(client *cloudstack.CloudStackClient, service *v1.Service, projectID, vip string) (*loadBalancerRule, error) {
+	rules, err := listLoadBalancerRulesByTags(client, service, projectID)
 	if err != nil {
 		return nil, err
 	}
-	if result.Count == 0 {
+	if len(rules) == 0 {
 		return nil, nil
 	}
 
+	tags := tagsForService(service)
 	var count int
 	var lbResult *loadBalancerRule
-	for _, lbRule := range result.LoadBalancerRules {
-		if matchAllTags(lbRule.Tags, tags) {
+	for _, lbRule := range rules {
+		if matchAllTags(lbRule.Tags, tags) && matchVIP(lbRule.Tags, vip) {
 			lbResult = lbRule
 			count++
 		}
 	}
 	if count > 1 {
-		return nil, fmt.Errorf("tags %#v with too many rules associated: %#v", tags, result.LoadBalancerRules)
+		return nil, fmt.Errorf("tags %#v with too many rules associated: %#v", tags, rules)
 	}
 	if count == 0 {
 		return nil, nil
@@ -519,16 +1021,31 @@ func getLoadBalancerByTags(client *cloudstack.CloudStackClient, service *v1.Serv
 	return lbResult, nil
 }
 
-func (cs *CSCloud) externalNIC(instance *cloudstack.VirtualMachine) (*cloudstack.Nic, error) {
-	if len(instance.Nic) == 0 {
-		return nil, errors.New("instance does not have any nics")
+// listLoadBalancerRulesByTags lists the load balancer rules with the service
+// name tag, callers must filter them by the remaining tags.
+func listLoadBalancerRulesByTags(client *cloudstack.CloudStackClient, service *v1.Service, projectID string) ([]*loadBalancerRule, error) {
+	pc := &cloudstack.CustomServiceParams{}
+
+	pc.SetParam("listall", true)
+	if projectID != "" {
+		pc.SetParam("projectid", projectID)
 	}
+	// Use only service name in query, as we'll filter the result by all tags a
+	// few lines down. Setting more tags would actually be worse than setting a
+	// single one because cloudstack will OR the tags instead of AND.
+	pc.SetParam("tags[0].key", serviceTag)
+	pc.SetParam("tags[0].value", service.Name)
 
-	externalIndex := cs.config.Global.ExternalIPIndex
-	if externalIndex >= 0 && externalIndex < len(instance.Nic) {
-		return &instance.Nic[externalIndex], nil
+	var result struct {
+		Count             int                 `json:"count"`
+		LoadBalancerRules []*loadBalancerRule `json:"loadbalancerrule"`
 	}
-	return &instance.Nic[0], nil
+
+	err := client.Custom.CustomRequest("listLoadBalancerRules", pc, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result.LoadBalancerRules, nil
 }
 
 // GetLoadBalancerName returns the name of the load balancer responsible for
@@ -540,7 +1057,7 @@ func (cs *CSCloud) GetLoadBalancerName(ctx context.Context, clusterName string,
 		return ""
 	}
 
-	return cs.getLoadBalancerName(service)
+	return cs.getLoadBalancerName(cs.withProfile(service))
 }
 
 func (cs *CSCloud) getLoadBalancerName(service *v1.Service) string {
@@ -561,20 +1078,33 @@ func (cs *CSCloud) getLoadBalancerName(service *v1.Service) string {
 }
 
 func (lb *loadBalancer) loadLoadBalancerIP() error {
-	if lb.ip.isValid() {
+	// Internal load balancers get their source IP when created.
+	if lb.internal || lb.ip.isValid() {
 		return nil
 	}
-	ip, err := lb.cloud.getLoadBalancerIP(lb.service, lb.mainNetworkID)
+	address := lb.vipAddress
+	if lb.vip == "" {
+		address = lb.service.Spec.LoadBalancerIP
+	}
+	ip, err := lb.cloud.getLoadBalancerIP(lb.service, lb.name, lb.mainNetworkID, lb.vip, address)
 	if err != nil {
 		return err
 	}
 	lb.ip = *ip
-	lb.mainNetworkID = ip.networkid
+	// IPs associated to a VPC are not bound to a tier, the rule is created
+	// in the tier chosen from the nodes.
+	if ip.networkid != "" {
+		lb.mainNetworkID = ip.networkid
+		return nil
+	}
+	if lb.rule == nil {
+		return lb.chooseVPCTier()
+	}
 	return nil
 }
 
-func (lb *loadBalancer) updateLoadBalancerIP() error {
-	publicIP, err := lb.cloud.getPublicIPAddressByIP(lb.service.Spec.LoadBalancerIP)
+func (lb *loadBalancer) updateLoadBalancerIP(address string) error {
+	publicIP, err := lb.cloud.getPublicIPAddressByIP(address)
 	if err != nil {
 		return err
 	}
@@ -601,10 +1131,19 @@ func (pc *projectCloud) releaseIPIfManaged(ip cloudstackIP, service *v1.Service)
 	if err != nil {
 		return err
 	}
-	if shouldManageIP(*publicIP, service) {
-		return pc.releaseLoadBalancerIP(ip)
+	if !shouldManageIP(*publicIP, service) {
+		return nil
 	}
-	return nil
+	return pc.releaseOrReturnIP(ip, publicIP.Tags, service)
+}
+
+// releaseOrReturnIP returns the IP to the reserved IP pool if it was claimed
+// from one or releases it otherwise, service is nil if no longer known.
+func (pc *projectCloud) releaseOrReturnIP(ip cloudstackIP, tags []cloudstack.Tags, service *v1.Service) error {
+	if _, isPoolIP := getTag(tags, ipPoolTag); isPoolIP && pc.ipPoolEnabled() {
+		return pc.returnPoolIP(ip)
+	}
+	return pc.releaseLoadBalancerIP(ip, service)
 }
 
 // getLoadBalancerIP retrieves an existing IP for the loadbalancer or allocates
@@ -613,25 +1152,38 @@ func (pc *projectCloud) releaseIPIfManaged(ip cloudstackIP, service *v1.Service)
 // This function should try to find an IP address with the following priorities:
 // 1 - Find an existing public IP tagged for the service
 // 2 - Find an existing public IP matching Status.LoadBalancer.Ingress[0].IP
-// 3 - Find a public IP matching service's Spec.LoadBalancerIP
-// 4 - Allocate a new random IP
+// 3 - Find a public IP matching the requested address, service's
+// Spec.LoadBalancerIP for the main load balancer
+// 4 - Claim a free IP from the reserved IP pool
+// 5 - Allocate a new random IP
 //
 // On situation 3 we'll also tag the IP address so that we can reuse or free it
 // in the future. If tagging fails we should immediately release it.
-func (pc *projectCloud) getLoadBalancerIP(service *v1.Service, networkID string) (*cloudstackIP, error) {
-	klog.V(4).Infof("getLoadBalancerIP for service (%v, %v)", service.Namespace, service.Name)
-	ip, err := pc.tryPublicIPAddressByTags(service)
+//
+// Additional VIPs without a requested address only look for tagged IPs before
+// allocating a new one.
+func (pc *projectCloud) getLoadBalancerIP(service *v1.Service, lbName, networkID, vip, address string) (*cloudstackIP, error) {
+	klog.V(4).Infof("getLoadBalancerIP for service (%v, %v) vip %q", service.Namespace, service.Name, vip)
+	ip, err := pc.tryPublicIPAddressByTags(service, vip)
 	if err != nil {
 		return nil, err
 	}
 	if ip != nil {
+		if ip.retained {
+			err = pc.claimIPWithHooks(service, lbName, networkID, vip, ip, func() error {
+				return pc.reclaimRetainedIP(ip)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
 		return ip, nil
 	}
-	if service.Spec.LoadBalancerIP != "" {
-		return pc.getPublicIPAddressByIP(service.Spec.LoadBalancerIP)
+	if address != "" {
+		return pc.getPublicIPAddressByIP(address)
 	}
 	ingresses := service.Status.LoadBalancer.Ingress
-	if len(ingresses) > 0 && ingresses[0].IP != "" {
+	if vip == "" && len(ingresses) > 0 && ingresses[0].IP != "" {
 		ip, err = pc.getPublicIPAddressByIP(ingresses[0].IP)
 		if err != nil {
 			if _, ok := err.(IPNotFoundError); !ok {
@@ -640,14 +1192,18 @@ func (pc *projectCloud) getLoadBalancerIP(service *v1.Service, networkID string)
 		}
 	}
 	if ip == nil {
-		ip, err = pc.associatePublicIPAddress(service, networkID)
+		ip, err = pc.claimPoolIP(service, lbName, networkID, vip)
+		if err != nil || ip != nil {
+			return ip, err
+		}
+		ip, err = pc.associatePublicIPAddress(service, lbName, networkID, vip)
 		if err != nil {
 			return nil, err
 		}
 	}
-	err = pc.assignTagsToIP(ip, service)
+	err = pc.assignTagsToIP(ip, service, vip)
 	if err != nil {
-		rollbackErr := pc.releaseLoadBalancerIP(*ip)
+		rollbackErr := pc.releaseLoadBalancerIP(*ip, service)
 		if rollbackErr != nil {
 			err = fmt.Errorf("%v: error rolling back IP address: %v", err, rollbackErr)
 		}
@@ -669,10 +1225,17 @@ func matchAllTags(csTags []cloudstack.Tags, tags map[string]string) bool {
 	return false
 }
 
+// matchVIP checks whether the resource tags belong to the vip, resources
+// belonging to the main load balancer have no vip tag.
+func matchVIP(csTags []cloudstack.Tags, vip string) bool {
+	value, _ := getTag(csTags, vipTag)
+	return value == vip
+}
+
 // tryPublicIPAddressByTags tries retrieving an ip address matching service
-// tags. If not is found it returns nil with no error.
-func (pc *projectCloud) tryPublicIPAddressByTags(service *v1.Service) (*cloudstackIP, error) {
-	klog.V(4).Infof("tryPublicIPAddressByTags(%v, %v)", service.Namespace, service.Name)
+// and vip tags. If not is found it returns nil with no error.
+func (pc *projectCloud) tryPublicIPAddressByTags(service *v1.Service, vip string) (*cloudstackIP, error) {
+	klog.V(4).Infof("tryPublicIPAddressByTags(%v, %v, %v)", service.Namespace, service.Name, vip)
 	client, err := pc.getClient()
 	if err != nil {
 		return nil, err
@@ -697,11 +1260,14 @@ func (pc *projectCloud) tryPublicIPAddressByTags(service *v1.Service) (*cloudsta
 	for _, publicIP := range publicIPAddresses {
 		// This match call is necessary because aparently cloudstack does an OR
 		// when multiple tags are specified and we want an AND.
-		if matchAllTags(publicIP.Tags, tags) {
+		if matchAllTags(publicIP.Tags, tags) && matchVIP(publicIP.Tags, vip) {
+			_, retained := getTag(publicIP.Tags, retainedForTag)
 			validIPs = append(validIPs, cloudstackIP{
 				id:        publicIP.Id,
 				address:   publicIP.Ipaddress,
 				networkid: publicIP.Networkid,
+				zoneid:    publicIP.Zoneid,
+				retained:  retained,
 			})
 		}
 	}
@@ -751,6 +1317,7 @@ func (pc *projectCloud) getPublicIPAddressByIP(loadBalancerIP string) (*cloudsta
 		address:   publicIP.Ipaddress,
 		id:        publicIP.Id,
 		networkid: publicIP.Networkid,
+		zoneid:    publicIP.Zoneid,
 	}, nil
 }
 
@@ -785,8 +1352,29 @@ func (pc *projectCloud) getPublicIPAddressByID(ipID string) (*cloudstack.PublicI
 }
 
 // associatePublicIPAddress associates a new IP and sets the address and it's ID.
-func (pc *projectCloud) associatePublicIPAddress(service *v1.Service, networkID string) (*cloudstackIP, error) {
+func (pc *projectCloud) associatePublicIPAddress(service *v1.Service, lbName, networkID, vip string) (*cloudstackIP, error) {
 	klog.V(4).Infof("Allocate new IP for service (%v, %v)", service.Namespace, service.Name)
+	req := pc.ipAllocatedRequest(service, lbName, networkID, vip)
+	ip, err := pc.associateIP(service, lbName, networkID, vip, func(params *cloudstack.CustomServiceParams) error {
+		pc.setExtraParams("associateIpAddress", service, params)
+		hookParams, err := pc.beforeHook(req)
+		hookParams.apply(params)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	klog.V(4).Infof("Allocated IP %s for service (%v, %v)", ip, service.Namespace, service.Name)
+	req.LoadBalancer.IPAddress = ip.address
+	req.LoadBalancer.IPID = ip.id
+	pc.afterHook(req, service)
+	return ip, nil
+}
+
+// associateIP associates a new IP in the network for the load balancer of the
+// service, nil for reserved pool IPs, extraParams may be used to set
+// additional params to the associate command.
+func (pc *projectCloud) associateIP(service *v1.Service, lbName, networkID, vip string, extraParams func(*cloudstack.CustomServiceParams) error) (*cloudstackIP, error) {
 	// If a network belongs to a VPC, the IP address needs to be associated with
 	// the VPC instead of with the network.
 	client, err := pc.getClient()
@@ -800,6 +1388,7 @@ func (pc *projectCloud) associatePublicIPAddress(service *v1.Service, networkID
 		}
 		return nil, fmt.Errorf("error retrieving network: %v", err)
 	}
+	pc.cacheNetworkVPC(networkID, network.Vpcid)
 
 	params := &cloudstack.CustomServiceParams{}
 	if network.Vpcid != "" {
@@ -811,6 +1400,12 @@ func (pc *projectCloud) associatePublicIPAddress(service *v1.Service, networkID
 		params.SetParam("projectid", pc.projectID)
 	}
 	environmentID := pc.getLBEnvironmentID()
+	if vip == vipIPv6 {
+		environmentID = pc.environments[pc.environment].lbEnvironmentIDIPv6
+		if environmentID == "" || network.Ip6cidr == "" {
+			return nil, VIPNotSupportedError{vip: vip, networkID: networkID}
+		}
+	}
 	if environmentID != "" {
 		params.SetParam("lbenvironmentid", environmentID)
 	}
@@ -821,7 +1416,14 @@ func (pc *projectCloud) associatePublicIPAddress(service *v1.Service, networkID
 		associateCommand = "associateIpAddress"
 	}
 
-	setExtraParams(service, associateIPAddressExtraParamPrefix, params)
+	if err = pc.applyCommandArgs(associateCommand, service, pc.commandArgsData(service, lbName, ""), params); err != nil {
+		return nil, err
+	}
+	if extraParams != nil {
+		if err = extraParams(params); err != nil {
+			return nil, err
+		}
+	}
 
 	err = client.Custom.CustomRequest(associateCommand, params, &result)
 	if err != nil {
@@ -841,19 +1443,19 @@ func (pc *projectCloud) associatePublicIPAddress(service *v1.Service, networkID
 		}
 		ip.address = result.Ipaddress
 	}
-	klog.V(4).Infof("Allocated IP %s for service (%v, %v)", ip, service.Namespace, service.Name)
 
 	return &ip, nil
 }
 
-// releasePublicIPAddress releases an associated IP.
-func (pc *projectCloud) releaseLoadBalancerIP(ip cloudstackIP) error {
+// releaseLoadBalancerIP releases an associated IP, extra params are taken
+// from the service if not nil.
+func (pc *projectCloud) releaseLoadBalancerIP(ip cloudstackIP, service *v1.Service) error {
 	klog.V(4).Infof("Release IP %s", ip)
 	client, err := pc.getClient()
 	if err != nil {
 		return err
 	}
-	params := &cloudstack.CustomServiceParams{}
+	params := pc.newCommandParams("disassociateIpAddress", service)
 	params.SetParam("id", ip.id)
 	if pc.projectID != "" {
 		params.SetParam("projectid", pc.projectID)
@@ -863,6 +1465,9 @@ func (pc *projectCloud) releaseLoadBalancerIP(ip cloudstackIP) error {
 	if disassociateCommand == "" {
 		disassociateCommand = "disassociateIpAddress"
 	}
+	if err = pc.applyCommandArgs(disassociateCommand, service, pc.commandArgsData(service, "", ip.address), params); err != nil {
+		return err
+	}
 	var rsp cloudstack.DisassociateIpAddressResponse
 	err = client.Custom.CustomRequest(disassociateCommand, params, &rsp)
 	if err != nil {
@@ -908,7 +1513,7 @@ func (lb *loadBalancer) checkLoadBalancerRule() (checkLBResult, error) {
 	}
 	portsEqual := comparePorts(newPorts, lb)
 
-	if portsEqual && lb.name == lb.rule.Name {
+	if portsEqual && lb.name == lb.rule.Name && !lb.internalNeedsRecreate() {
 		result.exists = true
 		result.needsUpdate = lb.rule.Algorithm != lb.algorithm
 		result.needsTags = lb.hasMissingTags()
@@ -936,10 +1541,15 @@ func (lb *loadBalancer) updateLoadBalancerRule() error {
 		return err
 	}
 
-	p := client.LoadBalancer.NewUpdateLoadBalancerRuleParams(lb.rule.Id)
-	p.SetAlgorithm(lb.algorithm)
+	p := lb.cloud.newCommandParams("updateLoadBalancerRule", lb.service)
+	p.SetParam("id", lb.rule.Id)
+	p.SetParam("algorithm", lb.algorithm)
 
-	_, err = client.LoadBalancer.UpdateLoadBalancerRule(p)
+	var result cloudstack.UpdateLoadBalancerRuleResponse
+	err = client.Custom.CustomRequest("updateLoadBalancerRule", p, &result)
+	if err == nil && result.JobID != "" {
+		err = waitJob(client, result.JobID, nil)
+	}
 	if err != nil {
 		return fmt.Errorf("unable to update load balancer %v: %v", lb, err)
 	}
@@ -976,7 +1586,13 @@ func (lb *loadBalancer) createLoadBalancerRule() (*loadBalancerRule, error) {
 	// Do not create corresponding firewall rule.
 	p.SetParam("openfirewall", false)
 
-	setExtraParams(lb.service, createLoadBalancerExtraParamPrefix, p)
+	lb.cloud.setExtraParams("createLoadBalancerRule", lb.service, p)
+
+	hookParams, err := lb.cloud.beforeHook(lb.hookRequest(hookStepRuleCreated))
+	if err != nil {
+		return nil, err
+	}
+	hookParams.apply(p)
 
 	// Create a new load balancer rule.
 	r := cloudstack.CreateLoadBalancerRuleResponse{}
@@ -1017,23 +1633,65 @@ func (lb *loadBalancer) updateLoadBalancerPool() error {
 		return err
 	}
 
+	if lb.internal {
+		return nil
+	}
+
+	proxyProtocol, err := proxyProtocolForService(lb.service)
+	if err != nil {
+		return err
+	}
 	_, lbCustomHealthCheckVal := getLabelOrAnnotation(lb.service.ObjectMeta, lbCustomHealthCheck)
-	if !lbCustomHealthCheckVal && lb.rule.Protocol != string(v1.ProtocolUDP) {
+	settings := poolSettings{
+		healthCheck:          lbCustomHealthCheckVal || lb.rule.Protocol == string(v1.ProtocolUDP),
+		proxyProtocol:        proxyProtocol != "" || lb.appliedProxyProtocol() != "",
+		proxyProtocolVersion: proxyProtocol,
+		params:               hasPoolParams(lb.service),
+		explicitHealthCheck:  hasAnnotationPrefix(lb.service, healthCheckPrefixes),
+	}
+
+	if settings.proxyProtocol && lb.cloud.config.Command.SetProxyProtocol != "" {
+		err = lb.setProxyProtocol(proxyProtocol)
+		if err != nil {
+			return err
+		}
+		settings.proxyProtocol = false
+	}
+
+	if !settings.healthCheck && !settings.explicitHealthCheck && !settings.proxyProtocol && !settings.params {
 		return nil
 	}
 
-	listGloboNetworkPoolsParams := cloudstack.CustomServiceParams{}
+	for _, zoneID := range lb.poolZones() {
+		err = lb.updateLoadBalancerPoolInZone(client, zoneID, settings)
+		if err != nil {
+			return err
+		}
+	}
+	if settings.proxyProtocol {
+		return lb.recordProxyProtocol(proxyProtocol)
+	}
+	return nil
+}
+
+// updateLoadBalancerPoolInZone updates the health checks and PROXY protocol
+// of the pools the backend created for the rule in the zone.
+func (lb *loadBalancer) updateLoadBalancerPoolInZone(client *cloudstack.CloudStackClient, zoneID string, settings poolSettings) error {
+	listGloboNetworkPoolsParams := lb.cloud.newCommandParams("listGloboNetworkPools", lb.service)
 	listGloboNetworkPoolsResponse := globoNetworkPools{}
 	listGloboNetworkPoolsParams.SetParam("lbruleid", lb.rule.Id)
-	listGloboNetworkPoolsParams.SetParam("zoneid", lb.rule.Zoneid)
+	listGloboNetworkPoolsParams.SetParam("zoneid", zoneID)
 
-	err = client.Custom.CustomRequest("listGloboNetworkPools", &listGloboNetworkPoolsParams, &listGloboNetworkPoolsResponse)
+	err := client.Custom.CustomRequest("listGloboNetworkPools", listGloboNetworkPoolsParams, &listGloboNetworkPoolsResponse)
 
 	if err != nil {
 		return fmt.Errorf("error list load balancer pools for %v: %v", lb, err)
 	}
 
 	if listGloboNetworkPoolsResponse.Count == 0 {
+		if lb.spansZones() {
+			return fmt.Errorf("error list load balancer pools for %v in zone %s: no LB pools found", lb, zoneID)
+		}
 		return fmt.Errorf("error list load balancer pools for %v: no LB pools found", lb)
 	}
 
@@ -1042,28 +1700,46 @@ func (lb *loadBalancer) updateLoadBalancerPool() error {
 		return err
 	}
 
-	updateGloboNetworkPoolsParams := cloudstack.CustomServiceParams{}
 	r := UpdateGloboNetworkPoolResponse{}
 	for _, portInfo := range ports.ports {
-		pool := lb.generateGloboNetworkPool(ports, portInfo, lb.service, listGloboNetworkPoolsResponse.GloboNetworkPools)
+		pool, redeploy, err := lb.generateGloboNetworkPool(ports, portInfo, lb.service, listGloboNetworkPoolsResponse.GloboNetworkPools, settings)
+		if err != nil {
+			return err
+		}
 		if pool == nil {
 			continue
 		}
+		updateGloboNetworkPoolsParams := lb.cloud.newCommandParams("updateGloboNetworkPool", lb.service)
 		updateGloboNetworkPoolsParams.SetParam("poolids", pool.Id)
 		updateGloboNetworkPoolsParams.SetParam("lbruleid", lb.rule.Id)
 		updateGloboNetworkPoolsParams.SetParam("healthchecktype", strings.ToUpper(pool.HealthCheckType))
 		updateGloboNetworkPoolsParams.SetParam("healthcheck", pool.HealthCheck)
 		updateGloboNetworkPoolsParams.SetParam("expectedhealthcheck", pool.HealthCheckExpected)
-		updateGloboNetworkPoolsParams.SetParam("zoneid", lb.rule.Zoneid)
-		updateGloboNetworkPoolsParams.SetParam("maxconn", 0)
-
-		if pool.HealthCheckType == string(v1.ProtocolUDP) {
-			updateGloboNetworkPoolsParams.SetParam("l4protocol", strings.ToUpper(pool.HealthCheckType))
-			updateGloboNetworkPoolsParams.SetParam("l7protocol", "Outros")
+		updateGloboNetworkPoolsParams.SetParam("zoneid", zoneID)
+		if pool.HealthCheckInterval > 0 {
+			updateGloboNetworkPoolsParams.SetParam("healthcheckinterval", pool.HealthCheckInterval)
+		}
+		if pool.HealthCheckTimeout > 0 {
+			updateGloboNetworkPoolsParams.SetParam("healthchecktimeout", pool.HealthCheckTimeout)
+		}
+		updateGloboNetworkPoolsParams.SetParam("maxconn", pool.MaxConn)
+		if settings.proxyProtocol {
+			updateGloboNetworkPoolsParams.SetParam("proxyprotocol", proxyProtocolParam(pool.ProxyProtocol))
+		}
+		if pool.L4Protocol != "" {
+			updateGloboNetworkPoolsParams.SetParam("l4protocol", pool.L4Protocol)
+		}
+		if pool.L7Protocol != "" {
+			updateGloboNetworkPoolsParams.SetParam("l7protocol", pool.L7Protocol)
+		}
+		if pool.ServiceDownAction != "" {
+			updateGloboNetworkPoolsParams.SetParam("servicedownaction", pool.ServiceDownAction)
+		}
+		if redeploy || pool.HealthCheckType == string(v1.ProtocolUDP) {
 			updateGloboNetworkPoolsParams.SetParam("redeploy", true)
 		}
 
-		err = client.Custom.CustomRequest("updateGloboNetworkPool", &updateGloboNetworkPoolsParams, &r)
+		err = client.Custom.CustomRequest("updateGloboNetworkPool", updateGloboNetworkPoolsParams, &r)
 		if err != nil {
 			return fmt.Errorf("error updating globo network pool for %v: %v", lb, err)
 		}
@@ -1077,7 +1753,10 @@ func (lb *loadBalancer) updateLoadBalancerPool() error {
 	return nil
 }
 
-func (lb *loadBalancer) generateGloboNetworkPool(ports lbPorts, portInfo lbPortInfo, service *v1.Service, globoPools []*globoNetworkPool) *globoNetworkPool {
+// generateGloboNetworkPool returns the pool of the port updated with the
+// managed settings or nil if the pool is up to date. It also indicates
+// whether the pool must be redeployed for the changes to take effect.
+func (lb *loadBalancer) generateGloboNetworkPool(ports lbPorts, portInfo lbPortInfo, service *v1.Service, globoPools []*globoNetworkPool, settings poolSettings) (*globoNetworkPool, bool, error) {
 	dstPort := int(portInfo.privatePort)
 	vipPort := int(portInfo.publicPort)
 	namedService := portInfo.name
@@ -1085,8 +1764,38 @@ func (lb *loadBalancer) generateGloboNetworkPool(ports lbPorts, portInfo lbPortI
 	healthCheckResponse, _ := getLabelOrAnnotation(service.ObjectMeta, fmt.Sprintf("%s%s", lbCustomHealthCheckResponsePrefix, namedService))
 	healthCheckMessage, _ := getLabelOrAnnotation(service.ObjectMeta, fmt.Sprintf("%s%s", lbCustomHealthCheckMessagePrefix, namedService))
 
-	if hcProtocol.requiresMsg && healthCheckMessage == "" {
-		return nil
+	manageHealthCheck := settings.healthCheck
+	hc, explicit, err := explicitHealthCheck(service, ports, portInfo)
+	switch {
+	case err != nil:
+		lb.healthCheckWarning("Ignoring health check of port %s: %v", portID(portInfo), err)
+		manageHealthCheck = false
+	case explicit:
+		manageHealthCheck = true
+		hcProtocol = hcPortInfo{protocol: hc.protocol}
+		healthCheckMessage = hc.request
+		healthCheckResponse = hc.expect
+	case manageHealthCheck && hcProtocol.requiresMsg && healthCheckMessage == "":
+		lb.healthCheckWarning("Ignoring health check of port %s: type %s requires the %s%s annotation", portID(portInfo), hcProtocol.protocol, lbCustomHealthCheckMessagePrefix, namedService)
+		manageHealthCheck = false
+	}
+
+	params, err := poolParamsForPort(service, namedService)
+	if err != nil {
+		return nil, false, err
+	}
+	if manageHealthCheck && hcProtocol.protocol == string(v1.ProtocolUDP) {
+		if params.l4Protocol == "" {
+			params.l4Protocol = string(v1.ProtocolUDP)
+		}
+		if params.l7Protocol == "" {
+			params.l7Protocol = udpL7Protocol
+		}
+	}
+	manageParams := params != (poolParams{})
+
+	if !manageHealthCheck && !settings.proxyProtocol && !manageParams {
+		return nil, false, nil
 	}
 
 	for _, pool := range globoPools {
@@ -1095,16 +1804,33 @@ func (lb *loadBalancer) generateGloboNetworkPool(ports lbPorts, portInfo lbPortI
 			continue
 		}
 
-		if pool.HealthCheck != healthCheckMessage ||
+		changed := false
+		if manageHealthCheck && (pool.HealthCheck != healthCheckMessage ||
 			pool.HealthCheckExpected != healthCheckResponse ||
-			pool.HealthCheckType != hcProtocol.protocol {
+			pool.HealthCheckType != hcProtocol.protocol) {
 			pool.HealthCheck = healthCheckMessage
 			pool.HealthCheckExpected = healthCheckResponse
 			pool.HealthCheckType = hcProtocol.protocol
-			return pool
+			changed = true
+		}
+		if manageHealthCheck && hc.interval > 0 && pool.HealthCheckInterval != hc.interval {
+			pool.HealthCheckInterval = hc.interval
+			changed = true
+		}
+		if manageHealthCheck && hc.timeout > 0 && pool.HealthCheckTimeout != hc.timeout {
+			pool.HealthCheckTimeout = hc.timeout
+			changed = true
+		}
+		if settings.proxyProtocol && normalizeProxyProtocol(pool.ProxyProtocol) != settings.proxyProtocolVersion {
+			pool.ProxyProtocol = settings.proxyProtocolVersion
+			changed = true
+		}
+		paramsChanged, redeploy := params.apply(pool)
+		if changed || paramsChanged {
+			return pool, redeploy, nil
 		}
 	}
-	return nil
+	return nil, false, nil
 }
 
 type hcPortInfo struct {
@@ -1113,12 +1839,6 @@ type hcPortInfo struct {
 }
 
 func portToHCProtocol(ports lbPorts, portInfo lbPortInfo) hcPortInfo {
-	supportedHCProtocols := map[string]bool{
-		"HTTP":  true,
-		"HTTPS": true,
-		"TCP":   false,
-		"UDP":   false,
-	}
 	svcNamePrefix := strings.ToUpper(strings.Split(portInfo.name, "-")[0])
 	if hasMsg, ok := supportedHCProtocols[svcNamePrefix]; ok {
 		return hcPortInfo{protocol: svcNamePrefix, requiresMsg: hasMsg}
@@ -1135,16 +1855,27 @@ func (lb *loadBalancer) deleteLoadBalancerRule() error {
 	}
 
 	deleteLBCommand := lb.cloud.config.Command.DeleteLBRule
-	if deleteLBCommand == "" {
+	extraParamsCommand := "deleteLoadBalancerRule"
+	if lb.internal {
+		deleteLBCommand = "deleteLoadBalancer"
+		extraParamsCommand = deleteLBCommand
+	} else if deleteLBCommand == "" {
 		deleteLBCommand = "deleteLoadBalancerRule"
 	}
 
-	p := &cloudstack.CustomServiceParams{}
+	p := lb.cloud.newCommandParams(extraParamsCommand, lb.service)
 	p.SetParam("id", lb.rule.Id)
-	for k, v := range lb.cloud.config.CommandArgs[deleteLBCommand].ToMap() {
-		p.SetParam(k, v)
+	if err = lb.applyCommandArgs(deleteLBCommand, p); err != nil {
+		return err
 	}
 
+	req := lb.hookRequest(hookStepRuleDeleted)
+	hookParams, err := lb.cloud.beforeHook(req)
+	if err != nil {
+		return err
+	}
+	hookParams.apply(p)
+
 	var result cloudstack.DeleteLoadBalancerRuleResponse
 	err = client.Custom.CustomRequest(deleteLBCommand, p, &result)
 	if err != nil {
@@ -1158,7 +1889,9 @@ func (lb *loadBalancer) deleteLoadBalancerRule() error {
 		}
 	}
 
+	lb.cloud.drains.forgetRule(lb.rule.Id)
 	lb.rule = nil
+	lb.cloud.afterHook(req, lb.service)
 	return nil
 }
 
@@ -1208,7 +1941,9 @@ func shouldManageLB(lb *loadBalancer) error {
 	ingresses := lb.service.Status.LoadBalancer.Ingress
 	if len(ingresses) == 1 {
 		statusHostname = ingresses[0].Hostname
-		if statusHostname == lb.name {
+		// The status may hold the hostname returned by a rule-created hook
+		// instead of the name derived from the service.
+		if statusHostname == lb.name || statusHostname == lb.hostname() {
 			return nil
 		}
 	}
@@ -1219,6 +1954,9 @@ func shouldManageLB(lb *loadBalancer) error {
 
 func (lb *loadBalancer) hasMissingTags() bool {
 	wantedTags := []string{cloudProviderTag, serviceTag, namespaceTag}
+	if lb.vip != "" {
+		wantedTags = append(wantedTags, vipTag)
+	}
 	tagMap := map[string]string{}
 	for _, lbTag := range lb.rule.Tags {
 		tagMap[lbTag.Key] = lbTag.Value
@@ -1249,16 +1987,52 @@ func tagsForService(service *v1.Service) map[string]string {
 	}
 }
 
+// tagsForVIP returns the service tags including the vip tag for additional
+// VIPs.
+func tagsForVIP(service *v1.Service, vip string) map[string]string {
+	tags := tagsForService(service)
+	if vip != "" {
+		tags[vipTag] = vip
+	}
+	return tags
+}
+
+// assignTagsToRule tags the load balancer rule, internal load balancers share
+// the same resource type as rules.
 func (lb *loadBalancer) assignTagsToRule() error {
-	return lb.cloud.setDefaultTags(CloudstackResourceLoadBalancer, lb.rule.Id, lb.service)
+	return lb.cloud.setDefaultTags(CloudstackResourceLoadBalancer, lb.rule.Id, lb.service, lb.vip)
+}
+
+// setRuleTag sets the value of a tag of the rule, keeping the loaded rule
+// tags up to date. Tags cannot be updated in place, the previous value is
+// removed first.
+func (lb *loadBalancer) setRuleTag(key, value string) error {
+	var tags []cloudstack.Tags
+	for _, tag := range lb.rule.Tags {
+		if tag.Key != key {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) != len(lb.rule.Tags) {
+		err := lb.cloud.deleteResourceTags(CloudstackResourceLoadBalancer, lb.rule.Id, []string{key})
+		if err != nil {
+			return err
+		}
+	}
+	err := lb.cloud.setResourceTags(CloudstackResourceLoadBalancer, lb.rule.Id, map[string]string{key: value})
+	if err != nil {
+		return err
+	}
+	lb.rule.Tags = append(tags, cloudstack.Tags{Key: key, Value: value})
+	return nil
 }
 
-func (pc *projectCloud) assignTagsToIP(ip *cloudstackIP, service *v1.Service) error {
-	return pc.setDefaultTags(CloudstackResourceIPAdress, ip.id, service)
+func (pc *projectCloud) assignTagsToIP(ip *cloudstackIP, service *v1.Service, vip string) error {
+	return pc.setDefaultTags(CloudstackResourceIPAdress, ip.id, service, vip)
 }
 
-func (pc *projectCloud) setDefaultTags(resourceType, resourceID string, service *v1.Service) error {
-	return pc.setResourceTags(resourceType, resourceID, tagsForService(service))
+func (pc *projectCloud) setDefaultTags(resourceType, resourceID string, service *v1.Service, vip string) error {
+	return pc.setResourceTags(resourceType, resourceID, tagsForVIP(service, vip))
 }
 
 func (pc *projectCloud) setResourceTags(resourceType, resourceID string, tags map[string]string) error {
@@ -1288,43 +2062,89 @@ func (pc *projectCloud) setResourceTags(resourceType, resourceID string, tags ma
 	return nil
 }
 
-// assignHostsToRule assigns hosts to a load balancer rule.
-func (lb *loadBalancer) assignHostsToRule(hostIDs []string) error {
-	client, err := lb.getClient()
+func (pc *projectCloud) deleteResourceTags(resourceType, resourceID string, tagKeys []string) error {
+	client, err := pc.getClient()
 	if err != nil {
 		return err
 	}
-	p := client.LoadBalancer.NewAssignToLoadBalancerRuleParams(lb.rule.Id)
-	p.SetVirtualmachineids(hostIDs)
+	tags := map[string]string{}
+	for _, k := range tagKeys {
+		tags[k] = ""
+	}
+	p := client.Resourcetags.NewDeleteTagsParams([]string{resourceID}, resourceType)
+	p.SetTags(tags)
+	_, err = client.Resourcetags.DeleteTags(p)
+	if err != nil {
+		return fmt.Errorf("error removing tags from %s %s: %v", resourceType, resourceID, err)
+	}
+	return nil
+}
 
-	if _, err := client.LoadBalancer.AssignToLoadBalancerRule(p); err != nil {
+// assignHostsToRule assigns hosts to a load balancer rule, hosts with a
+// weight are assigned through vmidipmap with their weight. extraParams are
+// returned by the members-changed hook.
+func (lb *loadBalancer) assignHostsToRule(hostIDs []string, weights map[string]memberWeight, extraParams hookParams) error {
+	unweighted, memberParams := weightedMemberParams(hostIDs, weights)
+	if err := lb.updateRuleMembers("assignToLoadBalancerRule", unweighted, memberParams, extraParams); err != nil {
 		return fmt.Errorf("error assigning hosts to %v: %v", lb, err)
 	}
-
+	for _, hostID := range hostIDs {
+		if w, ok := weights[hostID]; ok && w.ipAddress != "" && w.weight != lb.memberWeight(hostID) {
+			if err := lb.setMemberWeightTag(hostID, w.weight); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 // assignNetworksToRule assigns networks to a load balancer rule.
 func (lb *loadBalancer) assignNetworksToRule(networkIDs []string) error {
-	if lb.cloud.config.Command.AssignNetworks == "" {
+	if lb.internal || lb.cloud.config.Command.AssignNetworks == "" {
+		return nil
+	}
+	if lb.spansZones() {
+		// Networks are assigned once per zone so that the backend creates
+		// the pool members in every zone.
+		zoneNetworks := map[string][]string{}
+		var zones []string
+		for _, networkID := range networkIDs {
+			zoneID := lb.networkZone(networkID)
+			if _, ok := zoneNetworks[zoneID]; !ok {
+				zones = append(zones, zoneID)
+			}
+			zoneNetworks[zoneID] = append(zoneNetworks[zoneID], networkID)
+		}
+		sort.Strings(zones)
+		for _, zoneID := range zones {
+			if err := lb.assignNetworkToRule(zoneNetworks[zoneID], zoneID); err != nil {
+				return err
+			}
+		}
 		return nil
 	}
 	for i := range networkIDs {
-		if err := lb.assignNetworkToRule(networkIDs[i]); err != nil {
+		if err := lb.assignNetworkToRule([]string{networkIDs[i]}, ""); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (lb *loadBalancer) assignNetworkToRule(networkID string) error {
-	klog.V(4).Infof("assign network %q to %v", networkID, lb)
+func (lb *loadBalancer) assignNetworkToRule(networkIDs []string, zoneID string) error {
+	klog.V(4).Infof("assign networks %v in zone %q to %v", networkIDs, zoneID, lb)
 	p := &cloudstack.CustomServiceParams{}
 	if lb.cloud.projectID != "" {
 		p.SetParam("projectid", lb.cloud.projectID)
 	}
 	p.SetParam("id", lb.rule.Id)
-	p.SetParam("networkids", []string{networkID})
+	p.SetParam("networkids", networkIDs)
+	if zoneID != "" {
+		p.SetParam("zoneid", zoneID)
+	}
+	if err := lb.applyCommandArgs(lb.cloud.config.Command.AssignNetworks, p); err != nil {
+		return err
+	}
 	client, err := lb.getClient()
 	if err != nil {
 		return err
@@ -1348,19 +2168,37 @@ func (lb *loadBalancer) assignNetworkToRule(networkID string) error {
 	return nil
 }
 
-// removeHostsFromRule removes hosts from a load balancer rule.
-func (lb *loadBalancer) removeHostsFromRule(hostIDs []string) error {
+// removeHostsFromRule removes hosts from a load balancer rule, extraParams
+// are returned by the members-changed hook.
+func (lb *loadBalancer) removeHostsFromRule(hostIDs []string, extraParams hookParams) error {
+	if err := lb.updateRuleMembers("removeFromLoadBalancerRule", hostIDs, nil, extraParams); err != nil {
+		return fmt.Errorf("error removing hosts from %v: %v", lb, err)
+	}
+	return nil
+}
+
+func (lb *loadBalancer) updateRuleMembers(command string, hostIDs []string, memberParams, extraParams hookParams) error {
 	client, err := lb.getClient()
 	if err != nil {
 		return err
 	}
-	p := client.LoadBalancer.NewRemoveFromLoadBalancerRuleParams(lb.rule.Id)
-	p.SetVirtualmachineids(hostIDs)
-
-	if _, err := client.LoadBalancer.RemoveFromLoadBalancerRule(p); err != nil {
-		return fmt.Errorf("error removing hosts from %v: %v", lb, err)
+	p := lb.cloud.newCommandParams(command, lb.service)
+	p.SetParam("id", lb.rule.Id)
+	if len(hostIDs) > 0 {
+		p.SetParam("virtualmachineids", strings.Join(hostIDs, ","))
 	}
+	memberParams.apply(p)
+	extraParams.apply(p)
 
+	var result struct {
+		JobID string `json:"jobid"`
+	}
+	if err = client.Custom.CustomRequest(command, p, &result); err != nil {
+		return err
+	}
+	if result.JobID != "" {
+		return waitJob(client, result.JobID, nil)
+	}
 	return nil
 }
 
@@ -1373,6 +2211,9 @@ func (lb *loadBalancer) setAlgorithm(service *v1.Service) error {
 	default:
 		return fmt.Errorf("unsupported load balancer affinity: %v", service.Spec.SessionAffinity)
 	}
+	for _, vipLB := range lb.vips {
+		vipLB.algorithm = lb.algorithm
+	}
 	return nil
 }
 
@@ -1392,20 +2233,6 @@ func (pc *projectCloud) getLBEnvironmentID() string {
 	return pc.environments[pc.environment].lbEnvironmentID
 }
 
-func setExtraParams(service *v1.Service, prefix string, params *cloudstack.CustomServiceParams) {
-	for key, value := range service.ObjectMeta.Annotations {
-		if strings.HasPrefix(key, prefix) {
-			params.SetParam(strings.TrimPrefix(key, prefix), value)
-		}
-	}
-
-	for key, value := range service.ObjectMeta.Labels {
-		if strings.HasPrefix(key, prefix) {
-			params.SetParam(strings.TrimPrefix(key, prefix), value)
-		}
-	}
-}
-
 // symmetricDifference returns the symmetric difference between the old (existing) and new (wanted) host ID's.
 func symmetricDifference(hostIDs []string, lbInstances []*cloudstack.VirtualMachine) ([]string, []string) {
 	new := make(map[string]bool)
@@ -1483,39 +2310,67 @@ func (lb *loadBalancer) getTargetPort(targetPort intstr.IntOrString) (int, error
 	return 0, fmt.Errorf("no port name \"%s\" found for endpoint for %v", targetPort.String(), lb)
 }
 
-func (lb *loadBalancer) syncNodes(hostIDs, networkIDs []string) error {
+// syncNodes assigns and removes members of the rule to match the hosts, new
+// members are assigned with their weight. changed indicates whether members
+// were assigned or removed.
+func (lb *loadBalancer) syncNodes(hostIDs, networkIDs []string, weights map[string]memberWeight) (changed bool, err error) {
 	client, err := lb.getClient()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	p := client.LoadBalancer.NewListLoadBalancerRuleInstancesParams(lb.rule.Id)
 	vms, err := listAllLBInstancesPages(client, p)
 	if err != nil {
-		return fmt.Errorf("error retrieving associated instances: %v", err)
+		return false, fmt.Errorf("error retrieving associated instances: %v", err)
 	}
 
 	assign, remove := symmetricDifference(hostIDs, vms)
 
+	if err := lb.undrainHosts(hostIDs); err != nil {
+		return false, err
+	}
+
 	if len(assign) > 0 {
 		klog.V(4).Infof("Assigning networks (%v) to load balancer: %v", networkIDs, lb)
 		if err := lb.assignNetworksToRule(networkIDs); err != nil {
-			return err
+			return false, err
 		}
 
 		klog.V(4).Infof("Assigning new hosts (%v) to load balancer: %v", assign, lb)
-		if err := lb.assignHostsToRule(assign); err != nil {
-			return err
+		err = lb.changeMembers(hookMembers{Assign: assign}, func(extraParams hookParams) error {
+			return lb.assignHostsToRule(assign, weights, extraParams)
+		})
+		if err != nil {
+			return false, err
 		}
+		changed = true
 	}
 
 	if len(remove) > 0 {
-		klog.V(4).Infof("Removing old hosts (%v) from load balancer: %v", assign, lb)
-		if err := lb.removeHostsFromRule(remove); err != nil {
-			return err
+		ready, pending, err := lb.drainHosts(remove)
+		if err != nil {
+			return changed, err
+		}
+		if len(ready) > 0 {
+			klog.V(4).Infof("Removing old hosts (%v) from load balancer: %v", ready, lb)
+			err = lb.changeMembers(hookMembers{Remove: ready}, func(extraParams hookParams) error {
+				return lb.removeHostsFromRule(ready, extraParams)
+			})
+			if err != nil {
+				return changed, err
+			}
+			lb.drainDone(ready)
+			if err = lb.removeMemberTags(ready); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+		if pending > 0 {
+			return changed, DrainPendingError{remaining: pending}
 		}
 	}
-	return nil
+	return changed, nil
 }
 
 func nodeNames(nodes []*v1.Node) string {
@@ -85,6 +85,28 @@ func waitEvent(t *testing.T, expected string) {
 	}
 }
 
+// waitAnyEvent waits for an event with the expected message regardless of
+// the events recorded after it.
+func waitAnyEvent(t *testing.T, expected string) {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Errorf("timeout waiting for event with message %q", expected)
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		globalTestEvents.Lock()
+		for _, evt := range globalTestEvents.events {
+			if strings.Contains(evt, expected) {
+				globalTestEvents.Unlock()
+				return
+			}
+		}
+		globalTestEvents.Unlock()
+	}
+}
+
 func Test_CSCloud_EnsureLoadBalancer(t *testing.T) {
 	baseNodes := []*corev1.Node{
 		{
@@ -409,6 +431,42 @@ func Test_CSCloud_EnsureLoadBalancer(t *testing.T) {
 			},
 		},
 
+		{
+			name: "removes nodes excluded from load balancers",
+			calls: []consecutiveCall{
+				{
+					svc:    baseSvc,
+					assert: baseAssert,
+				},
+				{
+					svc: baseSvc,
+					nodes: (func() []*corev1.Node {
+						n1 := baseNodes[0].DeepCopy()
+						n1.Labels["node.kubernetes.io/exclude-from-external-load-balancers"] = ""
+						n2 := baseNodes[0].DeepCopy()
+						n2.Name = "n2"
+						return []*corev1.Node{
+							n1, n2,
+						}
+					})(),
+					assert: func(t *testing.T, srv *cloudstackFake.CloudstackServer, lbStatus *corev1.LoadBalancerStatus, err error) {
+						require.NoError(t, err)
+						srv.HasCalls(t, []cloudstackFake.MockAPICall{
+							{Command: "listVirtualMachines", Params: url.Values{"name": []string{"n2"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"svc1.test.com"}}},
+							{Command: "listLoadBalancerRuleInstances", Params: url.Values{"page": []string{"1"}, "id": []string{"lbrule-1"}}},
+							{Command: "assignNetworkToLBRule", Params: url.Values{"id": []string{"lbrule-1"}, "networkids": []string{"net2"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "assignToLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineids": []string{"vm2"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "removeFromLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineids": []string{"vm1"}}},
+							{Command: "queryAsyncJobResult"},
+						})
+					},
+				},
+			},
+		},
+
 		{
 			name: "second ensure updating ports",
 			calls: []consecutiveCall{
@@ -1607,6 +1665,8 @@ func Test_CSCloud_EnsureLoadBalancer(t *testing.T) {
 							{Command: "listVirtualMachines"},
 							{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"svc1.test.com"}}},
 							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listLoadBalancers", Params: url.Values{"name": []string{"svc1.test.com"}}},
+							{Command: "listLoadBalancers", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
 							{Command: "listPublicIpAddresses", Params: url.Values{"page": []string{"1"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
 							{Command: "listPublicIpAddresses", Params: url.Values{"ipaddress": []string{"192.168.9.9"}}},
 							{Command: "createTags", Params: url.Values{"resourceids": []string{"mycustomip"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
@@ -2235,6 +2295,7 @@ func Test_CSCloud_EnsureLoadBalancer(t *testing.T) {
 							{Command: "queryAsyncJobResult"},
 							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
 							{Command: "queryAsyncJobResult"},
+							{Command: "listNetworks", Params: url.Values{"id": []string{"mynetcustom1"}}},
 							{Command: "listLoadBalancerRuleInstances", Params: url.Values{"page": []string{"1"}, "id": []string{"lbrule-1"}}},
 							{Command: "assignNetworkToLBRule", Params: url.Values{"id": []string{"lbrule-1"}, "networkids": []string{"net1"}}},
 							{Command: "queryAsyncJobResult"},
@@ -2299,6 +2360,319 @@ func Test_CSCloud_EnsureLoadBalancer(t *testing.T) {
 				},
 			},
 		},
+
+		{
+			name: "dual-stack service allocates an IPv6 VIP and releases it when dropped",
+			hook: func(t *testing.T, srv *cloudstackFake.CloudstackServer) {
+				srv.SetIPv6LBEnvironment("16")
+				srv.Hook = func(w http.ResponseWriter, r *http.Request) bool {
+					if r.FormValue("command") == "listNetworks" {
+						w.Write([]byte(`{"listNetworksResponse": {"count": 1, "network": [{"id": "net1", "ip6cidr": "fd00::/64"}]}}`))
+						return true
+					}
+					return false
+				}
+			},
+			calls: []consecutiveCall{
+				{
+					svc: (func() corev1.Service {
+						svc := baseSvc.DeepCopy()
+						svc.Annotations["csccm.cloudprovider.io/loadbalancer-ip-families"] = "IPv4,IPv6"
+						return *svc
+					})(),
+					assert: func(t *testing.T, srv *cloudstackFake.CloudstackServer, lbStatus *corev1.LoadBalancerStatus, err error) {
+						require.NoError(t, err)
+						assert.Equal(t, lbStatus, &corev1.LoadBalancerStatus{
+							Ingress: []corev1.LoadBalancerIngress{
+								{IP: "10.0.0.1", Hostname: "svc1.test.com"},
+								{IP: "fd00::2", Hostname: "svc1.test.com"},
+							},
+						})
+						srv.HasCalls(t, []cloudstackFake.MockAPICall{
+							{Command: "listVirtualMachines"},
+							{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"svc1.test.com"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"ipv6.svc1.test.com"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listPublicIpAddresses", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listPublicIpAddresses"},
+							{Command: "listNetworks"},
+							{Command: "associateIpAddress", Params: url.Values{"lbenvironmentid": []string{"1"}, "networkid": []string{"net1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-1"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-1"}, "tags[0].key": []string{"kubernetes_namespace"}, "tags[0].value": []string{"myns"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-1"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createLoadBalancerRule", Params: url.Values{"name": []string{"svc1.test.com"}, "publicipid": []string{"ip-1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_namespace"}, "tags[0].value": []string{"myns"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listPublicIpAddresses"},
+							{Command: "listNetworks"},
+							{Command: "associateIpAddress", Params: url.Values{"lbenvironmentid": []string{"16"}, "networkid": []string{"net1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-2"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-2"}, "tags[0].key": []string{"kubernetes_namespace"}, "tags[0].value": []string{"myns"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-2"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-2"}, "tags[0].key": []string{"kubernetes_vip"}, "tags[0].value": []string{"ipv6"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createLoadBalancerRule", Params: url.Values{"name": []string{"ipv6.svc1.test.com"}, "publicipid": []string{"ip-2"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-2"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-2"}, "tags[0].key": []string{"kubernetes_namespace"}, "tags[0].value": []string{"myns"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-2"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-2"}, "tags[0].key": []string{"kubernetes_vip"}, "tags[0].value": []string{"ipv6"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"lbrule-1"}}},
+							{Command: "assignNetworkToLBRule", Params: url.Values{"id": []string{"lbrule-1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "assignToLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineids": []string{"vm1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"lbrule-2"}}},
+							{Command: "assignNetworkToLBRule", Params: url.Values{"id": []string{"lbrule-2"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "assignToLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-2"}, "virtualmachineids": []string{"vm1"}}},
+							{Command: "queryAsyncJobResult"},
+						})
+					},
+				},
+				{
+					svc: *baseSvc.DeepCopy(),
+					assert: func(t *testing.T, srv *cloudstackFake.CloudstackServer, lbStatus *corev1.LoadBalancerStatus, err error) {
+						require.NoError(t, err)
+						assert.Equal(t, lbStatus, &corev1.LoadBalancerStatus{
+							Ingress: []corev1.LoadBalancerIngress{
+								{IP: "10.0.0.1", Hostname: "svc1.test.com"},
+							},
+						})
+						srv.HasCalls(t, []cloudstackFake.MockAPICall{
+							{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"svc1.test.com"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listPublicIpAddresses", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "deleteLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-2"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listPublicIpAddresses", Params: url.Values{"id": []string{"ip-2"}}},
+							{Command: "disassociateIpAddress", Params: url.Values{"id": []string{"ip-2"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"lbrule-1"}}},
+						})
+					},
+				},
+			},
+		},
+		{
+			name: "service with additional VIPs on another network and a requested address",
+			hook: func(t *testing.T, srv *cloudstackFake.CloudstackServer) {
+				srv.AddIP(cloudstack.PublicIpAddress{
+					Id:        "ip-fixed",
+					Ipaddress: "192.168.9.9",
+					Networkid: "net9",
+				})
+			},
+			calls: []consecutiveCall{
+				{
+					svc: (func() corev1.Service {
+						svc := baseSvc.DeepCopy()
+						svc.Annotations["csccm.cloudprovider.io/loadbalancer-additional-vips"] = "internal=network:net2, fixed=ip:192.168.9.9"
+						return *svc
+					})(),
+					assert: func(t *testing.T, srv *cloudstackFake.CloudstackServer, lbStatus *corev1.LoadBalancerStatus, err error) {
+						require.NoError(t, err)
+						assert.Equal(t, lbStatus, &corev1.LoadBalancerStatus{
+							Ingress: []corev1.LoadBalancerIngress{
+								{IP: "10.0.0.1", Hostname: "svc1.test.com"},
+								{IP: "10.0.0.2", Hostname: "svc1.test.com"},
+								{IP: "192.168.9.9", Hostname: "svc1.test.com"},
+							},
+						})
+						srv.HasCalls(t, []cloudstackFake.MockAPICall{
+							{Command: "listVirtualMachines"},
+							{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"svc1.test.com"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"internal.svc1.test.com"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"fixed.svc1.test.com"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listPublicIpAddresses", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listPublicIpAddresses"},
+							{Command: "listNetworks"},
+							{Command: "associateIpAddress", Params: url.Values{"lbenvironmentid": []string{"1"}, "networkid": []string{"net1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-1"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-1"}, "tags[0].key": []string{"kubernetes_namespace"}, "tags[0].value": []string{"myns"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-1"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createLoadBalancerRule", Params: url.Values{"name": []string{"svc1.test.com"}, "networkid": []string{"net1"}, "publicipid": []string{"ip-1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_namespace"}, "tags[0].value": []string{"myns"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listPublicIpAddresses"},
+							{Command: "listNetworks"},
+							{Command: "associateIpAddress", Params: url.Values{"lbenvironmentid": []string{"1"}, "networkid": []string{"net2"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-2"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-2"}, "tags[0].key": []string{"kubernetes_namespace"}, "tags[0].value": []string{"myns"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-2"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-2"}, "tags[0].key": []string{"kubernetes_vip"}, "tags[0].value": []string{"internal"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createLoadBalancerRule", Params: url.Values{"name": []string{"internal.svc1.test.com"}, "networkid": []string{"net2"}, "publicipid": []string{"ip-2"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-2"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-2"}, "tags[0].key": []string{"kubernetes_namespace"}, "tags[0].value": []string{"myns"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-2"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-2"}, "tags[0].key": []string{"kubernetes_vip"}, "tags[0].value": []string{"internal"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listPublicIpAddresses"},
+							{Command: "listPublicIpAddresses", Params: url.Values{"ipaddress": []string{"192.168.9.9"}}},
+							{Command: "createLoadBalancerRule", Params: url.Values{"name": []string{"fixed.svc1.test.com"}, "networkid": []string{"net9"}, "publicipid": []string{"ip-fixed"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-3"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-3"}, "tags[0].key": []string{"kubernetes_namespace"}, "tags[0].value": []string{"myns"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-3"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-3"}, "tags[0].key": []string{"kubernetes_vip"}, "tags[0].value": []string{"fixed"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"lbrule-1"}}},
+							{Command: "assignNetworkToLBRule", Params: url.Values{"id": []string{"lbrule-1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "assignToLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineids": []string{"vm1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"lbrule-2"}}},
+							{Command: "assignNetworkToLBRule", Params: url.Values{"id": []string{"lbrule-2"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "assignToLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-2"}, "virtualmachineids": []string{"vm1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listNetworks", Params: url.Values{"id": []string{"net9"}}},
+							{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"lbrule-3"}}},
+							{Command: "assignNetworkToLBRule", Params: url.Values{"id": []string{"lbrule-3"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "assignToLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-3"}, "virtualmachineids": []string{"vm1"}}},
+							{Command: "queryAsyncJobResult"},
+						})
+					},
+				},
+			},
+		},
+		{
+			name: "removing an additional VIP deletes its rule and releases its IP",
+			calls: []consecutiveCall{
+				{
+					svc: (func() corev1.Service {
+						svc := baseSvc.DeepCopy()
+						svc.Annotations["csccm.cloudprovider.io/loadbalancer-additional-vips"] = "internal=network:net2"
+						return *svc
+					})(),
+					assert: func(t *testing.T, srv *cloudstackFake.CloudstackServer, lbStatus *corev1.LoadBalancerStatus, err error) {
+						require.NoError(t, err)
+						assert.Len(t, lbStatus.Ingress, 2)
+					},
+				},
+				{
+					svc: *baseSvc.DeepCopy(),
+					assert: func(t *testing.T, srv *cloudstackFake.CloudstackServer, lbStatus *corev1.LoadBalancerStatus, err error) {
+						require.NoError(t, err)
+						assert.Equal(t, lbStatus, &corev1.LoadBalancerStatus{
+							Ingress: []corev1.LoadBalancerIngress{
+								{IP: "10.0.0.1", Hostname: "svc1.test.com"},
+							},
+						})
+						srv.HasCalls(t, []cloudstackFake.MockAPICall{
+							{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"svc1.test.com"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listPublicIpAddresses", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "deleteLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-2"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listPublicIpAddresses", Params: url.Values{"id": []string{"ip-2"}}},
+							{Command: "disassociateIpAddress", Params: url.Values{"id": []string{"ip-2"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"lbrule-1"}}},
+						})
+					},
+				},
+			},
+		},
+		{
+			name: "dual-stack service on network without IPv6 keeps only IPv4",
+			calls: []consecutiveCall{
+				{
+					svc: (func() corev1.Service {
+						svc := baseSvc.DeepCopy()
+						svc.Annotations["csccm.cloudprovider.io/loadbalancer-ip-families"] = "IPv4,IPv6"
+						return *svc
+					})(),
+					assert: func(t *testing.T, srv *cloudstackFake.CloudstackServer, lbStatus *corev1.LoadBalancerStatus, err error) {
+						require.NoError(t, err)
+						assert.Equal(t, lbStatus, &corev1.LoadBalancerStatus{
+							Ingress: []corev1.LoadBalancerIngress{
+								{IP: "10.0.0.1", Hostname: "svc1.test.com"},
+							},
+						})
+						srv.HasCalls(t, []cloudstackFake.MockAPICall{
+							{Command: "listVirtualMachines"},
+							{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"svc1.test.com"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"ipv6.svc1.test.com"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listPublicIpAddresses", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "listPublicIpAddresses"},
+							{Command: "listNetworks"},
+							{Command: "associateIpAddress", Params: url.Values{"lbenvironmentid": []string{"1"}, "networkid": []string{"net1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-1"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-1"}, "tags[0].key": []string{"kubernetes_namespace"}, "tags[0].value": []string{"myns"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"ip-1"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createLoadBalancerRule", Params: url.Values{"name": []string{"svc1.test.com"}, "publicipid": []string{"ip-1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"cloudprovider"}, "tags[0].value": []string{"custom-cloudstack"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_namespace"}, "tags[0].value": []string{"myns"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "listPublicIpAddresses"},
+							{Command: "listNetworks"},
+							{Command: "listLoadBalancerRuleInstances", Params: url.Values{"id": []string{"lbrule-1"}}},
+							{Command: "assignNetworkToLBRule", Params: url.Values{"id": []string{"lbrule-1"}}},
+							{Command: "queryAsyncJobResult"},
+							{Command: "assignToLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineids": []string{"vm1"}}},
+							{Command: "queryAsyncJobResult"},
+						})
+					},
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -2317,11 +2691,12 @@ func Test_CSCloud_EnsureLoadBalancer(t *testing.T) {
 				},
 				Environment: map[string]*environmentConfig{
 					"env1": {
-						APIURL:          srv.URL,
-						APIKey:          "a",
-						SecretKey:       "b",
-						LBEnvironmentID: "1",
-						LBDomain:        "test.com",
+						APIURL:              srv.URL,
+						APIKey:              "a",
+						SecretKey:           "b",
+						LBEnvironmentID:     "1",
+						LBEnvironmentIDIPv6: "16",
+						LBDomain:            "test.com",
 					},
 				},
 			}, tt.prepend)
@@ -3045,6 +3420,60 @@ func Test_CSCloud_EnsureLoadBalancerDeleted(t *testing.T) {
 				})
 			},
 		},
+		{
+			name: "lb removal is enabled; removed VIP IP is released",
+			svc: func() *corev1.Service {
+				svc := baseSvc.DeepCopy()
+				svc.Annotations["environment-label"] = "env2"
+				svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{
+					{IP: "192.168.1.100"},
+					{IP: "192.168.1.101"},
+				}
+				return svc
+			}(),
+			setup: func(cs *cloudstackFake.CloudstackServer) {
+				tags := []cloudstack.Tags{
+					{Key: "cloudprovider", Value: "custom-cloudstack"},
+					{Key: "kubernetes_namespace", Value: "default"},
+					{Key: "kubernetes_service", Value: "svc1"},
+				}
+				cs.AddTags("1", tags)
+				cs.AddIP(cloudstack.PublicIpAddress{
+					Id:        "1",
+					Ipaddress: "192.168.1.100",
+					Tags:      tags,
+				})
+				cs.AddTags("2", append([]cloudstack.Tags{{Key: "kubernetes_vip", Value: "internal"}}, tags...))
+				cs.AddIP(cloudstack.PublicIpAddress{
+					Id:        "2",
+					Ipaddress: "192.168.1.101",
+				})
+				cs.AddLBRule("svc1.test.com", cloudstackFake.LoadBalancerRule{
+					Rule: map[string]interface{}{
+						"id":         "1",
+						"name":       "svc1.env2.test.com",
+						"publicipid": "1",
+						"publicip":   "192.168.1.100",
+					},
+				})
+			},
+			assert: func(t *testing.T, err error, cs *cloudstackFake.CloudstackServer) {
+				require.NoError(t, err)
+				cs.HasCalls(t, []cloudstackFake.MockAPICall{
+					{Command: "listLoadBalancerRules", Params: url.Values{"keyword": []string{"svc1.env2.test.com"}}},
+					{Command: "listLoadBalancerRules", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+					{Command: "listPublicIpAddresses", Params: url.Values{"tags[0].key": []string{"kubernetes_service"}, "tags[0].value": []string{"svc1"}}},
+					{Command: "deleteLoadBalancerRule", Params: url.Values{"id": []string{"1"}}},
+					{Command: "queryAsyncJobResult", Params: url.Values{"jobid": []string{"job-delete-lb-1"}}},
+					{Command: "listPublicIpAddresses", Params: url.Values{"id": []string{"1"}}},
+					{Command: "disassociateIpAddress", Params: url.Values{"id": []string{"1"}}},
+					{Command: "queryAsyncJobResult"},
+					{Command: "listPublicIpAddresses", Params: url.Values{"id": []string{"2"}}},
+					{Command: "disassociateIpAddress", Params: url.Values{"id": []string{"2"}}},
+					{Command: "queryAsyncJobResult"},
+				})
+			},
+		},
 		{
 			name: "lb removal is enabled; lb managed by this controller; no public ip attached to lb rule",
 			svc: func() *corev1.Service {
@@ -3533,3 +3962,37 @@ func Test_listAllIPPages(t *testing.T) {
 		}, ips)
 	})
 }
+
+func Test_parseAdditionalVIPs(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []vipSpec
+		err      string
+	}{
+		{value: "", expected: nil},
+		{
+			value: "internal=network:net2, public2=ip:200.1.1.10,",
+			expected: []vipSpec{
+				{name: "internal", networkID: "net2"},
+				{name: "public2", address: "200.1.1.10"},
+			},
+		},
+		{value: "internal", err: `invalid VIP "internal", expected name=network:<network-id> or name=ip:<address>`},
+		{value: "internal=net2", err: `invalid VIP "internal=net2", expected name=network:<network-id> or name=ip:<address>`},
+		{value: "public=ip:300.1.1.1", err: `invalid VIP "public=ip:300.1.1.1", expected name=network:<network-id> or name=ip:<address>`},
+		{value: "ipv6=network:net2", err: `invalid VIP name "ipv6"`},
+		{value: "Internal=network:net2", err: `invalid VIP name "Internal"`},
+		{value: "a=network:net2,a=network:net3", err: `duplicated VIP name "a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			vips, err := parseAdditionalVIPs(tt.value)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, vips)
+		})
+	}
+}
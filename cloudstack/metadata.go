@@ -0,0 +1,65 @@
+package cloudstack
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	metadataAvailabilityZone = "availability-zone"
+	metadataInstanceID       = "instance-id"
+	metadataLocalHostname    = "local-hostname"
+)
+
+// metadataClient queries the metadata service exposed by the CloudStack
+// virtual router to the VMs it serves.
+type metadataClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newMetadataClient(baseURL string) *metadataClient {
+	return &metadataClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (m *metadataClient) get(ctx context.Context, key string) (string, error) {
+	url := fmt.Sprintf("%s/latest/meta-data/%s", m.baseURL, key)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("error querying metadata %q: %v", key, err)
+	}
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading metadata %q: %v", key, err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("invalid status code querying metadata %q: %d - %s", key, rsp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (m *metadataClient) availabilityZone(ctx context.Context) (string, error) {
+	return m.get(ctx, metadataAvailabilityZone)
+}
+
+func (m *metadataClient) instanceID(ctx context.Context) (string, error) {
+	return m.get(ctx, metadataInstanceID)
+}
+
+func (m *metadataClient) localHostname(ctx context.Context) (string, error) {
+	return m.get(ctx, metadataLocalHostname)
+}
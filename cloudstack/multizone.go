@@ -0,0 +1,95 @@
+package cloudstack
+
+import (
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const eventReasonZonesNotSpanned = "LoadBalancerZonesNotSpanned"
+
+// zoneNetworksForNodes groups the networks of the nodes by their zone, nodes
+// in unknown zones are ignored.
+func zoneNetworksForNodes(nodes []nodeInfo) map[string][]string {
+	zoneNetworks := map[string]sets.String{}
+	for _, n := range nodes {
+		if n.zoneID == "" {
+			continue
+		}
+		if zoneNetworks[n.zoneID] == nil {
+			zoneNetworks[n.zoneID] = sets.String{}
+		}
+		zoneNetworks[n.zoneID].Insert(n.networkID)
+	}
+	result := make(map[string][]string, len(zoneNetworks))
+	for zoneID, networks := range zoneNetworks {
+		result[zoneID] = networks.List()
+	}
+	return result
+}
+
+// spansZones indicates whether the load balancer members are spread across
+// more than one zone.
+func (lb *loadBalancer) spansZones() bool {
+	return len(lb.zoneNetworks) > 1
+}
+
+// canSpanZones indicates whether the backend is able to serve members from
+// several zones with a single rule, which is only possible in GloboNetwork
+// environments where networks are assigned to rules.
+func (lb *loadBalancer) canSpanZones() bool {
+	return !lb.internal && lb.cloud.config.Command.AssignNetworks != ""
+}
+
+// recordZones records the zones of the nodes in the load balancer when the
+// backend is able to span zones. Other backends keep serving every node
+// through the rule zone as they always did, a warning event is recorded if
+// the nodes are spread across zones.
+func (lb *loadBalancer) recordZones(nodes []nodeInfo) {
+	zoneNetworks := zoneNetworksForNodes(nodes)
+	if lb.canSpanZones() {
+		lb.zoneNetworks = zoneNetworks
+		return
+	}
+	lb.zoneNetworks = nil
+	if len(zoneNetworks) <= 1 || lb.cloud.recorder == nil {
+		return
+	}
+	var zones []string
+	for zoneID := range zoneNetworks {
+		zones = append(zones, zoneID)
+	}
+	sort.Strings(zones)
+	lb.cloud.recorder.Eventf(lb.service, v1.EventTypeWarning, eventReasonZonesNotSpanned, "Load balancer %s cannot span the zones of its nodes (%s), every node is served through the zone of the rule: spanning zones requires the assign-networks command", lb.name, strings.Join(zones, ", "))
+}
+
+// poolZones returns the zones where the load balancer pools must be updated.
+func (lb *loadBalancer) poolZones() []string {
+	if !lb.spansZones() {
+		return []string{lb.rule.Zoneid}
+	}
+	var zones []string
+	for zoneID := range lb.zoneNetworks {
+		zones = append(zones, zoneID)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// networkZone returns the zone of a network of the load balancer members, it
+// is only known when members span several zones.
+func (lb *loadBalancer) networkZone(networkID string) string {
+	if !lb.spansZones() {
+		return ""
+	}
+	for zoneID, networks := range lb.zoneNetworks {
+		for _, n := range networks {
+			if n == networkID {
+				return zoneID
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+package cloudstack
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_CSCloud_multiZoneLoadBalancer(t *testing.T) {
+	tests := []struct {
+		name           string
+		assignNetworks string
+		assert         func(t *testing.T, srv *cloudstackFake.CloudstackServer)
+	}{
+		{
+			name:           "globonetwork assigns networks and updates pools in every zone",
+			assignNetworks: "assignNetworkToLBRule",
+			assert: func(t *testing.T, srv *cloudstackFake.CloudstackServer) {
+				var calls []cloudstackFake.MockAPICall
+				for _, call := range srv.Calls {
+					switch call.Command {
+					case "assignNetworkToLBRule", "assignToLoadBalancerRule", "listGloboNetworkPools":
+						calls = append(calls, call)
+					}
+				}
+				srv.Calls = calls
+				srv.HasCalls(t, []cloudstackFake.MockAPICall{
+					{Command: "assignNetworkToLBRule", Params: url.Values{"networkids": []string{"net1"}, "zoneid": []string{"zone1"}}},
+					{Command: "assignNetworkToLBRule", Params: url.Values{"networkids": []string{"net2"}, "zoneid": []string{"zone2"}}},
+					{Command: "assignToLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}}},
+					{Command: "listGloboNetworkPools", Params: url.Values{"zoneid": []string{"zone1"}}},
+					{Command: "listGloboNetworkPools", Params: url.Values{"zoneid": []string{"zone2"}}},
+				})
+			},
+		},
+		{
+			name: "backends unable to span zones keep every member in the rule zone pools",
+			assert: func(t *testing.T, srv *cloudstackFake.CloudstackServer) {
+				waitAnyEvent(t, "Load balancer svc1.test.com cannot span the zones of its nodes (zone1, zone2), every node is served through the zone of the rule: spanning zones requires the assign-networks command")
+				var calls []cloudstackFake.MockAPICall
+				var assigned []string
+				for _, call := range srv.Calls {
+					switch call.Command {
+					case "assignToLoadBalancerRule":
+						assigned = append(assigned, strings.Split(call.Params.Get("virtualmachineids"), ",")...)
+						calls = append(calls, call)
+					case "assignNetworkToLBRule", "listGloboNetworkPools":
+						calls = append(calls, call)
+					}
+				}
+				assert.ElementsMatch(t, []string{"vm1", "vm2"}, assigned)
+				srv.Calls = calls
+				srv.HasCalls(t, []cloudstackFake.MockAPICall{
+					{Command: "assignToLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}}},
+					{Command: "listGloboNetworkPools", Params: url.Values{"zoneid": []string{""}}},
+				})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := cloudstackFake.NewCloudstackServer()
+			defer srv.Close()
+			srv.SetVMZone("n1", "zone1")
+			srv.SetVMZone("n2", "zone2")
+			cs := newTestCSCloud(t, &CSConfig{
+				Global: globalConfig{
+					EnvironmentLabel: "environment-label",
+					ProjectIDLabel:   "my/project-label",
+				},
+				Command: commandConfig{
+					AssignNetworks: tt.assignNetworks,
+				},
+				Environment: map[string]*environmentConfig{
+					"env1": {
+						APIURL:          srv.URL,
+						APIKey:          "a",
+						SecretKey:       "b",
+						LBEnvironmentID: "1",
+						LBDomain:        "test.com",
+					},
+				},
+			}, nil)
+
+			var nodes []*corev1.Node
+			for _, name := range []string{"n1", "n2"} {
+				nodes = append(nodes, &corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: name,
+						Labels: map[string]string{
+							"my/project-label":  "11111111-2222-3333-4444-555555555555",
+							"environment-label": "env1",
+						},
+					},
+				})
+			}
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "svc1",
+					Namespace: "myns",
+					Labels: map[string]string{
+						"environment-label": "env1",
+					},
+					Annotations: map[string]string{
+						"csccm.cloudprovider.io/loadbalancer-custom-healthcheck":      "true",
+						"csccm.cloudprovider.io/loadbalancer-custom-healthcheck-msg-": "GET / HTTP/1.0",
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			}
+			_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+			require.NoError(t, err)
+
+			cs.updateLBQueue.start(context.Background())
+			_, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+			require.NoError(t, err)
+			cs.updateLBQueue.stopWait()
+			tt.assert(t, srv)
+		})
+	}
+}
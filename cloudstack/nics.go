@@ -0,0 +1,143 @@
+package cloudstack
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	"k8s.io/klog"
+)
+
+const (
+	nicSelectorNetworkName = "network-name"
+	nicSelectorNetworkID   = "network-id"
+	nicSelectorTrafficType = "traffic-type"
+	nicSelectorTagPrefix   = "tag."
+)
+
+// nicSelector picks a VM NIC by the network it is attached to or by the tags
+// assigned to it, instead of relying on its position in the NIC list. The
+// selector format is a comma separated list of key=value requirements, e.g.
+// "network-name=ingress,traffic-type=Guest" or "tag.role=external", all of
+// which must match.
+type nicSelector struct {
+	networkName string
+	networkID   string
+	trafficType string
+	tags        map[string]string
+	raw         string
+}
+
+func parseNICSelector(value string) (*nicSelector, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	selector := &nicSelector{raw: value}
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid NIC selector requirement %q, expected key=value", part)
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch {
+		case key == nicSelectorNetworkName:
+			selector.networkName = val
+		case key == nicSelectorNetworkID:
+			selector.networkID = val
+		case key == nicSelectorTrafficType:
+			selector.trafficType = val
+		case strings.HasPrefix(key, nicSelectorTagPrefix) && len(key) > len(nicSelectorTagPrefix):
+			if selector.tags == nil {
+				selector.tags = map[string]string{}
+			}
+			selector.tags[strings.TrimPrefix(key, nicSelectorTagPrefix)] = val
+		default:
+			return nil, fmt.Errorf("invalid NIC selector key %q, expected one of %q, %q, %q or %q", key, nicSelectorNetworkName, nicSelectorNetworkID, nicSelectorTrafficType, nicSelectorTagPrefix+"<key>")
+		}
+	}
+	return selector, nil
+}
+
+func (s *nicSelector) String() string {
+	if s == nil {
+		return ""
+	}
+	return s.raw
+}
+
+func (s *nicSelector) matches(nic cloudstack.Nic, nicTags func(nicID string) (map[string]string, error)) (bool, error) {
+	if s.networkName != "" && s.networkName != nic.Networkname {
+		return false, nil
+	}
+	if s.networkID != "" && s.networkID != nic.Networkid {
+		return false, nil
+	}
+	if s.trafficType != "" && !strings.EqualFold(s.trafficType, nic.Traffictype) {
+		return false, nil
+	}
+	if len(s.tags) == 0 {
+		return true, nil
+	}
+	tags, err := nicTags(nic.Id)
+	if err != nil {
+		return false, err
+	}
+	for k, v := range s.tags {
+		if tags[k] != v {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// nicIndex returns the index of the first NIC in the instance matching the
+// selector. If the selector is not set or does not match any NIC, index is
+// returned instead.
+func (cs *CSCloud) nicIndex(instance *cloudstack.VirtualMachine, environment string, selector *nicSelector, index int) (int, error) {
+	if selector == nil {
+		return index, nil
+	}
+	nicTags := func(nicID string) (map[string]string, error) {
+		env, ok := cs.environments[environment]
+		if !ok || env.manager == nil {
+			return nil, fmt.Errorf("unable to retrieve cloudstack manager for environment %q", environment)
+		}
+		return env.manager.nicTags(nicID, instance.Projectid)
+	}
+	for i, nic := range instance.Nic {
+		ok, err := selector.matches(nic, nicTags)
+		if err != nil {
+			return 0, fmt.Errorf("unable to match NIC %q with selector %q: %v", nic.Id, selector, err)
+		}
+		if ok {
+			return i, nil
+		}
+	}
+	klog.V(4).Infof("No NIC in instance %q matches selector %q, falling back to index %v", instance.Id, selector, index)
+	return index, nil
+}
+
+func (cs *CSCloud) internalNICIndex(instance *cloudstack.VirtualMachine, environment string) (int, error) {
+	return cs.nicIndex(instance, environment, cs.environments[environment].internalNIC, cs.config.Global.InternalIPIndex)
+}
+
+func (cs *CSCloud) externalNICIndex(instance *cloudstack.VirtualMachine, environment string) (int, error) {
+	return cs.nicIndex(instance, environment, cs.environments[environment].externalNIC, cs.config.Global.ExternalIPIndex)
+}
+
+func (cs *CSCloud) externalNIC(instance *cloudstack.VirtualMachine, environment string) (*cloudstack.Nic, error) {
+	if len(instance.Nic) == 0 {
+		return nil, errors.New("instance does not have any nics")
+	}
+
+	externalIndex, err := cs.externalNICIndex(instance, environment)
+	if err != nil {
+		return nil, err
+	}
+	if externalIndex >= 0 && externalIndex < len(instance.Nic) {
+		return &instance.Nic[externalIndex], nil
+	}
+	return &instance.Nic[0], nil
+}
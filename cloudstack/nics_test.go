@@ -0,0 +1,45 @@
+package cloudstack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseNICSelector(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected *nicSelector
+		err      string
+	}{
+		{value: "", expected: nil},
+		{
+			value:    "network-name=ingress",
+			expected: &nicSelector{networkName: "ingress", raw: "network-name=ingress"},
+		},
+		{
+			value: "network-id=net1, traffic-type=Guest,tag.role=external",
+			expected: &nicSelector{
+				networkID:   "net1",
+				trafficType: "Guest",
+				tags:        map[string]string{"role": "external"},
+				raw:         "network-id=net1, traffic-type=Guest,tag.role=external",
+			},
+		},
+		{value: "network-name", err: `invalid NIC selector requirement "network-name", expected key=value`},
+		{value: "tag.=x", err: `invalid NIC selector key "tag.", expected one of "network-name", "network-id", "traffic-type" or "tag.<key>"`},
+		{value: "index=1", err: `invalid NIC selector key "index", expected one of "network-name", "network-id", "traffic-type" or "tag.<key>"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			selector, err := parseNICSelector(tt.value)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, selector)
+		})
+	}
+}
@@ -3,22 +3,34 @@ package cloudstack
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
 )
 
+const nodeExcludeLBLabel = "node.kubernetes.io/exclude-from-external-load-balancers"
+
 type nodeInfo struct {
 	name          string
 	vmID          string
+	ipAddress     string
 	networkID     string
+	zoneID        string
+	zoneName      string
 	hostName      string
 	projectID     string
 	environmentID string
 	filterValue   string
+	excludeReason string
+	labels        labels.Set
+	weight        int
+	weightErr     string
 	revision      uint64
 }
 
@@ -125,9 +137,6 @@ func (r *nodeRegistry) handleEndpoints() cache.ResourceEventHandler {
 }
 
 func (r *nodeRegistry) nodesForService(svc *v1.Service) ([]nodeInfo, error) {
-	r.nodesMu.RLock()
-	defer r.nodesMu.RUnlock()
-
 	if svc == nil {
 		return nil, errors.New("service cannot be nil")
 	}
@@ -139,38 +148,75 @@ func (r *nodeRegistry) nodesForService(svc *v1.Service) ([]nodeInfo, error) {
 		filterValue, _ = getLabelOrAnnotation(svc.ObjectMeta, r.cs.config.Global.ServiceFilterLabel)
 	}
 
+	selector, err := nodeSelectorForService(svc)
+	if err != nil {
+		return nil, err
+	}
+
 	environment := r.cs.environmentForMeta(svc.ObjectMeta)
 	project, _ := r.cs.projectForMeta(svc.ObjectMeta, environment)
 
+	var excluded []string
+	r.nodesMu.RLock()
 	for _, nInfo := range r.nodes {
-		if nInfo.environmentID != environment {
-			continue
-		}
-		if filterValue != "" && nInfo.filterValue != filterValue {
-			continue
-		}
-		if project != "" && nInfo.projectID != project {
+		reason := nInfo.serviceExcludeReason(environment, project, filterValue, selector)
+		if reason != "" {
+			klog.V(4).Infof("Ignoring node %q for service %s/%s: %s", nInfo.name, svc.Namespace, svc.Name, reason)
+			excluded = append(excluded, fmt.Sprintf("%s (%s)", nInfo.name, reason))
 			continue
 		}
 
 		nodes = append(nodes, *nInfo)
 	}
+	r.nodesMu.RUnlock()
 
 	if len(nodes) == 0 {
+		if selector != nil {
+			// Recorded only when the excluded nodes change, services
+			// are synced and requeued often.
+			sort.Strings(excluded)
+			r.cs.warnOnce(svc, eventReasonNoNodesMatched, fmt.Sprintf("No nodes match selector %q, excluded nodes: %s", selector, strings.Join(excluded, ", ")))
+		}
 		return nil, fmt.Errorf("no nodes available to add to service %s/%s", svc.Namespace, svc.Name)
 	}
+	r.cs.clearWarning(svc, eventReasonNoNodesMatched)
 
-	return nodes, nil
+	return r.cs.nodesInTopologyZone(svc, nodes), nil
 }
 
-func (r *nodeRegistry) idsForService(svc *v1.Service) (hostIDs []string, networkIDs []string, projectID string, err error) {
-	nodes, err := r.nodesForService(svc)
+// nodeSelectorForService returns the label selector from the service node
+// selector annotation, or nil if it is not set.
+func nodeSelectorForService(svc *v1.Service) (labels.Selector, error) {
+	value, _ := getLabelOrAnnotation(svc.ObjectMeta, lbNodeSelector)
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	selector, err := labels.Parse(value)
 	if err != nil {
-		return nil, nil, "", err
+		return nil, fmt.Errorf("invalid %s annotation %q for service %s/%s: %v", lbNodeSelector, value, svc.Namespace, svc.Name, err)
 	}
+	return selector, nil
+}
 
-	hostIDs, networkIDs, projectID = idsForNodes(nodes)
-	return hostIDs, networkIDs, projectID, nil
+// serviceExcludeReason returns why the node must not be a member of a
+// service load balancer, or an empty string if it can be a member.
+func (n *nodeInfo) serviceExcludeReason(environment, project, filterValue string, selector labels.Selector) string {
+	if n.environmentID != environment {
+		return fmt.Sprintf("environment %q does not match %q", n.environmentID, environment)
+	}
+	if filterValue != "" && n.filterValue != filterValue {
+		return fmt.Sprintf("filter value %q does not match %q", n.filterValue, filterValue)
+	}
+	if project != "" && n.projectID != project {
+		return fmt.Sprintf("project %q does not match %q", n.projectID, project)
+	}
+	if n.excludeReason != "" {
+		return n.excludeReason
+	}
+	if selector != nil && !selector.Matches(n.labels) {
+		return "labels do not match selector"
+	}
+	return ""
 }
 
 func idsForNodes(nodes []nodeInfo) (hostIDs []string, networkIDs []string, projectID string) {
@@ -185,6 +231,15 @@ func idsForNodes(nodes []nodeInfo) (hostIDs []string, networkIDs []string, proje
 	return hostIDs, networkSet.List(), projectID
 }
 
+// nodeCountByNetwork returns the number of nodes in each network.
+func nodeCountByNetwork(nodes []nodeInfo) map[string]int {
+	count := map[string]int{}
+	for _, nInfo := range nodes {
+		count[nInfo.networkID]++
+	}
+	return count
+}
+
 func (r *nodeRegistry) updateNodes(nodes []*v1.Node) error {
 	if len(nodes) == 0 {
 		return errors.New("no nodes available to add to load balancer")
@@ -247,9 +302,47 @@ func (n *nodeInfo) updateLabels(cs *CSCloud, node *v1.Node) error {
 		n.hostName = name
 	}
 
+	n.excludeReason = cs.lbExcludeReason(node)
+	n.updateWeight(node)
+
+	n.labels = nil
+	if len(node.Labels) > 0 {
+		n.labels = make(labels.Set, len(node.Labels))
+		for k, v := range node.Labels {
+			n.labels[k] = v
+		}
+	}
+
 	return nil
 }
 
+// lbExcludeReason returns why the node must be left out of load balancers,
+// or an empty string if it can be a member.
+func (cs *CSCloud) lbExcludeReason(node *v1.Node) string {
+	if _, ok := node.Labels[nodeExcludeLBLabel]; ok {
+		return fmt.Sprintf("node has label %q", nodeExcludeLBLabel)
+	}
+	if cs.config.Global.LBExcludeUnschedulable && node.Spec.Unschedulable {
+		return "node is unschedulable"
+	}
+	if cs.config.Global.LBExcludeNotReady && !isNodeReady(node) {
+		return "node is not ready"
+	}
+	if cs.lbExcludeSelector != nil && cs.lbExcludeSelector.Matches(labels.Set(node.Labels)) {
+		return fmt.Sprintf("node matches selector %q", cs.lbExcludeSelector)
+	}
+	return ""
+}
+
+func isNodeReady(node *v1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == v1.NodeReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
 func newNodeInfo(cs *CSCloud, node *v1.Node) (*nodeInfo, error) {
 	nInfo := nodeInfo{
 		name: node.Name,
@@ -277,13 +370,16 @@ func newNodeInfo(cs *CSCloud, node *v1.Node) (*nodeInfo, error) {
 		return nil, nil
 	}
 
-	nic, err := cs.externalNIC(vm)
+	nic, err := cs.externalNIC(vm, nInfo.environmentID)
 	if err != nil {
 		return nil, err
 	}
 
 	nInfo.vmID = vm.Id
+	nInfo.ipAddress = nic.Ipaddress
 	nInfo.networkID = nic.Networkid
+	nInfo.zoneID = vm.Zoneid
+	nInfo.zoneName = vm.Zonename
 
 	return &nInfo, nil
 }
@@ -2,13 +2,17 @@ package cloudstack
 
 import (
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 func Test_NodeRegistry_updateNodes(t *testing.T) {
@@ -76,12 +80,18 @@ func Test_NodeRegistry_updateNodes(t *testing.T) {
 				"n1": {
 					name:          "n1",
 					vmID:          "vm1",
+					ipAddress:     "192.168.1.10",
 					networkID:     "net1",
 					hostName:      "n1",
 					projectID:     "11111111-2222-3333-4444-555555555555",
 					environmentID: "env1",
 					filterValue:   "pool1",
-					revision:      1,
+					labels: labels.Set{
+						"my/project-label":  "11111111-2222-3333-4444-555555555555",
+						"environment-label": "env1",
+						"pool-label":        "pool1",
+					},
+					revision: 1,
 				},
 			},
 		},
@@ -113,22 +123,34 @@ func Test_NodeRegistry_updateNodes(t *testing.T) {
 				"n1": {
 					name:          "n1",
 					vmID:          "vm1",
+					ipAddress:     "192.168.1.10",
 					networkID:     "net1",
 					hostName:      "n1",
 					projectID:     "11111111-2222-3333-4444-555555555555",
 					environmentID: "env1",
 					filterValue:   "pool1",
-					revision:      1,
+					labels: labels.Set{
+						"my/project-label":  "11111111-2222-3333-4444-555555555555",
+						"environment-label": "env1",
+						"pool-label":        "pool1",
+					},
+					revision: 1,
 				},
 				"n2": {
 					name:          "n2",
 					vmID:          "vm2",
+					ipAddress:     "192.168.2.10",
 					networkID:     "net2",
 					hostName:      "n2",
 					projectID:     "91111111-2222-3333-4444-555555555555",
 					environmentID: "env1",
 					filterValue:   "pool2",
-					revision:      1,
+					labels: labels.Set{
+						"my/project-label":  "91111111-2222-3333-4444-555555555555",
+						"environment-label": "env1",
+						"pool-label":        "pool2",
+					},
+					revision: 1,
 				},
 			},
 		},
@@ -149,12 +171,17 @@ func Test_NodeRegistry_updateNodes(t *testing.T) {
 				"n1": {
 					name:          "n1",
 					vmID:          "vm1",
+					ipAddress:     "192.168.1.10",
 					networkID:     "net1",
 					hostName:      "n1",
 					projectID:     "def-proj1",
 					environmentID: "env1",
 					filterValue:   "pool1",
-					revision:      1,
+					labels: labels.Set{
+						"environment-label": "env1",
+						"pool-label":        "pool1",
+					},
+					revision: 1,
 				},
 			},
 		},
@@ -174,12 +201,16 @@ func Test_NodeRegistry_updateNodes(t *testing.T) {
 				"n1": {
 					name:          "n1",
 					vmID:          "vm1",
+					ipAddress:     "192.168.1.10",
 					networkID:     "net1",
 					hostName:      "n1",
 					projectID:     "def-proj1",
 					environmentID: "env1",
 					filterValue:   "pool1",
-					revision:      1,
+					labels: labels.Set{
+						"pool-label": "pool1",
+					},
+					revision: 1,
 				},
 			},
 		},
@@ -196,6 +227,7 @@ func Test_NodeRegistry_updateNodes(t *testing.T) {
 				"n1": {
 					name:          "n1",
 					vmID:          "vm1",
+					ipAddress:     "192.168.1.10",
 					networkID:     "net1",
 					hostName:      "n1",
 					projectID:     "def-proj1",
@@ -252,12 +284,18 @@ func Test_NodeRegistry_updateNodes(t *testing.T) {
 				"n1": {
 					name:          "n1",
 					vmID:          "vm1",
+					ipAddress:     "192.168.1.10",
 					networkID:     "net1",
 					hostName:      "n1",
 					projectID:     "91111111-2222-3333-4444-555555555555",
 					environmentID: "env1",
 					filterValue:   "pool2",
-					revision:      1,
+					labels: labels.Set{
+						"my/project-label":  "91111111-2222-3333-4444-555555555555",
+						"environment-label": "env1",
+						"pool-label":        "pool2",
+					},
+					revision: 1,
 				},
 			},
 		},
@@ -301,22 +339,34 @@ func Test_NodeRegistry_updateNodes(t *testing.T) {
 				"n1": {
 					name:          "n1",
 					vmID:          "vm1",
+					ipAddress:     "192.168.1.10",
 					networkID:     "net1",
 					hostName:      "n1",
 					projectID:     "11111111-2222-3333-4444-555555555555",
 					environmentID: "env1",
 					filterValue:   "pool1",
-					revision:      1,
+					labels: labels.Set{
+						"my/project-label":  "11111111-2222-3333-4444-555555555555",
+						"environment-label": "env1",
+						"pool-label":        "pool1",
+					},
+					revision: 1,
 				},
 				"n2": {
 					name:          "n2",
 					vmID:          "vm2",
+					ipAddress:     "192.168.2.10",
 					networkID:     "net2",
 					hostName:      "n2",
 					projectID:     "91111111-2222-3333-4444-555555555555",
 					environmentID: "env1",
 					filterValue:   "pool2",
-					revision:      2,
+					labels: labels.Set{
+						"my/project-label":  "91111111-2222-3333-4444-555555555555",
+						"environment-label": "env1",
+						"pool-label":        "pool2",
+					},
+					revision: 2,
 				},
 			},
 		},
@@ -360,12 +410,18 @@ func Test_NodeRegistry_updateNodes(t *testing.T) {
 				"n2": {
 					name:          "n2",
 					vmID:          "vm2",
+					ipAddress:     "192.168.2.10",
 					networkID:     "net2",
 					hostName:      "n2",
 					projectID:     "91111111-2222-3333-4444-555555555555",
 					environmentID: "env1",
 					filterValue:   "pool2",
-					revision:      1,
+					labels: labels.Set{
+						"my/project-label":  "91111111-2222-3333-4444-555555555555",
+						"environment-label": "env1",
+						"pool-label":        "pool2",
+					},
+					revision: 1,
 				},
 			},
 		},
@@ -617,6 +673,9 @@ func Test_NodeRegistry_nodesForService(t *testing.T) {
 		svc           *corev1.Service
 		expectedNodes []string
 		expectedErr   string
+		hook          func(*CSConfig)
+		srvHook       func(*cloudstackFake.CloudstackServer)
+		expectedEvent string
 	}{
 		{
 			name: "empty",
@@ -703,12 +762,285 @@ func Test_NodeRegistry_nodesForService(t *testing.T) {
 			},
 			expectedNodes: []string{"n2"},
 		},
+		{
+			name: "nodes with exclusion label are ignored",
+			nodes: []*corev1.Node{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n1"},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n2", Labels: map[string]string{
+						"node.kubernetes.io/exclude-from-external-load-balancers": "",
+					}},
+				},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "svc1"},
+			},
+			expectedNodes: []string{"n1"},
+		},
+		{
+			name: "unschedulable and not ready nodes are kept by default",
+			nodes: []*corev1.Node{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n1"},
+					Spec:       corev1.NodeSpec{Unschedulable: true},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n2"},
+					Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+						{Type: corev1.NodeReady, Status: corev1.ConditionFalse},
+					}},
+				},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "svc1"},
+			},
+			expectedNodes: []string{"n1", "n2"},
+		},
+		{
+			name: "unschedulable and not ready nodes are ignored when configured",
+			hook: func(cfg *CSConfig) {
+				cfg.Global.LBExcludeUnschedulable = true
+				cfg.Global.LBExcludeNotReady = true
+			},
+			nodes: []*corev1.Node{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n1"},
+					Spec:       corev1.NodeSpec{Unschedulable: true},
+					Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+						{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+					}},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n2"},
+					Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+						{Type: corev1.NodeReady, Status: corev1.ConditionFalse},
+					}},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n3"},
+					Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+						{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+					}},
+				},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "svc1"},
+			},
+			expectedNodes: []string{"n3"},
+		},
+		{
+			name: "nodes matching exclusion selector are ignored",
+			hook: func(cfg *CSConfig) {
+				cfg.Global.LBExcludeNodeSelector = "role in (master, etcd)"
+			},
+			nodes: []*corev1.Node{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: map[string]string{"role": "master"}},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n2", Labels: map[string]string{"role": "worker"}},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n3"},
+				},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "svc1"},
+			},
+			expectedNodes: []string{"n2", "n3"},
+		},
+		{
+			name: "all nodes excluded",
+			nodes: []*corev1.Node{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: map[string]string{
+						"node.kubernetes.io/exclude-from-external-load-balancers": "true",
+					}},
+				},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "svc1"},
+			},
+			expectedErr: "no nodes available to add to service ns1/svc1",
+		},
+		{
+			name: "svc filtering by node selector",
+			nodes: []*corev1.Node{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: map[string]string{"pool": "edge"}},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n2", Labels: map[string]string{"pool": "edge-canary"}},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n3", Labels: map[string]string{"pool": "default"}},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n4"},
+				},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "ns1",
+					Name:      "svc1",
+					Annotations: map[string]string{
+						"csccm.cloudprovider.io/loadbalancer-node-selector": "pool in (edge, edge-canary)",
+					},
+				},
+			},
+			expectedNodes: []string{"n1", "n2"},
+		},
+		{
+			name: "svc filtering by node selector combined with project",
+			nodes: []*corev1.Node{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: map[string]string{"pool": "edge"}},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n2", Labels: map[string]string{
+						"pool":             "edge",
+						"my/project-label": "p9",
+					}},
+				},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "ns1",
+					Name:      "svc1",
+					Labels: map[string]string{
+						"my/project-label": "p9",
+					},
+					Annotations: map[string]string{
+						"csccm.cloudprovider.io/loadbalancer-node-selector": "pool=edge,!deprecated",
+					},
+				},
+			},
+			expectedNodes: []string{"n2"},
+		},
+		{
+			name: "svc with invalid node selector",
+			nodes: []*corev1.Node{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n1"},
+				},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "ns1",
+					Name:      "svc1",
+					Annotations: map[string]string{
+						"csccm.cloudprovider.io/loadbalancer-node-selector": "pool in edge",
+					},
+				},
+			},
+			expectedErr: `invalid csccm.cloudprovider.io/loadbalancer-node-selector annotation "pool in edge" for service ns1/svc1: unable to parse requirement: found 'edge' expected: '('`,
+		},
+		{
+			name: "svc with node selector matching no nodes",
+			nodes: []*corev1.Node{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: map[string]string{"pool": "default"}},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "n2", Labels: map[string]string{
+						"pool": "edge",
+						"node.kubernetes.io/exclude-from-external-load-balancers": "",
+					}},
+				},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "ns1",
+					Name:      "svc1",
+					Annotations: map[string]string{
+						"csccm.cloudprovider.io/loadbalancer-node-selector": "pool=edge",
+					},
+				},
+			},
+			expectedErr:   "no nodes available to add to service ns1/svc1",
+			expectedEvent: `No nodes match selector "pool=edge", excluded nodes: n1 (labels do not match selector), n2 (node has label "node.kubernetes.io/exclude-from-external-load-balancers")`,
+		},
+		{
+			name: "svc filtering by topology zone",
+			srvHook: func(srv *cloudstackFake.CloudstackServer) {
+				srv.SetVMZone("n1", "zone1")
+				srv.SetVMZone("n2", "zone2")
+			},
+			nodes: []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "n1"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "n2"}},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "ns1",
+					Name:      "svc1",
+					Annotations: map[string]string{
+						"csccm.cloudprovider.io/loadbalancer-topology-zone": "zone2",
+					},
+				},
+			},
+			expectedNodes: []string{"n2"},
+		},
+		{
+			name: "svc with topology zone of the public ip not filtered by the registry",
+			srvHook: func(srv *cloudstackFake.CloudstackServer) {
+				srv.SetVMZone("n1", "zone1")
+				srv.SetVMZone("n2", "zone2")
+				srv.AddIP(cloudstack.PublicIpAddress{Id: "ip-1", Ipaddress: "10.0.0.1", Zoneid: "zone1"})
+			},
+			nodes: []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "n1"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "n2"}},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "ns1",
+					Name:      "svc1",
+					Annotations: map[string]string{
+						"csccm.cloudprovider.io/loadbalancer-topology-zone": "public-ip",
+					},
+				},
+				Status: corev1.ServiceStatus{
+					LoadBalancer: corev1.LoadBalancerStatus{
+						Ingress: []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}},
+					},
+				},
+			},
+			expectedNodes: []string{"n1", "n2"},
+		},
+		{
+			name: "svc filtering by topology zone without nodes in the zone",
+			srvHook: func(srv *cloudstackFake.CloudstackServer) {
+				srv.SetVMZone("n1", "zone1")
+				srv.SetVMZone("n2", "zone2")
+			},
+			nodes: []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "n1"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "n2"}},
+			},
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "ns1",
+					Name:      "svc1",
+					Annotations: map[string]string{
+						"csccm.cloudprovider.io/loadbalancer-topology-zone": "zone3",
+					},
+				},
+			},
+			expectedNodes: []string{"n1", "n2"},
+			expectedEvent: `No nodes available in zone "zone3", using nodes in all zones`,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			srv := cloudstackFake.NewCloudstackServer()
 			defer srv.Close()
-			cs := newTestCSCloud(t, &CSConfig{
+			if tt.srvHook != nil {
+				tt.srvHook(srv)
+			}
+			cfg := &CSConfig{
 				Global: globalConfig{
 					EnvironmentLabel:   "environment-label",
 					ProjectIDLabel:     "my/project-label",
@@ -725,7 +1057,11 @@ func Test_NodeRegistry_nodesForService(t *testing.T) {
 						ProjectID:       "default-proj",
 					},
 				},
-			}, nil)
+			}
+			if tt.hook != nil {
+				tt.hook(cfg)
+			}
+			cs := newTestCSCloud(t, cfg, nil)
 
 			err := cs.nodeRegistry.updateNodes(tt.nodes)
 			require.NoError(t, err)
@@ -735,6 +1071,24 @@ func Test_NodeRegistry_nodesForService(t *testing.T) {
 			} else {
 				assert.EqualError(t, err, tt.expectedErr)
 			}
+			if tt.expectedEvent != "" {
+				waitEvent(t, tt.expectedEvent)
+			}
+			if tt.expectedEvent != "" && tt.expectedErr != "" {
+				// The event is not recorded again while nothing changes.
+				_, err = cs.nodeRegistry.nodesForService(tt.svc)
+				require.Error(t, err)
+				time.Sleep(200 * time.Millisecond)
+				var events int
+				globalTestEvents.Lock()
+				for _, evt := range globalTestEvents.events {
+					if strings.Contains(evt, tt.expectedEvent) {
+						events++
+					}
+				}
+				globalTestEvents.Unlock()
+				assert.Equal(t, 1, events)
+			}
 			var nodeNames []string
 			for _, n := range result {
 				nodeNames = append(nodeNames, n.name)
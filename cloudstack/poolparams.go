@@ -0,0 +1,80 @@
+package cloudstack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Per port GloboNetwork pool parameters, suffixed by the port name like
+	// the custom health check annotations.
+	lbPoolMaxConnPrefix           = "csccm.cloudprovider.io/loadbalancer-pool-maxconn-"
+	lbPoolL4ProtocolPrefix        = "csccm.cloudprovider.io/loadbalancer-pool-l4protocol-"
+	lbPoolL7ProtocolPrefix        = "csccm.cloudprovider.io/loadbalancer-pool-l7protocol-"
+	lbPoolServiceDownActionPrefix = "csccm.cloudprovider.io/loadbalancer-pool-service-down-action-"
+
+	udpL7Protocol = "Outros"
+)
+
+var poolParamPrefixes = []string{
+	lbPoolMaxConnPrefix,
+	lbPoolL4ProtocolPrefix,
+	lbPoolL7ProtocolPrefix,
+	lbPoolServiceDownActionPrefix,
+}
+
+// poolParams holds the pool parameters requested for a port, empty or nil
+// values are left unmanaged.
+type poolParams struct {
+	maxConn           *int
+	l4Protocol        string
+	l7Protocol        string
+	serviceDownAction string
+}
+
+// hasPoolParams indicates whether the service sets pool parameters for any of
+// its ports.
+func hasPoolParams(service *v1.Service) bool {
+	return hasAnnotationPrefix(service, poolParamPrefixes)
+}
+
+// poolParamsForPort returns the pool parameters requested for the named port.
+func poolParamsForPort(service *v1.Service, portName string) (poolParams, error) {
+	var params poolParams
+	if value, ok := getLabelOrAnnotation(service.ObjectMeta, lbPoolMaxConnPrefix+portName); ok {
+		maxConn, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || maxConn < 0 {
+			return params, fmt.Errorf("invalid value for %q: %q, expected a non-negative integer", lbPoolMaxConnPrefix+portName, value)
+		}
+		params.maxConn = &maxConn
+	}
+	params.l4Protocol, _ = getLabelOrAnnotation(service.ObjectMeta, lbPoolL4ProtocolPrefix+portName)
+	params.l7Protocol, _ = getLabelOrAnnotation(service.ObjectMeta, lbPoolL7ProtocolPrefix+portName)
+	params.serviceDownAction, _ = getLabelOrAnnotation(service.ObjectMeta, lbPoolServiceDownActionPrefix+portName)
+	return params, nil
+}
+
+// apply sets the requested parameters in the pool, returning whether any of
+// them changed and whether the change requires the pool to be redeployed.
+func (p poolParams) apply(pool *globoNetworkPool) (changed, redeploy bool) {
+	if p.maxConn != nil && pool.MaxConn != *p.maxConn {
+		pool.MaxConn = *p.maxConn
+		changed = true
+	}
+	if p.l4Protocol != "" && !strings.EqualFold(pool.L4Protocol, p.l4Protocol) {
+		pool.L4Protocol = p.l4Protocol
+		changed, redeploy = true, true
+	}
+	if p.l7Protocol != "" && !strings.EqualFold(pool.L7Protocol, p.l7Protocol) {
+		pool.L7Protocol = p.l7Protocol
+		changed, redeploy = true, true
+	}
+	if p.serviceDownAction != "" && pool.ServiceDownAction != p.serviceDownAction {
+		pool.ServiceDownAction = p.serviceDownAction
+		changed = true
+	}
+	return changed, redeploy
+}
@@ -0,0 +1,150 @@
+package cloudstack
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_poolParamsForPort(t *testing.T) {
+	maxConn := 100
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    poolParams
+		err         string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "all params",
+			annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-pool-maxconn-web":             "100",
+				"csccm.cloudprovider.io/loadbalancer-pool-l4protocol-web":          "TCP",
+				"csccm.cloudprovider.io/loadbalancer-pool-l7protocol-web":          "HTTP",
+				"csccm.cloudprovider.io/loadbalancer-pool-service-down-action-web": "reset",
+				"csccm.cloudprovider.io/loadbalancer-pool-maxconn-other":           "5",
+			},
+			expected: poolParams{maxConn: &maxConn, l4Protocol: "TCP", l7Protocol: "HTTP", serviceDownAction: "reset"},
+		},
+		{
+			name: "invalid maxconn",
+			annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-pool-maxconn-web": "-1",
+			},
+			err: `invalid value for "csccm.cloudprovider.io/loadbalancer-pool-maxconn-web": "-1", expected a non-negative integer`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			assert.Equal(t, len(tt.annotations) > 0, hasPoolParams(svc))
+			params, err := poolParamsForPort(svc, "web")
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, params)
+		})
+	}
+}
+
+func Test_CSCloud_poolParams(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+			},
+		},
+	}, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-pool-maxconn-web":             "100",
+				"csccm.cloudprovider.io/loadbalancer-pool-l4protocol-web":          "TCP",
+				"csccm.cloudprovider.io/loadbalancer-pool-l7protocol-web":          "HTTP",
+				"csccm.cloudprovider.io/loadbalancer-pool-service-down-action-web": "reset",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "web", Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	ensure := func() {
+		srv.Calls = nil
+		cs.updateLBQueue.start(context.Background())
+		_, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), []*corev1.Node{node})
+		cs.updateLBQueue.stopWait()
+		require.NoError(t, err)
+		var calls []cloudstackFake.MockAPICall
+		for _, call := range srv.Calls {
+			if call.Command == "listGloboNetworkPools" || call.Command == "updateGloboNetworkPool" {
+				calls = append(calls, call)
+			}
+		}
+		srv.Calls = calls
+	}
+
+	ensure()
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listGloboNetworkPools"},
+		{Command: "updateGloboNetworkPool", Params: url.Values{
+			"healthchecktype":   []string{"TCP"},
+			"maxconn":           []string{"100"},
+			"l4protocol":        []string{"TCP"},
+			"l7protocol":        []string{"HTTP"},
+			"servicedownaction": []string{"reset"},
+			"redeploy":          []string{"true"},
+		}},
+	})
+
+	ensure()
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listGloboNetworkPools"},
+	})
+
+	svc.Annotations["csccm.cloudprovider.io/loadbalancer-pool-maxconn-web"] = "200"
+	ensure()
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listGloboNetworkPools"},
+		{Command: "updateGloboNetworkPool", Params: url.Values{"maxconn": []string{"200"}, "l4protocol": []string{"TCP"}}},
+	})
+	assert.NotContains(t, srv.Calls[1].Params, "redeploy")
+}
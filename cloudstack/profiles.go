@@ -0,0 +1,217 @@
+package cloudstack
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+const (
+	// lbProfile names the CloudStackLoadBalancerProfile providing default
+	// annotations for the service.
+	lbProfile = "csccm.cloudprovider.io/loadbalancer-profile"
+
+	eventReasonProfileNotFound = "LoadBalancerProfileNotFound"
+
+	profileResyncPeriod = 10 * time.Minute
+)
+
+// profileResource is the cluster scoped CloudStackLoadBalancerProfile
+// resource, its spec.annotations are applied to the services referencing it
+// unless the service sets them itself.
+var profileResource = schema.GroupVersionResource{
+	Group:    "csccm.cloudprovider.io",
+	Version:  "v1alpha1",
+	Resource: "cloudstackloadbalancerprofiles",
+}
+
+// profileRegistry holds the annotations of load balancer profiles keyed by
+// profile name.
+type profileRegistry struct {
+	sync.RWMutex
+	profiles map[string]map[string]string
+	synced   bool
+}
+
+func newProfileRegistry() *profileRegistry {
+	return &profileRegistry{
+		profiles: map[string]map[string]string{},
+	}
+}
+
+func (r *profileRegistry) get(name string) (map[string]string, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	annotations, ok := r.profiles[name]
+	return annotations, ok
+}
+
+// update stores the profile returning whether its annotations changed.
+func (r *profileRegistry) update(obj *unstructured.Unstructured) bool {
+	annotations, _, err := unstructured.NestedStringMap(obj.Object, "spec", "annotations")
+	if err != nil {
+		klog.Errorf("Ignoring invalid load balancer profile %s: %v", obj.GetName(), err)
+		annotations = nil
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	r.Lock()
+	defer r.Unlock()
+	current, ok := r.profiles[obj.GetName()]
+	r.profiles[obj.GetName()] = annotations
+	return !ok || !reflect.DeepEqual(current, annotations)
+}
+
+func (r *profileRegistry) markSynced() {
+	r.Lock()
+	defer r.Unlock()
+	r.synced = true
+}
+
+func (r *profileRegistry) hasSynced() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.synced
+}
+
+func (r *profileRegistry) remove(name string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.profiles, name)
+}
+
+// profileName returns the name of the profile referenced by the service,
+// falling back to its load balancer class. explicit is false when the name
+// comes from the class.
+func profileName(service *v1.Service) (name string, explicit bool) {
+	if name, _ = getLabelOrAnnotation(service.ObjectMeta, lbProfile); name != "" {
+		return name, true
+	}
+	return loadBalancerClass(service), false
+}
+
+// withProfile returns a copy of the service with the annotations of its
+// profile, annotations set on the service take precedence. The service is
+// returned unchanged if it does not reference a profile. A load balancer class
+// without a profile of the same name is not an error.
+func (cs *CSCloud) withProfile(service *v1.Service) *v1.Service {
+	name, explicit := profileName(service)
+	if name == "" || cs.profiles == nil {
+		return service
+	}
+	annotations, ok := cs.profiles.get(name)
+	if !ok {
+		if !explicit {
+			return service
+		}
+		klog.Warningf("Load balancer profile %q of service %s/%s not found", name, service.Namespace, service.Name)
+		if cs.recorder != nil {
+			cs.recorder.Eventf(service, v1.EventTypeWarning, eventReasonProfileNotFound, "Load balancer profile %q not found", name)
+		}
+		return service
+	}
+	svc := service.DeepCopy()
+	if svc.Annotations == nil {
+		svc.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		if _, ok := svc.Annotations[k]; !ok {
+			svc.Annotations[k] = v
+		}
+	}
+	return svc
+}
+
+// profilesSynced returns an error if the service references a profile which
+// may not be loaded yet, the profile settings could change its load balancer
+// name or removal.
+func (cs *CSCloud) profilesSynced(service *v1.Service) error {
+	if !cs.config.Global.LBProfiles || cs.profiles.hasSynced() {
+		return nil
+	}
+	if name, _ := profileName(service); name != "" {
+		return fmt.Errorf("load balancer profiles not synced yet, unable to handle service %s/%s using profile %q", service.Namespace, service.Name, name)
+	}
+	return nil
+}
+
+// watchProfiles keeps the profile registry up to date until the context is
+// done, blocking until the profiles are synced. It returns false if the
+// context is done first.
+func (cs *CSCloud) watchProfiles(ctx context.Context, client dynamic.Interface) bool {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, profileResyncPeriod, metav1.NamespaceAll, nil)
+	informer := factory.ForResource(profileResource).Informer()
+	informer.AddEventHandler(cs.handleProfiles(informer.HasSynced))
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return false
+	}
+	cs.profiles.markSynced()
+	return true
+}
+
+// handleProfiles updates the profile registry, requeuing the services of
+// changed profiles once synced returns true.
+func (cs *CSCloud) handleProfiles(synced func() bool) cache.ResourceEventHandler {
+	update := func(obj interface{}) {
+		profile, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+		if cs.profiles.update(profile) && synced() {
+			cs.requeueProfileServices(profile.GetName())
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj interface{}) { update(obj) },
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if profile, ok := obj.(*unstructured.Unstructured); ok {
+				cs.profiles.remove(profile.GetName())
+				cs.requeueProfileServices(profile.GetName())
+			}
+		},
+	}
+}
+
+// requeueProfileServices pushes the load balancer services referencing the
+// profile to the update queue, updating their members and pools. Settings
+// applied only when the load balancer is created take effect on the next
+// EnsureLoadBalancer.
+func (cs *CSCloud) requeueProfileServices(name string) {
+	services, err := cs.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Unable to list services of load balancer profile %q: %v", name, err)
+		return
+	}
+	for i := range services.Items {
+		service := &services.Items[i]
+		if profile, _ := profileName(service); service.Spec.Type != v1.ServiceTypeLoadBalancer || profile != name || !cs.claimsService(service) {
+			continue
+		}
+		klog.V(3).Infof("Requeuing service %s/%s after load balancer profile %q changed", service.Namespace, service.Name, name)
+		err = cs.updateLBQueue.push(queueEntry{
+			service:    cs.withProfile(service),
+			start:      time.Now(),
+			updatePool: true,
+		})
+		if err != nil {
+			klog.Errorf("Unable to requeue service %s/%s: %v", service.Namespace, service.Name, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package cloudstack
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestProfile(name string, annotations map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "csccm.cloudprovider.io/v1alpha1",
+			"kind":       "CloudStackLoadBalancerProfile",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+			"spec": map[string]interface{}{
+				"annotations": annotations,
+			},
+		},
+	}
+}
+
+func Test_CSCloud_withProfile(t *testing.T) {
+	cs := newTestCSCloud(t, &CSConfig{}, nil)
+	assert.True(t, cs.profiles.update(newTestProfile("web", map[string]interface{}{
+		lbNameSuffix:              "custom.com",
+		removeLBsOnDeleteLabelKey: "true",
+	})))
+	assert.False(t, cs.profiles.update(newTestProfile("web", map[string]interface{}{
+		lbNameSuffix:              "custom.com",
+		removeLBsOnDeleteLabelKey: "true",
+	})))
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		expected    map[string]string
+	}{
+		{
+			name:     "no profile",
+			expected: nil,
+		},
+		{
+			name:        "profile annotations",
+			annotations: map[string]string{lbProfile: "web"},
+			expected: map[string]string{
+				lbProfile:                 "web",
+				lbNameSuffix:              "custom.com",
+				removeLBsOnDeleteLabelKey: "true",
+			},
+		},
+		{
+			name:        "service annotations override the profile",
+			annotations: map[string]string{lbProfile: "web", removeLBsOnDeleteLabelKey: "false"},
+			expected: map[string]string{
+				lbProfile:                 "web",
+				lbNameSuffix:              "custom.com",
+				removeLBsOnDeleteLabelKey: "false",
+			},
+		},
+		{
+			name:     "profile from label",
+			labels:   map[string]string{lbProfile: "web"},
+			expected: map[string]string{lbNameSuffix: "custom.com", removeLBsOnDeleteLabelKey: "true"},
+		},
+		{
+			name:        "profile from load balancer class",
+			annotations: map[string]string{lbClass: "web"},
+			expected: map[string]string{
+				lbClass:                   "web",
+				lbNameSuffix:              "custom.com",
+				removeLBsOnDeleteLabelKey: "true",
+			},
+		},
+		{
+			name:        "load balancer class without profile",
+			annotations: map[string]string{lbClass: "metallb"},
+			expected:    map[string]string{lbClass: "metallb"},
+		},
+		{
+			name:        "profile not found",
+			annotations: map[string]string{lbProfile: "other"},
+			expected:    map[string]string{lbProfile: "other"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "svc1",
+					Namespace:   "myns",
+					Labels:      tt.labels,
+					Annotations: tt.annotations,
+				},
+			}
+			result := cs.withProfile(svc)
+			assert.Equal(t, tt.expected, result.Annotations)
+			assert.Equal(t, tt.annotations, svc.Annotations)
+		})
+	}
+	waitAnyEvent(t, `reason: 'LoadBalancerProfileNotFound' Load balancer profile "other" not found`)
+}
+
+func Test_CSCloud_profiles(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+			},
+		},
+	}, nil)
+	handler := cs.handleProfiles(func() bool { return true }).(cache.ResourceEventHandlerFuncs)
+	handler.OnAdd(newTestProfile("web", map[string]interface{}{
+		lbNameSuffix:              "custom.com",
+		removeLBsOnDeleteLabelKey: "true",
+	}))
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+		},
+	}
+	newService := func(name string, annotations map[string]string) *corev1.Service {
+		svc := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "myns",
+				Labels: map[string]string{
+					"environment-label": "env1",
+				},
+				Annotations: annotations,
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+		require.NoError(t, err)
+		return svc
+	}
+	svc1 := newService("svc1", map[string]string{lbProfile: "web"})
+	svc2 := newService("svc2", map[string]string{lbProfile: "web", lbNameSuffix: "other.com"})
+	newService("svc3", nil)
+
+	assert.Equal(t, "svc1.custom.com", cs.GetLoadBalancerName(context.Background(), "kubernetes", svc1))
+	assert.Equal(t, "svc2.other.com", cs.GetLoadBalancerName(context.Background(), "kubernetes", svc2))
+
+	cs.updateLBQueue.start(context.Background())
+	lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc1.DeepCopy(), []*corev1.Node{node})
+	cs.updateLBQueue.stopWait()
+	require.NoError(t, err)
+	assert.Equal(t, "svc1.custom.com", lbStatus.Ingress[0].Hostname)
+
+	handler.OnUpdate(nil, newTestProfile("web", map[string]interface{}{
+		lbNameSuffix:              "custom.com",
+		removeLBsOnDeleteLabelKey: "false",
+	}))
+	cs.updateLBQueue.Lock()
+	assert.Len(t, cs.updateLBQueue.queue, 2)
+	for _, name := range []string{"svc1", "svc2"} {
+		entry, ok := cs.updateLBQueue.queue[serviceKey{namespace: "myns", name: name}]
+		require.True(t, ok, name)
+		assert.True(t, entry.updatePool)
+		assert.Equal(t, "false", entry.service.Annotations[removeLBsOnDeleteLabelKey])
+	}
+	cs.updateLBQueue.queue = map[serviceKey]queueEntry{}
+	cs.updateLBQueue.Unlock()
+
+	handler.OnDelete(cache.DeletedFinalStateUnknown{Obj: newTestProfile("web", nil)})
+	_, ok := cs.profiles.get("web")
+	assert.False(t, ok)
+	assert.Equal(t, "svc1.test.com", cs.GetLoadBalancerName(context.Background(), "kubernetes", svc1))
+}
+
+func Test_CSCloud_profilesSynced(t *testing.T) {
+	cs := newTestCSCloud(t, &CSConfig{Global: globalConfig{LBProfiles: true}}, nil)
+	withProfile := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "svc1",
+			Namespace:   "myns",
+			Annotations: map[string]string{lbProfile: "web"},
+		},
+	}
+	withoutProfile := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc2",
+			Namespace: "myns",
+		},
+	}
+	assert.EqualError(t, cs.profilesSynced(withProfile), `load balancer profiles not synced yet, unable to handle service myns/svc1 using profile "web"`)
+	_, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", withProfile, nil)
+	assert.EqualError(t, err, `load balancer profiles not synced yet, unable to handle service myns/svc1 using profile "web"`)
+	assert.Error(t, cs.UpdateLoadBalancer(context.Background(), "kubernetes", withProfile, nil))
+	assert.Error(t, cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", withProfile))
+	assert.NoError(t, cs.profilesSynced(withoutProfile))
+
+	cs.profiles.markSynced()
+	assert.NoError(t, cs.profilesSynced(withProfile))
+}
@@ -0,0 +1,130 @@
+package cloudstack
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// lbProxyProtocol enables the PROXY protocol on the load balancer pools
+	// so that backends receive the client address, accepted values are "v1"
+	// and "v2".
+	lbProxyProtocol = "csccm.cloudprovider.io/loadbalancer-proxy-protocol"
+
+	// proxyProtocolTag records on the rule the PROXY protocol version last
+	// applied, allowing it to be disabled once the annotation is removed.
+	proxyProtocolTag = "kubernetes_proxy_protocol"
+
+	proxyProtocolV1   = "v1"
+	proxyProtocolV2   = "v2"
+	proxyProtocolNone = "none"
+)
+
+// poolSettings indicates which pool settings are managed for a service.
+type poolSettings struct {
+	healthCheck   bool
+	proxyProtocol bool
+	// proxyProtocolVersion is the wanted PROXY protocol version, empty when
+	// disabled.
+	proxyProtocolVersion string
+	// params indicates the service sets per port pool parameters.
+	params bool
+	// explicitHealthCheck indicates the service sets per port health check
+	// annotations.
+	explicitHealthCheck bool
+}
+
+// proxyProtocolForService returns the PROXY protocol version requested by the
+// service, empty if it is not enabled.
+func proxyProtocolForService(service *v1.Service) (string, error) {
+	value, _ := getLabelOrAnnotation(service.ObjectMeta, lbProxyProtocol)
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case "", proxyProtocolV1, proxyProtocolV2:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid value for %q: %q, expected %q or %q", lbProxyProtocol, value, proxyProtocolV1, proxyProtocolV2)
+}
+
+// appliedProxyProtocol returns the PROXY protocol version last applied to the
+// load balancer rule.
+func (lb *loadBalancer) appliedProxyProtocol() string {
+	value, _ := getTag(lb.rule.Tags, proxyProtocolTag)
+	return value
+}
+
+// proxyProtocolParam returns the value of the proxyprotocol param for the
+// version, disabling it for empty versions.
+func proxyProtocolParam(version string) string {
+	if version == "" {
+		return proxyProtocolNone
+	}
+	return version
+}
+
+// normalizeProxyProtocol converts the PROXY protocol reported by pools into a
+// version, empty when disabled.
+func normalizeProxyProtocol(value string) string {
+	value = strings.ToLower(value)
+	if value == proxyProtocolNone {
+		return ""
+	}
+	return value
+}
+
+// setProxyProtocol enables or disables the PROXY protocol using the
+// set-proxy-protocol custom command, used by backends not managing pools
+// through GloboNetwork.
+func (lb *loadBalancer) setProxyProtocol(version string) error {
+	command := lb.cloud.config.Command.SetProxyProtocol
+	if version == lb.appliedProxyProtocol() {
+		return nil
+	}
+	client, err := lb.getClient()
+	if err != nil {
+		return err
+	}
+	klog.V(4).Infof("Setting PROXY protocol %q on %v using cmd %q", proxyProtocolParam(version), lb, command)
+	p := &cloudstack.CustomServiceParams{}
+	if lb.cloud.projectID != "" {
+		p.SetParam("projectid", lb.cloud.projectID)
+	}
+	p.SetParam("id", lb.rule.Id)
+	p.SetParam("proxyprotocol", proxyProtocolParam(version))
+	if err = lb.applyCommandArgs(command, p); err != nil {
+		return err
+	}
+	var result struct {
+		JobID string `json:"jobid"`
+	}
+	if err = client.Custom.CustomRequest(command, p, &result); err != nil {
+		return fmt.Errorf("error setting PROXY protocol of %v using cmd %q: %v", lb, command, err)
+	}
+	if result.JobID != "" {
+		if err = waitJob(client, result.JobID, nil); err != nil {
+			return fmt.Errorf("error waiting for PROXY protocol update of %v: %v", lb, err)
+		}
+	}
+	return lb.recordProxyProtocol(version)
+}
+
+// recordProxyProtocol tags the rule with the applied PROXY protocol version.
+func (lb *loadBalancer) recordProxyProtocol(version string) error {
+	if version == lb.appliedProxyProtocol() {
+		return nil
+	}
+	var err error
+	if version == "" {
+		err = lb.cloud.deleteResourceTags(CloudstackResourceLoadBalancer, lb.rule.Id, []string{proxyProtocolTag})
+	} else {
+		err = lb.cloud.setResourceTags(CloudstackResourceLoadBalancer, lb.rule.Id, map[string]string{proxyProtocolTag: version})
+	}
+	if err != nil {
+		return fmt.Errorf("error recording PROXY protocol of %v: %v", lb, err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package cloudstack
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_proxyProtocolForService(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+		err      string
+	}{
+		{value: "", expected: ""},
+		{value: "v1", expected: "v1"},
+		{value: "V2", expected: "v2"},
+		{value: "v3", err: `invalid value for "csccm.cloudprovider.io/loadbalancer-proxy-protocol": "v3", expected "v1" or "v2"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+			if tt.value != "" {
+				svc.Annotations["csccm.cloudprovider.io/loadbalancer-proxy-protocol"] = tt.value
+			}
+			version, err := proxyProtocolForService(svc)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, version)
+		})
+	}
+}
+
+func Test_CSCloud_proxyProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		enable  []cloudstackFake.MockAPICall
+		disable []cloudstackFake.MockAPICall
+	}{
+		{
+			name: "globonetwork pools",
+			enable: []cloudstackFake.MockAPICall{
+				{Command: "listGloboNetworkPools"},
+				{Command: "updateGloboNetworkPool", Params: url.Values{"proxyprotocol": []string{"v2"}, "healthchecktype": []string{"TCP"}}},
+				{Command: "queryAsyncJobResult"},
+				{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_proxy_protocol"}, "tags[0].value": []string{"v2"}}},
+				{Command: "queryAsyncJobResult"},
+			},
+			disable: []cloudstackFake.MockAPICall{
+				{Command: "listGloboNetworkPools"},
+				{Command: "updateGloboNetworkPool", Params: url.Values{"proxyprotocol": []string{"none"}}},
+				{Command: "queryAsyncJobResult"},
+				{Command: "deleteTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_proxy_protocol"}}},
+				{Command: "queryAsyncJobResult"},
+			},
+		},
+		{
+			name:    "custom command",
+			command: "setProxyProtocol",
+			enable: []cloudstackFake.MockAPICall{
+				{Command: "setProxyProtocol", Params: url.Values{"id": []string{"lbrule-1"}, "proxyprotocol": []string{"v2"}, "backend": []string{"haproxy"}}},
+				{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_proxy_protocol"}, "tags[0].value": []string{"v2"}}},
+				{Command: "queryAsyncJobResult"},
+			},
+			disable: []cloudstackFake.MockAPICall{
+				{Command: "setProxyProtocol", Params: url.Values{"id": []string{"lbrule-1"}, "proxyprotocol": []string{"none"}}},
+				{Command: "deleteTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_proxy_protocol"}}},
+				{Command: "queryAsyncJobResult"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := cloudstackFake.NewCloudstackServer()
+			defer srv.Close()
+			srv.Hook = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.FormValue("command") != "setProxyProtocol" {
+					return false
+				}
+				w.Write(cloudstackFake.MarshalResponse("setProxyProtocolResponse", map[string]interface{}{}))
+				return true
+			}
+			argsCfg, err := readConfig(strings.NewReader(`
+[custom-command-args "setProxyProtocol"]
+backend = haproxy
+`))
+			require.NoError(t, err)
+			cs := newTestCSCloud(t, &CSConfig{
+				Global: globalConfig{
+					EnvironmentLabel: "environment-label",
+					ProjectIDLabel:   "my/project-label",
+				},
+				Command: commandConfig{
+					SetProxyProtocol: tt.command,
+				},
+				CommandArgs: argsCfg.CommandArgs,
+				Environment: map[string]*environmentConfig{
+					"env1": {
+						APIURL:          srv.URL,
+						APIKey:          "a",
+						SecretKey:       "b",
+						LBEnvironmentID: "1",
+						LBDomain:        "test.com",
+					},
+				},
+			}, nil)
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "n1",
+					Labels: map[string]string{
+						"my/project-label":  "11111111-2222-3333-4444-555555555555",
+						"environment-label": "env1",
+					},
+				},
+			}
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "svc1",
+					Namespace: "myns",
+					Labels: map[string]string{
+						"environment-label": "env1",
+					},
+					Annotations: map[string]string{
+						"csccm.cloudprovider.io/loadbalancer-proxy-protocol": "v2",
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			}
+			_, err = cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+			require.NoError(t, err)
+
+			// poolCalls returns the calls made after the members were assigned.
+			poolCalls := func() []cloudstackFake.MockAPICall {
+				for i, call := range srv.Calls {
+					if call.Command == "listLoadBalancerRuleInstances" {
+						calls := srv.Calls[i+1:]
+						for len(calls) > 0 && (calls[0].Command == "assignToLoadBalancerRule" || calls[0].Command == "queryAsyncJobResult") {
+							calls = calls[1:]
+						}
+						return calls
+					}
+				}
+				return nil
+			}
+			ensure := func(svc *corev1.Service) {
+				srv.Calls = nil
+				cs.updateLBQueue.start(context.Background())
+				_, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*corev1.Node{node})
+				cs.updateLBQueue.stopWait()
+				require.NoError(t, err)
+				srv.Calls = poolCalls()
+			}
+
+			ensure(svc.DeepCopy())
+			srv.HasCalls(t, tt.enable)
+
+			ensure(svc.DeepCopy())
+			if tt.command == "" {
+				srv.HasCalls(t, []cloudstackFake.MockAPICall{{Command: "listGloboNetworkPools"}})
+			} else {
+				srv.HasCalls(t, nil)
+			}
+
+			delete(svc.Annotations, "csccm.cloudprovider.io/loadbalancer-proxy-protocol")
+			ensure(svc.DeepCopy())
+			srv.HasCalls(t, tt.disable)
+
+			ensure(svc.DeepCopy())
+			srv.HasCalls(t, nil)
+		})
+	}
+}
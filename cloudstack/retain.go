@@ -0,0 +1,177 @@
+package cloudstack
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	retainedForTag = "kubernetes_retained_for"
+	retainedAtTag  = "kubernetes_retained_at"
+
+	defaultRetainedIPTTL = 24 * time.Hour
+
+	maxRetainedIPSweepInterval = 5 * time.Minute
+
+	// allProjectsID is used by CloudStack list commands to list resources
+	// in every project.
+	allProjectsID = "-1"
+)
+
+// shouldRetainIP indicates whether the service asks for its IP to be kept
+// after the service is deleted.
+func shouldRetainIP(service *v1.Service) bool {
+	value, ok := getLabelOrAnnotation(service.ObjectMeta, lbRetainIP)
+	if !ok {
+		return false
+	}
+	retain, err := strconv.ParseBool(value)
+	if err != nil {
+		klog.Errorf("Ignoring invalid %s %q for service %s/%s", lbRetainIP, value, service.Namespace, service.Name)
+		return false
+	}
+	return retain
+}
+
+// retainIPIfManaged keeps the IP address tagged for the service, marking it as
+// retained so that it is reused if the service is created again or released
+// after the retained IP TTL.
+func (pc *projectCloud) retainIPIfManaged(ip cloudstackIP, service *v1.Service) error {
+	publicIP, err := pc.getPublicIPAddressByID(ip.id)
+	if err != nil {
+		return err
+	}
+	if !shouldManageIP(*publicIP, service) {
+		return nil
+	}
+	return pc.setResourceTags(CloudstackResourceIPAdress, ip.id, map[string]string{
+		retainedForTag: service.Namespace + "/" + service.Name,
+		retainedAtTag:  time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// reclaimRetainedIP removes the retained mark from an IP reused by its
+// service.
+func (pc *projectCloud) reclaimRetainedIP(ip *cloudstackIP) error {
+	klog.V(3).Infof("Reclaiming retained IP %s", ip)
+	err := pc.deleteResourceTags(CloudstackResourceIPAdress, ip.id, []string{retainedForTag, retainedAtTag})
+	if err != nil {
+		return err
+	}
+	ip.retained = false
+	return nil
+}
+
+// releaseExpiredRetainedIPs releases retained IPs whose TTL has elapsed and
+// whose service was not created again.
+func (pc *projectCloud) releaseExpiredRetainedIPs(now time.Time) error {
+	client, err := pc.getClient()
+	if err != nil {
+		return err
+	}
+	p := client.Resourcetags.NewListTagsParams()
+	p.SetResourcetype(CloudstackResourceIPAdress)
+	p.SetKey(retainedAtTag)
+	p.SetListall(true)
+	p.SetProjectid(allProjectsID)
+	tagsResponse, err := client.Resourcetags.ListTags(p)
+	if err != nil {
+		return fmt.Errorf("error listing retained IPs: %v", err)
+	}
+	for _, tag := range tagsResponse.Tags {
+		retainedAt, err := time.Parse(time.RFC3339, tag.Value)
+		if err != nil {
+			klog.Errorf("Ignoring retained IP %s with invalid %s tag %q", tag.Resourceid, retainedAtTag, tag.Value)
+			continue
+		}
+		if now.Sub(retainedAt) < pc.retainedIPTTL {
+			continue
+		}
+		ipCloud := &projectCloud{CSCloud: pc.CSCloud, environment: pc.environment, projectID: tag.Projectid}
+		err = ipCloud.releaseRetainedIP(tag.Resourceid)
+		if err != nil {
+			klog.Errorf("Unable to release retained IP %s: %v", tag.Resourceid, err)
+		}
+	}
+	return nil
+}
+
+func (pc *projectCloud) releaseRetainedIP(ipID string) error {
+	publicIP, err := pc.getPublicIPAddressByID(ipID)
+	if err != nil {
+		return err
+	}
+	if !isRetainedIP(publicIP.Tags) {
+		return nil
+	}
+	retainedFor, _ := getTag(publicIP.Tags, retainedForTag)
+	parts := strings.SplitN(retainedFor, "/", 2)
+	if len(parts) == 2 {
+		_, err = pc.kubeClient.CoreV1().Services(parts[0]).Get(parts[1], metav1.GetOptions{})
+		if err == nil {
+			klog.V(3).Infof("Skipping release of retained IP %s, service %s exists", publicIP.Ipaddress, retainedFor)
+			return nil
+		}
+		if !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	ip := cloudstackIP{
+		id:        publicIP.Id,
+		address:   publicIP.Ipaddress,
+		networkid: publicIP.Networkid,
+	}
+	klog.V(3).Infof("Releasing IP %s retained for %s after %v", ip, retainedFor, pc.retainedIPTTL)
+	err = pc.deleteResourceTags(CloudstackResourceIPAdress, ip.id, []string{retainedForTag, retainedAtTag})
+	if err != nil {
+		return err
+	}
+	return pc.releaseOrReturnIP(ip, publicIP.Tags, nil)
+}
+
+func isRetainedIP(tags []cloudstack.Tags) bool {
+	if value, _ := getTag(tags, cloudProviderTag); value != ProviderName {
+		return false
+	}
+	_, ok := getTag(tags, retainedAtTag)
+	return ok
+}
+
+// releaseRetainedIPs periodically releases expired retained IPs in every
+// environment until the context is done.
+func (cs *CSCloud) releaseRetainedIPs(ctx context.Context) {
+	var envNames []string
+	for name := range cs.environments {
+		envNames = append(envNames, name)
+	}
+	sort.Strings(envNames)
+	interval := cs.retainedIPTTL
+	if interval > maxRetainedIPSweepInterval {
+		interval = maxRetainedIPSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, name := range envNames {
+			pc := &projectCloud{CSCloud: cs, environment: name}
+			if err := pc.releaseExpiredRetainedIPs(time.Now()); err != nil {
+				klog.Errorf("Unable to release retained IPs for environment %q: %v", name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package cloudstack
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_CSCloud_retainIPOnDelete(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+			RetainedIPTTL:    "1h",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				RemoveLBs:       true,
+			},
+		},
+	}, nil)
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{
+				"csccm.cloudprovider.io/loadbalancer-retain-ip": "true",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	ensure := func() *corev1.LoadBalancerStatus {
+		cs.updateLBQueue.start(context.Background())
+		lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), []*corev1.Node{node})
+		cs.updateLBQueue.stopWait()
+		require.NoError(t, err)
+		return lbStatus
+	}
+	commands := func() []string {
+		var cmds []string
+		for _, call := range srv.Calls {
+			cmds = append(cmds, call.Command)
+		}
+		return cmds
+	}
+	ipTags := func() map[string]string {
+		pc := &projectCloud{CSCloud: cs, environment: "env1"}
+		publicIP, err := pc.getPublicIPAddressByID("ip-1")
+		require.NoError(t, err)
+		tags := map[string]string{}
+		for _, tag := range publicIP.Tags {
+			tags[tag.Key] = tag.Value
+		}
+		return tags
+	}
+
+	lbStatus := ensure()
+	assert.Equal(t, "10.0.0.1", lbStatus.Ingress[0].IP)
+
+	srv.Calls = nil
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc)
+	require.NoError(t, err)
+	assert.Contains(t, commands(), "deleteLoadBalancerRule")
+	assert.NotContains(t, commands(), "disassociateIpAddress")
+	tags := ipTags()
+	assert.Equal(t, "myns/svc1", tags["kubernetes_retained_for"])
+	assert.Equal(t, "svc1", tags["kubernetes_service"])
+	retainedAt, err := time.Parse(time.RFC3339, tags["kubernetes_retained_at"])
+	require.NoError(t, err)
+
+	// Service is created again and reuses the retained IP.
+	srv.Calls = nil
+	lbStatus = ensure()
+	assert.Equal(t, "10.0.0.1", lbStatus.Ingress[0].IP)
+	assert.NotContains(t, commands(), "associateIpAddress")
+	tags = ipTags()
+	assert.NotContains(t, tags, "kubernetes_retained_for")
+	assert.NotContains(t, tags, "kubernetes_retained_at")
+
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc)
+	require.NoError(t, err)
+	assert.Contains(t, ipTags(), "kubernetes_retained_at")
+
+	pc := &projectCloud{CSCloud: cs, environment: "env1"}
+
+	// TTL not elapsed.
+	srv.Calls = nil
+	err = pc.releaseExpiredRetainedIPs(retainedAt.Add(30 * time.Minute))
+	require.NoError(t, err)
+	assert.NotContains(t, commands(), "disassociateIpAddress")
+
+	// TTL elapsed but service still exists.
+	err = pc.releaseExpiredRetainedIPs(retainedAt.Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.NotContains(t, commands(), "disassociateIpAddress")
+
+	err = cs.kubeClient.CoreV1().Services(svc.Namespace).Delete(svc.Name, &metav1.DeleteOptions{})
+	require.NoError(t, err)
+	err = pc.releaseExpiredRetainedIPs(retainedAt.Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Contains(t, commands(), "disassociateIpAddress")
+	_, err = pc.getPublicIPAddressByID("ip-1")
+	assert.EqualError(t, err, "could not find IP ID ip-1")
+}
+
+func Test_isRetainedIP(t *testing.T) {
+	tests := []struct {
+		tags     []cloudstack.Tags
+		expected bool
+	}{
+		{tags: nil, expected: false},
+		{tags: []cloudstack.Tags{{Key: "kubernetes_retained_at", Value: "2020-01-01T00:00:00Z"}}, expected: false},
+		{tags: []cloudstack.Tags{
+			{Key: "cloudprovider", Value: "custom-cloudstack"},
+			{Key: "kubernetes_retained_at", Value: "2020-01-01T00:00:00Z"},
+		}, expected: true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, isRetainedIP(tt.tags))
+	}
+}
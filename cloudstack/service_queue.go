@@ -22,6 +22,11 @@ const (
 
 	eventReasonUpdateFailed  = "QueuedUpdateLoadBalancerFailed"
 	eventReasonUpdateSuccess = "QueuedUpdatedLoadBalancer"
+
+	eventReasonVIPNotSupported = "LoadBalancerVIPNotSupported"
+	eventReasonNoNodesMatched  = "LoadBalancerNoNodesMatched"
+	eventReasonZoneFallback    = "LoadBalancerZoneFallback"
+	eventReasonTiersNotServed  = "LoadBalancerTiersNotServed"
 )
 
 var (
@@ -102,7 +107,21 @@ func (q *updateLBNodeQueue) pushWithBackoff(entry queueEntry) (time.Duration, er
 	return backoff, q.push(entry)
 }
 
+func (q *updateLBNodeQueue) pushAfter(entry queueEntry, delay time.Duration) error {
+	entry.backoffUntil = time.Now().Add(delay)
+	entry.lb = nil
+	return q.push(entry)
+}
+
 func (q *updateLBNodeQueue) push(entry queueEntry) error {
+	// Simply validate that there are nodes available, we'll fetch them
+	// directly from the registry when running the task. It is done before
+	// locking the queue as it may record events.
+	_, err := q.cs.nodeRegistry.nodesForService(entry.service)
+	if err != nil {
+		return err
+	}
+
 	q.Lock()
 	defer q.Unlock()
 
@@ -115,13 +134,6 @@ func (q *updateLBNodeQueue) push(entry queueEntry) error {
 		return nil
 	}
 
-	// Simply validate that there are nodes available, we'll fetch them
-	// directly from the registry when running the task.
-	_, err := q.cs.nodeRegistry.nodesForService(entry.service)
-	if err != nil {
-		return err
-	}
-
 	if q.queue == nil {
 		q.queue = map[serviceKey]queueEntry{}
 	}
@@ -219,6 +231,13 @@ func (q *updateLBNodeQueue) start(ctx context.Context) {
 				err = q.processQueueEntry(item)
 				processedTotal.WithLabelValues(item.service.Namespace, item.service.Name).Inc()
 				processedDuration.WithLabelValues(item.service.Namespace, item.service.Name).Set(time.Since(item.start).Seconds())
+				if drainErr, ok := err.(DrainPendingError); ok {
+					klog.V(4).Infof("Requeueing service %v/%v: %v", item.service.Namespace, item.service.Name, drainErr)
+					if pushErr := q.pushAfter(item, drainErr.remaining); pushErr != nil {
+						klog.Errorf("unable to requeue service %v/%v after drain: %v", item.service.Namespace, item.service.Name, pushErr)
+					}
+					continue
+				}
 				if err != nil {
 					failuresTotal.WithLabelValues(item.service.Namespace, item.service.Name).Inc()
 
@@ -252,7 +271,8 @@ func (q *updateLBNodeQueue) processQueueEntry(entry queueEntry) error {
 
 	klog.V(4).Infof("Processing lb update for service %v/%v with nodes %v", entry.service.Namespace, entry.service.Name, nodeInfoNames(nodes))
 
-	hostIDs, networkIDs, projectID := idsForNodes(nodes)
+	_, networkIDs, projectID := idsForNodes(nodes)
+	weights := weightsForNodes(nodes)
 
 	lb := entry.lb
 	if lb == nil {
@@ -273,19 +293,79 @@ func (q *updateLBNodeQueue) processQueueEntry(entry queueEntry) error {
 		}
 	}
 
-	err = lb.syncNodes(hostIDs, networkIDs)
-	if err != nil {
-		return err
-	}
+	var drainErr error
+	var changedLBs []webhookLoadBalancer
+	defer func() {
+		if len(changedLBs) > 0 {
+			q.cs.webhooks.notify(entry.service, webhookEventMembersChanged, changedLBs)
+		}
+	}()
+	// The zone of the public IP may require API calls, it is resolved
+	// here instead of in nodesForService which is called with the queue
+	// locked.
+	nodes = lb.topologyNodes(nodes)
+	for _, l := range lb.withVIPs() {
+		l.recordZones(nodes)
+
+		hostIDs, networkIDs, err := l.tierMembers(nodes)
+		if err != nil {
+			return err
+		}
 
-	if entry.updatePool {
-		err = lb.updateLoadBalancerPool()
+		changed, err := l.syncNodes(hostIDs, networkIDs, weights)
+		if changed {
+			changedLB := l.webhookLoadBalancer()
+			changedLB.Members = hostIDs
+			changedLBs = append(changedLBs, changedLB)
+		}
+		if err != nil {
+			pendingErr, ok := err.(DrainPendingError)
+			if !ok {
+				return err
+			}
+			if drainErr == nil || pendingErr.remaining < drainErr.(DrainPendingError).remaining {
+				drainErr = pendingErr
+			}
+		}
+
+		err = l.syncWeights(hostIDs, weights)
 		if err != nil {
 			return err
 		}
+
+		if entry.updatePool {
+			err = l.updateLoadBalancerPool()
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	return nil
+	return drainErr
+}
+
+type warningKey struct {
+	serviceKey
+	reason string
+}
+
+// warnOnce records a warning event for a persistent condition of the
+// service, the event is only recorded again when the message changes.
+func (cs *CSCloud) warnOnce(svc *corev1.Service, reason, message string) {
+	key := warningKey{serviceKey: svcKey(svc), reason: reason}
+	if last, ok := cs.warnings.Load(key); ok && last.(string) == message {
+		return
+	}
+	cs.warnings.Store(key, message)
+	if cs.recorder != nil {
+		cs.recorder.Event(svc, corev1.EventTypeWarning, reason, message)
+	}
+}
+
+// clearWarning forgets the warning of the service so it is recorded again if
+// the condition returns.
+func (cs *CSCloud) clearWarning(svc *corev1.Service, reason string) {
+	cs.warnings.Delete(warningKey{serviceKey: svcKey(svc), reason: reason})
 }
 
 type sortableQueueEntries []queueEntryWithNodeRecent
@@ -0,0 +1,73 @@
+package cloudstack
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// lbTopologyZone limits the load balancer members to nodes in a
+	// CloudStack zone, identified by its ID or name. The special value
+	// "public-ip" uses the zone of the load balancer public IP.
+	lbTopologyZone = "csccm.cloudprovider.io/loadbalancer-topology-zone"
+
+	lbTopologyZonePublicIP = "public-ip"
+)
+
+func topologyZoneForService(svc *v1.Service) string {
+	value, _ := getLabelOrAnnotation(svc.ObjectMeta, lbTopologyZone)
+	return strings.TrimSpace(value)
+}
+
+// nodesInTopologyZone limits the nodes to the zone set in the service, the
+// zone of the public IP is only known once the load balancer is loaded and is
+// handled by topologyNodes.
+func (cs *CSCloud) nodesInTopologyZone(svc *v1.Service, nodes []nodeInfo) []nodeInfo {
+	zone := topologyZoneForService(svc)
+	if zone == "" || zone == lbTopologyZonePublicIP {
+		return nodes
+	}
+	return cs.preferNodesInZone(svc, nodes, zone)
+}
+
+// topologyNodes limits the nodes to the zone of the load balancer public IP
+// when requested by the service. The zone is retrieved once and kept in the
+// load balancer IP.
+func (lb *loadBalancer) topologyNodes(nodes []nodeInfo) []nodeInfo {
+	if topologyZoneForService(lb.service) != lbTopologyZonePublicIP || lb.internal || !lb.ip.isValid() {
+		return nodes
+	}
+	if lb.ip.zoneid == "" {
+		ip, err := lb.cloud.getPublicIPAddressByID(lb.ip.id)
+		if err != nil {
+			klog.Errorf("Unable to retrieve zone of IP %s for service %s/%s, using nodes in all zones: %v", lb.ip.address, lb.service.Namespace, lb.service.Name, err)
+			return nodes
+		}
+		lb.ip.zoneid = ip.Zoneid
+	}
+	if lb.ip.zoneid == "" {
+		return nodes
+	}
+	return lb.cloud.preferNodesInZone(lb.service, nodes, lb.ip.zoneid)
+}
+
+// preferNodesInZone returns the nodes in the zone, falling back to all nodes
+// if none is available in the zone so that traffic is never blackholed.
+func (cs *CSCloud) preferNodesInZone(svc *v1.Service, nodes []nodeInfo, zone string) []nodeInfo {
+	var zoneNodes []nodeInfo
+	for _, n := range nodes {
+		if n.zoneID == zone || n.zoneName == zone {
+			zoneNodes = append(zoneNodes, n)
+		}
+	}
+	if len(zoneNodes) > 0 {
+		return zoneNodes
+	}
+	klog.V(2).Infof("No nodes in zone %q for service %s/%s, using nodes in all zones", zone, svc.Namespace, svc.Name)
+	if cs.recorder != nil {
+		cs.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonZoneFallback, "No nodes available in zone %q, using nodes in all zones", zone)
+	}
+	return nodes
+}
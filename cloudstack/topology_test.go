@@ -0,0 +1,93 @@
+package cloudstack
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_CSCloud_topologyZonePublicIP(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	srv.SetVMZone("n1", "zone1")
+	srv.SetVMZone("n2", "zone2")
+	srv.AddIP(cloudstack.PublicIpAddress{Id: "ip-9", Ipaddress: "10.0.0.9", Networkid: "net1", Zoneid: "zone2"})
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+			},
+		},
+	}, nil)
+
+	var nodes []*corev1.Node
+	for _, name := range []string{"n1", "n2"} {
+		nodes = append(nodes, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					"my/project-label":  "11111111-2222-3333-4444-555555555555",
+					"environment-label": "env1",
+				},
+			},
+		})
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{
+				lbTopologyZone: lbTopologyZonePublicIP,
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			LoadBalancerIP: "10.0.0.9",
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	members := func() []string {
+		var ids []string
+		for _, call := range srv.Calls {
+			if call.Command == "assignToLoadBalancerRule" || call.Command == "removeFromLoadBalancerRule" {
+				ids = append(ids, call.Command+":"+call.Params.Get("virtualmachineids"))
+			}
+		}
+		return ids
+	}
+
+	cs.updateLBQueue.start(context.Background())
+	_, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	cs.updateLBQueue.stopWait()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"assignToLoadBalancerRule:vm2"}, members())
+
+	srv.AddIP(cloudstack.PublicIpAddress{Id: "ip-9", Ipaddress: "10.0.0.9", Networkid: "net1", Zoneid: "zone1"})
+	srv.Calls = nil
+	cs.updateLBQueue.start(context.Background())
+	err = cs.UpdateLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	cs.updateLBQueue.stopWait()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"assignToLoadBalancerRule:vm1", "removeFromLoadBalancerRule:vm2"}, members())
+}
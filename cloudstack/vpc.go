@@ -0,0 +1,132 @@
+package cloudstack
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// networkVPC returns the VPC of the network or an empty string if the network
+// is not a VPC tier. Results are cached as networks never move between VPCs.
+func (pc *projectCloud) networkVPC(networkID string) (string, error) {
+	if vpcID, ok := pc.networkVPCs.Load(pc.environment + "/" + networkID); ok {
+		return vpcID.(string), nil
+	}
+	client, err := pc.getClient()
+	if err != nil {
+		return "", err
+	}
+	network, count, err := client.Network.GetNetworkByID(networkID, cloudstack.WithProject(pc.projectID))
+	if err != nil {
+		if count == 0 {
+			return "", fmt.Errorf("could not find network %v", networkID)
+		}
+		return "", fmt.Errorf("error retrieving network: %v", err)
+	}
+	pc.cacheNetworkVPC(networkID, network.Vpcid)
+	return network.Vpcid, nil
+}
+
+func (pc *projectCloud) cacheNetworkVPC(networkID, vpcID string) {
+	pc.networkVPCs.Store(pc.environment+"/"+networkID, vpcID)
+}
+
+// chooseVPCTier sets the main network of the load balancer to the tier with
+// most members in the VPC of the current main network, ties are broken by the
+// network ID. Networks which are not VPC tiers are left untouched.
+func (lb *loadBalancer) chooseVPCTier() error {
+	if lb.mainNetworkID == "" || len(lb.networkNodes) < 2 {
+		return nil
+	}
+	vpcID, err := lb.cloud.networkVPC(lb.mainNetworkID)
+	if err != nil || vpcID == "" {
+		return err
+	}
+	networkIDs := make([]string, 0, len(lb.networkNodes))
+	for networkID := range lb.networkNodes {
+		networkIDs = append(networkIDs, networkID)
+	}
+	sort.Strings(networkIDs)
+	best := lb.mainNetworkID
+	for _, networkID := range networkIDs {
+		if lb.networkNodes[networkID] <= lb.networkNodes[best] {
+			continue
+		}
+		tierVPCID, err := lb.cloud.networkVPC(networkID)
+		if err != nil {
+			return err
+		}
+		if tierVPCID == vpcID {
+			best = networkID
+		}
+	}
+	lb.mainNetworkID = best
+	return nil
+}
+
+// tierMembers returns the hosts and networks of the nodes the load balancer
+// is able to serve. Rules on a VPC tier serve other tiers of the same VPC only
+// when the assign networks command is configured, nodes in the remaining tiers
+// are left out and reported in a warning event as retrying cannot serve them.
+func (lb *loadBalancer) tierMembers(nodes []nodeInfo) (hostIDs, networkIDs []string, err error) {
+	ruleNetworkID := lb.mainNetworkID
+	if lb.rule != nil && lb.rule.Networkid != "" {
+		ruleNetworkID = lb.rule.Networkid
+	}
+
+	hostIDs, networkIDs, _ = idsForNodes(nodes)
+	if ruleNetworkID == "" || (len(networkIDs) == 1 && networkIDs[0] == ruleNetworkID) || len(networkIDs) == 0 {
+		return hostIDs, networkIDs, nil
+	}
+
+	ruleVPCID, err := lb.cloud.networkVPC(ruleNetworkID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ruleVPCID == "" {
+		return hostIDs, networkIDs, nil
+	}
+
+	canExtend := !lb.internal && lb.cloud.config.Command.AssignNetworks != ""
+	unserved := sets.String{}
+	for _, networkID := range networkIDs {
+		if networkID == ruleNetworkID {
+			continue
+		}
+		if !canExtend {
+			unserved.Insert(networkID)
+			continue
+		}
+		vpcID, err := lb.cloud.networkVPC(networkID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if vpcID != ruleVPCID {
+			unserved.Insert(networkID)
+		}
+	}
+	if unserved.Len() == 0 {
+		lb.cloud.clearWarning(lb.service, eventReasonTiersNotServed)
+		return hostIDs, networkIDs, nil
+	}
+
+	var reason string
+	if canExtend {
+		reason = fmt.Sprintf("tiers are not part of VPC %s", ruleVPCID)
+	} else {
+		reason = "rules on VPC tiers cannot span tiers without the assign-networks command"
+	}
+	lb.cloud.warnOnce(lb.service, eventReasonTiersNotServed, fmt.Sprintf("Load balancer %s on tier %s cannot serve nodes in tiers %s: %s", lb.name, ruleNetworkID, strings.Join(unserved.List(), ", "), reason))
+
+	var served []nodeInfo
+	for _, n := range nodes {
+		if !unserved.Has(n.networkID) {
+			served = append(served, n)
+		}
+	}
+	hostIDs, networkIDs, _ = idsForNodes(served)
+	return hostIDs, networkIDs, nil
+}
@@ -0,0 +1,256 @@
+package cloudstack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_CSCloud_vpcTiers(t *testing.T) {
+	networkVPCs := map[string]string{
+		"net1": "vpc1",
+		"net2": "vpc1",
+		"net3": "vpc2",
+	}
+	tests := []struct {
+		name           string
+		assignNetworks string
+		expectedVMs    []string
+		expectedEvent  string
+	}{
+		{
+			name:           "assign networks extends the rule to tiers in the same vpc",
+			assignNetworks: "assignNetworkToLBRule",
+			expectedVMs:    []string{"vm1", "vm2"},
+			expectedEvent:  "on tier net1 cannot serve nodes in tiers net3: tiers are not part of VPC vpc1",
+		},
+		{
+			name:          "without assign networks only the rule tier is served",
+			expectedVMs:   []string{"vm1"},
+			expectedEvent: "on tier net1 cannot serve nodes in tiers net2, net3: rules on VPC tiers cannot span tiers without the assign-networks command",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := cloudstackFake.NewCloudstackServer()
+			defer srv.Close()
+			srv.Hook = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.FormValue("command") != "listNetworks" {
+					return false
+				}
+				id := r.FormValue("id")
+				w.Write([]byte(fmt.Sprintf(`{"listNetworksResponse": {"count": 1, "network": [{"id": %q, "vpcid": %q}]}}`, id, networkVPCs[id])))
+				return true
+			}
+			cs := newTestCSCloud(t, &CSConfig{
+				Global: globalConfig{
+					EnvironmentLabel: "environment-label",
+					ProjectIDLabel:   "my/project-label",
+				},
+				Command: commandConfig{
+					AssignNetworks: tt.assignNetworks,
+				},
+				Environment: map[string]*environmentConfig{
+					"env1": {
+						APIURL:          srv.URL,
+						APIKey:          "a",
+						SecretKey:       "b",
+						LBEnvironmentID: "1",
+						LBDomain:        "test.com",
+					},
+				},
+			}, nil)
+
+			var nodes []*corev1.Node
+			for _, name := range []string{"n1", "n2", "n3"} {
+				nodes = append(nodes, &corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: name,
+						Labels: map[string]string{
+							"my/project-label":  "11111111-2222-3333-4444-555555555555",
+							"environment-label": "env1",
+						},
+					},
+				})
+			}
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "svc1",
+					Namespace: "myns",
+					Labels: map[string]string{
+						"environment-label": "env1",
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			}
+			_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+			require.NoError(t, err)
+
+			cs.updateLBQueue.start(context.Background())
+			_, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+			require.NoError(t, err)
+			// Tiers that cannot be served are not retried.
+			waitEvent(t, "Updated load balancer with new hosts")
+			waitAnyEvent(t, tt.expectedEvent)
+			err = cs.UpdateLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+			require.NoError(t, err)
+			cs.updateLBQueue.stopWait()
+			time.Sleep(200 * time.Millisecond)
+			var tierEvents int
+			globalTestEvents.Lock()
+			for _, evt := range globalTestEvents.events {
+				if strings.Contains(evt, tt.expectedEvent) {
+					tierEvents++
+				}
+			}
+			globalTestEvents.Unlock()
+			assert.Equal(t, 1, tierEvents)
+
+			var assigned []string
+			for _, call := range srv.Calls {
+				switch call.Command {
+				case "createLoadBalancerRule":
+					assert.Equal(t, "net1", call.Params.Get("networkid"))
+				case "assignToLoadBalancerRule":
+					assigned = append(assigned, strings.Split(call.Params.Get("virtualmachineids"), ",")...)
+				}
+			}
+			assert.ElementsMatch(t, tt.expectedVMs, assigned)
+		})
+	}
+}
+
+func Test_idsForNodes(t *testing.T) {
+	nodes := []nodeInfo{
+		{vmID: "vm1", networkID: "net2", projectID: "p1"},
+		{vmID: "vm2", networkID: "net1", projectID: "p1"},
+		{vmID: "vm3", networkID: "net3", projectID: "p1"},
+		{vmID: "vm4", networkID: "net3", projectID: "p1"},
+	}
+	hostIDs, networkIDs, projectID := idsForNodes(nodes)
+	assert.Equal(t, []string{"vm1", "vm2", "vm3", "vm4"}, hostIDs)
+	assert.Equal(t, []string{"net1", "net2", "net3"}, networkIDs)
+	assert.Equal(t, "p1", projectID)
+}
+
+func Test_CSCloud_ruleNetwork(t *testing.T) {
+	nodeNetworks := map[string]string{
+		"n1": "net1",
+		"n2": "net2",
+		"n3": "net2",
+	}
+	tests := []struct {
+		name            string
+		networkVPCs     map[string]string
+		expectedNetwork string
+	}{
+		{
+			name:            "networks keep the first network in lexicographic order",
+			networkVPCs:     map[string]string{},
+			expectedNetwork: "net1",
+		},
+		{
+			name:            "vpc tiers use the tier with most nodes",
+			networkVPCs:     map[string]string{"net1": "vpc1", "net2": "vpc1"},
+			expectedNetwork: "net2",
+		},
+		{
+			name:            "vpc tiers ignore tiers in other vpcs",
+			networkVPCs:     map[string]string{"net1": "vpc1", "net2": "vpc2"},
+			expectedNetwork: "net1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := cloudstackFake.NewCloudstackServer()
+			defer srv.Close()
+			srv.Hook = func(w http.ResponseWriter, r *http.Request) bool {
+				switch r.FormValue("command") {
+				case "listNetworks":
+					id := r.FormValue("id")
+					w.Write([]byte(fmt.Sprintf(`{"listNetworksResponse": {"count": 1, "network": [{"id": %q, "vpcid": %q}]}}`, id, tt.networkVPCs[id])))
+					return true
+				case "listVirtualMachines":
+					name := r.FormValue("name")
+					w.Write([]byte(fmt.Sprintf(`{"listVirtualMachinesResponse": {"count": 1, "virtualmachine": [{"name": %q, "id": "vm-%s", "nic": [{"networkid": %q}]}]}}`, name, name, nodeNetworks[name])))
+					return true
+				}
+				return false
+			}
+			cs := newTestCSCloud(t, &CSConfig{
+				Global: globalConfig{
+					EnvironmentLabel: "environment-label",
+					ProjectIDLabel:   "my/project-label",
+				},
+				Command: commandConfig{
+					AssignNetworks: "assignNetworkToLBRule",
+				},
+				Environment: map[string]*environmentConfig{
+					"env1": {
+						APIURL:          srv.URL,
+						APIKey:          "a",
+						SecretKey:       "b",
+						LBEnvironmentID: "1",
+						LBDomain:        "test.com",
+					},
+				},
+			}, nil)
+
+			var nodes []*corev1.Node
+			for _, name := range []string{"n1", "n2", "n3"} {
+				nodes = append(nodes, &corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: name,
+						Labels: map[string]string{
+							"my/project-label":  "11111111-2222-3333-4444-555555555555",
+							"environment-label": "env1",
+						},
+					},
+				})
+			}
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "svc1",
+					Namespace: "myns",
+					Labels: map[string]string{
+						"environment-label": "env1",
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			}
+			_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+			require.NoError(t, err)
+
+			cs.updateLBQueue.start(context.Background())
+			_, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+			cs.updateLBQueue.stopWait()
+			require.NoError(t, err)
+
+			var created bool
+			for _, call := range srv.Calls {
+				if call.Command == "createLoadBalancerRule" {
+					created = true
+					assert.Equal(t, tt.expectedNetwork, call.Params.Get("networkid"))
+				}
+			}
+			assert.True(t, created)
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package cloudstack
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	webhookEventEnsured        = "loadbalancer.ensured"
+	webhookEventMembersChanged = "loadbalancer.members-changed"
+	webhookEventDeleted        = "loadbalancer.deleted"
+
+	webhookEventHeader     = "X-Csccm-Event"
+	webhookSignatureHeader = "X-Csccm-Signature"
+
+	defaultWebhookMaxAttempts = 5
+	// maxWebhookDeliveries limits the deliveries in flight, notifications
+	// are dropped once it is reached.
+	maxWebhookDeliveries = 100
+
+	promWebhookSubsystem = "webhook"
+)
+
+var (
+	webhookMinRetryDelay = time.Second
+	webhookMaxRetryDelay = time.Minute
+
+	webhookDeliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promWebhookSubsystem,
+		Name:      "deliveries_total",
+		Help:      "The number of webhook deliveries by result",
+	}, []string{"event", "result"})
+)
+
+// webhookEvent is the JSON payload posted to webhook endpoints.
+type webhookEvent struct {
+	Event         string                `json:"event"`
+	Timestamp     time.Time             `json:"timestamp"`
+	Service       webhookService        `json:"service"`
+	LoadBalancers []webhookLoadBalancer `json:"loadBalancers"`
+}
+
+type webhookService struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+}
+
+type webhookLoadBalancer struct {
+	Name        string   `json:"name"`
+	Hostname    string   `json:"hostname,omitempty"`
+	Environment string   `json:"environment"`
+	ProjectID   string   `json:"projectID,omitempty"`
+	VIP         string   `json:"vip,omitempty"`
+	IPAddress   string   `json:"ipAddress,omitempty"`
+	RuleID      string   `json:"ruleID,omitempty"`
+	Members     []string `json:"members,omitempty"`
+}
+
+// webhookNotifier posts load balancer lifecycle events to the configured
+// endpoints. Deliveries happen in the background and are retried with
+// exponential backoff.
+type webhookNotifier struct {
+	urls        []string
+	secret      []byte
+	maxAttempts int
+	client      *http.Client
+	inFlight    chan struct{}
+}
+
+func newWebhookNotifier(cfg globalConfig) (*webhookNotifier, error) {
+	var urls []string
+	for _, u := range strings.Split(cfg.WebhookURLs, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid url %q", u)
+		}
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	maxAttempts := cfg.WebhookMaxAttempts
+	if maxAttempts < 0 {
+		return nil, fmt.Errorf("invalid max attempts %d", maxAttempts)
+	}
+	if maxAttempts == 0 {
+		maxAttempts = defaultWebhookMaxAttempts
+	}
+	return &webhookNotifier{
+		urls:        urls,
+		secret:      []byte(cfg.WebhookSecret),
+		maxAttempts: maxAttempts,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		inFlight: make(chan struct{}, maxWebhookDeliveries),
+	}, nil
+}
+
+// notify sends the event to every endpoint without blocking the caller.
+func (n *webhookNotifier) notify(service *v1.Service, event string, lbs []webhookLoadBalancer) {
+	if n == nil {
+		return
+	}
+	payload, err := json.Marshal(webhookEvent{
+		Event:     event,
+		Timestamp: time.Now().UTC(),
+		Service: webhookService{
+			Namespace: service.Namespace,
+			Name:      service.Name,
+			UID:       string(service.UID),
+		},
+		LoadBalancers: lbs,
+	})
+	if err != nil {
+		klog.Errorf("Unable to encode webhook event %s for service %s/%s: %v", event, service.Namespace, service.Name, err)
+		return
+	}
+	for _, u := range n.urls {
+		select {
+		case n.inFlight <- struct{}{}:
+		default:
+			klog.Errorf("Dropping webhook event %s for service %s/%s to %s: too many deliveries in flight", event, service.Namespace, service.Name, u)
+			webhookDeliveriesTotal.WithLabelValues(event, "dropped").Inc()
+			continue
+		}
+		go func(u string) {
+			defer func() { <-n.inFlight }()
+			n.deliver(u, event, payload)
+		}(u)
+	}
+}
+
+func (n *webhookNotifier) deliver(u, event string, payload []byte) {
+	delay := webhookMinRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := n.post(u, event, payload)
+		if err == nil {
+			webhookDeliveriesTotal.WithLabelValues(event, "success").Inc()
+			return
+		}
+		if attempt >= n.maxAttempts {
+			klog.Errorf("Giving up webhook event %s to %s after %d attempts: %v", event, u, attempt, err)
+			webhookDeliveriesTotal.WithLabelValues(event, "failure").Inc()
+			return
+		}
+		klog.V(3).Infof("Error sending webhook event %s to %s - retry in %v: %v", event, u, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > webhookMaxRetryDelay {
+			delay = webhookMaxRetryDelay
+		}
+	}
+}
+
+func (n *webhookNotifier) post(u, event string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event)
+	if len(n.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookPayload(n.secret, payload))
+	}
+	rsp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	data, _ := ioutil.ReadAll(rsp.Body)
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("invalid status code: %d - %s", rsp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// signWebhookPayload returns the hex encoded HMAC-SHA256 of the payload.
+func signWebhookPayload(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookLoadBalancer returns the load balancer as reported to webhooks.
+func (lb *loadBalancer) webhookLoadBalancer() webhookLoadBalancer {
+	w := webhookLoadBalancer{
+		Name:        lb.name,
+		Hostname:    lb.hostname(),
+		Environment: lb.cloud.environment,
+		ProjectID:   lb.cloud.projectID,
+		VIP:         lb.vip,
+		IPAddress:   lb.ip.address,
+	}
+	if lb.rule != nil {
+		w.RuleID = lb.rule.Id
+	}
+	return w
+}
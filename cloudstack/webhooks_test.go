@@ -0,0 +1,179 @@
+package cloudstack
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_newWebhookNotifier(t *testing.T) {
+	tests := []struct {
+		cfg  globalConfig
+		urls []string
+		err  string
+	}{
+		{cfg: globalConfig{}},
+		{cfg: globalConfig{WebhookURLs: "http://a.com/hook, https://b.com"}, urls: []string{"http://a.com/hook", "https://b.com"}},
+		{cfg: globalConfig{WebhookURLs: "a.com"}, err: `invalid url "a.com"`},
+		{cfg: globalConfig{WebhookURLs: "http://a.com", WebhookMaxAttempts: -1}, err: "invalid max attempts -1"},
+	}
+	for _, tt := range tests {
+		n, err := newWebhookNotifier(tt.cfg)
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err)
+			continue
+		}
+		require.NoError(t, err)
+		if tt.urls == nil {
+			assert.Nil(t, n)
+			continue
+		}
+		assert.Equal(t, tt.urls, n.urls)
+		assert.Equal(t, defaultWebhookMaxAttempts, n.maxAttempts)
+	}
+}
+
+func Test_CSCloud_webhooks(t *testing.T) {
+	oldDelay := webhookMinRetryDelay
+	webhookMinRetryDelay = 10 * time.Millisecond
+	defer func() { webhookMinRetryDelay = oldDelay }()
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	events := make(chan webhookEvent, 10)
+	hookSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "sha256="+signWebhookPayload([]byte("s3cr3t"), data), r.Header.Get("X-Csccm-Signature"))
+		event := r.Header.Get("X-Csccm-Event")
+		mu.Lock()
+		attempts[event]++
+		failed := attempts[event] == 1
+		mu.Unlock()
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var evt webhookEvent
+		require.NoError(t, json.Unmarshal(data, &evt))
+		assert.Equal(t, event, evt.Event)
+		events <- evt
+	}))
+	defer hookSrv.Close()
+
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+			WebhookURLs:      hookSrv.URL,
+			WebhookSecret:    "s3cr3t",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+				RemoveLBs:       true,
+			},
+		},
+	}, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	waitEvents := func(n int) map[string]webhookEvent {
+		result := map[string]webhookEvent{}
+		for i := 0; i < n; i++ {
+			select {
+			case evt := <-events:
+				result[evt.Event] = evt
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for webhook events, got %v", result)
+			}
+		}
+		return result
+	}
+
+	cs.updateLBQueue.start(context.Background())
+	_, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), []*corev1.Node{node})
+	cs.updateLBQueue.stopWait()
+	require.NoError(t, err)
+
+	received := waitEvents(2)
+	lb := webhookLoadBalancer{
+		Name:        "svc1.test.com",
+		Hostname:    "svc1.test.com",
+		Environment: "env1",
+		ProjectID:   "11111111-2222-3333-4444-555555555555",
+		IPAddress:   "10.0.0.1",
+		RuleID:      "lbrule-1",
+	}
+	assert.Equal(t, webhookService{Namespace: "myns", Name: "svc1"}, received[webhookEventEnsured].Service)
+	assert.Equal(t, []webhookLoadBalancer{lb}, received[webhookEventEnsured].LoadBalancers)
+	membersLB := lb
+	membersLB.Members = []string{"vm1"}
+	assert.Equal(t, []webhookLoadBalancer{membersLB}, received[webhookEventMembersChanged].LoadBalancers)
+
+	// Resyncing an unchanged load balancer notifies nothing.
+	cs.updateLBQueue.start(context.Background())
+	_, err = cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), []*corev1.Node{node})
+	cs.updateLBQueue.stopWait()
+	require.NoError(t, err)
+	select {
+	case evt := <-events:
+		t.Errorf("unexpected webhook event %q", evt.Event)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	err = cs.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc)
+	require.NoError(t, err)
+	received = waitEvents(1)
+	deletedLB := lb
+	deletedLB.ProjectID = ""
+	assert.Equal(t, []webhookLoadBalancer{deletedLB}, received[webhookEventDeleted].LoadBalancers)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{
+		webhookEventEnsured:        2,
+		webhookEventMembersChanged: 2,
+		webhookEventDeleted:        2,
+	}, attempts)
+}
@@ -0,0 +1,251 @@
+package cloudstack
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	nodeWeightLabel       = "csccm.cloudprovider.io/loadbalancer-member-weight"
+	memberWeightTagPrefix = "kubernetes_member_weight_"
+
+	eventReasonMemberWeightIgnored = "LoadBalancerMemberWeightIgnored"
+
+	defaultMemberWeight = 1
+)
+
+// memberWeight is the weight of a load balancer member along with the
+// address assigned to the load balancer.
+type memberWeight struct {
+	weight    int
+	ipAddress string
+}
+
+// nodeWeight returns the load balancer member weight set in the node, or 0
+// if the node uses the default weight. Invalid weights are returned as an
+// error along with 0.
+func nodeWeight(node *v1.Node) (int, error) {
+	value, ok := getLabelOrAnnotation(node.ObjectMeta, nodeWeightLabel)
+	if !ok || value == "" {
+		return 0, nil
+	}
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < 1 {
+		return 0, fmt.Errorf("invalid %s %q, expected a positive integer", nodeWeightLabel, value)
+	}
+	return weight, nil
+}
+
+// updateWeight sets the weight of the node, invalid weights are logged once
+// per value instead of on every sync.
+func (n *nodeInfo) updateWeight(node *v1.Node) {
+	var err error
+	n.weight, err = nodeWeight(node)
+	if err == nil {
+		n.weightErr = ""
+		return
+	}
+	if err.Error() != n.weightErr {
+		klog.Errorf("Ignoring member weight for node %q: %v", node.Name, err)
+	}
+	n.weightErr = err.Error()
+}
+
+func weightsForNodes(nodes []nodeInfo) map[string]memberWeight {
+	weights := map[string]memberWeight{}
+	for _, nInfo := range nodes {
+		if nInfo.weight > 0 {
+			weights[nInfo.vmID] = memberWeight{weight: nInfo.weight, ipAddress: nInfo.ipAddress}
+		}
+	}
+	return weights
+}
+
+// weightedMemberParams returns the vmidipmap params assigning the weighted
+// hosts with their weight, the remaining hosts are assigned through
+// virtualmachineids.
+func weightedMemberParams(hostIDs []string, weights map[string]memberWeight) ([]string, hookParams) {
+	var unweighted []string
+	params := hookParams{}
+	for _, hostID := range hostIDs {
+		w, ok := weights[hostID]
+		if !ok || w.weight == defaultMemberWeight || w.ipAddress == "" {
+			unweighted = append(unweighted, hostID)
+			continue
+		}
+		i := len(params) / 3
+		params[fmt.Sprintf("vmidipmap[%d].vmid", i)] = hostID
+		params[fmt.Sprintf("vmidipmap[%d].vmip", i)] = w.ipAddress
+		params[fmt.Sprintf("vmidipmap[%d].weight", i)] = strconv.Itoa(w.weight)
+	}
+	return unweighted, params
+}
+
+// memberWeightTag returns the load balancer rule tag holding the weight
+// applied to a member. Members with the default weight have no tag.
+func memberWeightTag(hostID string) string {
+	return memberWeightTagPrefix + hostID
+}
+
+// memberWeight returns the weight applied to the member according to the
+// load balancer rule tags.
+func (lb *loadBalancer) memberWeight(hostID string) int {
+	value, ok := getTag(lb.rule.Tags, memberWeightTag(hostID))
+	if !ok {
+		return defaultMemberWeight
+	}
+	weight, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultMemberWeight
+	}
+	return weight
+}
+
+// syncWeights updates the weight of the load balancer members whose weight
+// changed, without removing them from the load balancer, using the
+// update-lb-member command or the update-pool-member command on the
+// GloboNetwork pools of the rule. Applied weights are stored as tags in the
+// load balancer rule.
+func (lb *loadBalancer) syncWeights(hostIDs []string, weights map[string]memberWeight) error {
+	// Sort hosts for deterministic API calls easing debugging
+	sortedHostIDs := append([]string(nil), hostIDs...)
+	sort.Strings(sortedHostIDs)
+	var poolIDs map[string][]string
+	for _, hostID := range sortedHostIDs {
+		wanted := defaultMemberWeight
+		if w, ok := weights[hostID]; ok {
+			wanted = w.weight
+		}
+		current := lb.memberWeight(hostID)
+		if wanted == current {
+			continue
+		}
+		klog.V(4).Infof("Updating weight of host %v in load balancer %v from %d to %d", hostID, lb, current, wanted)
+		var err error
+		switch {
+		case lb.cloud.config.Command.UpdateLBMember != "":
+			err = lb.updateMember(hostID, map[string]interface{}{"weight": wanted})
+		case lb.cloud.config.Command.UpdatePoolMember != "" && !lb.internal:
+			if poolIDs == nil {
+				if poolIDs, err = lb.poolIDsByZone(); err != nil {
+					return err
+				}
+			}
+			err = lb.updatePoolMember(poolIDs, hostID, wanted)
+		default:
+			lb.cloud.warnOnce(lb.service, eventReasonMemberWeightIgnored, fmt.Sprintf("Ignoring member weight changes for load balancer %s, no update-lb-member or update-pool-member command configured", lb.name))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = lb.setMemberWeightTag(hostID, wanted); err != nil {
+			return err
+		}
+	}
+	lb.cloud.clearWarning(lb.service, eventReasonMemberWeightIgnored)
+	return nil
+}
+
+// poolIDsByZone returns the IDs of the GloboNetwork pools of the rule keyed
+// by zone.
+func (lb *loadBalancer) poolIDsByZone() (map[string][]string, error) {
+	client, err := lb.getClient()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string][]string{}
+	for _, zoneID := range lb.poolZones() {
+		p := lb.cloud.newCommandParams("listGloboNetworkPools", lb.service)
+		p.SetParam("lbruleid", lb.rule.Id)
+		p.SetParam("zoneid", zoneID)
+		var pools globoNetworkPools
+		if err = client.Custom.CustomRequest("listGloboNetworkPools", p, &pools); err != nil {
+			return nil, fmt.Errorf("error list load balancer pools for %v: %v", lb, err)
+		}
+		for _, pool := range pools.GloboNetworkPools {
+			result[zoneID] = append(result[zoneID], strconv.Itoa(pool.Id))
+		}
+	}
+	return result, nil
+}
+
+// updatePoolMember sets the weight of the member in every pool of the rule
+// using the update-pool-member command.
+func (lb *loadBalancer) updatePoolMember(poolIDs map[string][]string, hostID string, weight int) error {
+	command := lb.cloud.config.Command.UpdatePoolMember
+	client, err := lb.getClient()
+	if err != nil {
+		return err
+	}
+	for _, zoneID := range lb.poolZones() {
+		if len(poolIDs[zoneID]) == 0 {
+			continue
+		}
+		p := lb.cloud.newCommandParams(command, lb.service)
+		p.SetParam("lbruleid", lb.rule.Id)
+		p.SetParam("poolids", strings.Join(poolIDs[zoneID], ","))
+		p.SetParam("zoneid", zoneID)
+		p.SetParam("virtualmachineid", hostID)
+		p.SetParam("weight", weight)
+		if err = lb.applyCommandArgs(command, p); err != nil {
+			return err
+		}
+		var result struct {
+			JobID string `json:"jobid"`
+		}
+		if err = client.Custom.CustomRequest(command, p, &result); err != nil {
+			return fmt.Errorf("error updating member %v of %v pools using cmd %q: %v", hostID, lb, command, err)
+		}
+		if result.JobID != "" {
+			if err = waitJob(client, result.JobID, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (lb *loadBalancer) setMemberWeightTag(hostID string, weight int) error {
+	tag := memberWeightTag(hostID)
+	if weight != defaultMemberWeight {
+		return lb.setRuleTag(tag, strconv.Itoa(weight))
+	}
+	if _, ok := getTag(lb.rule.Tags, tag); !ok {
+		return nil
+	}
+	if err := lb.cloud.deleteResourceTags(CloudstackResourceLoadBalancer, lb.rule.Id, []string{tag}); err != nil {
+		return err
+	}
+	var tags []cloudstack.Tags
+	for _, t := range lb.rule.Tags {
+		if t.Key != tag {
+			tags = append(tags, t)
+		}
+	}
+	lb.rule.Tags = tags
+	return nil
+}
+
+// removeMemberTags removes the weight and drain tags of members removed from
+// the load balancer.
+func (lb *loadBalancer) removeMemberTags(hostIDs []string) error {
+	var tags []string
+	for _, hostID := range hostIDs {
+		for _, tag := range []string{memberWeightTag(hostID), memberDrainTag(hostID)} {
+			if _, ok := getTag(lb.rule.Tags, tag); ok {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return lb.cloud.deleteResourceTags(CloudstackResourceLoadBalancer, lb.rule.Id, tags)
+}
@@ -0,0 +1,312 @@
+package cloudstack
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloudstackFake "github.com/tsuru/custom-cloudstack-ccm/cloudstack/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeFake "k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_nodeWeight(t *testing.T) {
+	tests := []struct {
+		labels      map[string]string
+		annotations map[string]string
+		expected    int
+		expectedErr string
+	}{
+		{expected: 0},
+		{labels: map[string]string{"csccm.cloudprovider.io/loadbalancer-member-weight": "10"}, expected: 10},
+		{annotations: map[string]string{"csccm.cloudprovider.io/loadbalancer-member-weight": "5"}, expected: 5},
+		{annotations: map[string]string{"csccm.cloudprovider.io/loadbalancer-member-weight": "0"}, expectedErr: `invalid csccm.cloudprovider.io/loadbalancer-member-weight "0", expected a positive integer`},
+		{annotations: map[string]string{"csccm.cloudprovider.io/loadbalancer-member-weight": "abc"}, expectedErr: `invalid csccm.cloudprovider.io/loadbalancer-member-weight "abc", expected a positive integer`},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: tt.labels, Annotations: tt.annotations}}
+			weight, err := nodeWeight(node)
+			if tt.expectedErr != "" {
+				assert.EqualError(t, err, tt.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected, weight)
+		})
+	}
+}
+
+func Test_CSCloud_syncMemberWeights(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cfg := &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Command: commandConfig{
+			UpdateLBMember: "updateLBMember",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+			},
+		},
+	}
+	kubeClient := kubeFake.NewSimpleClientset()
+	cs := newTestCSCloud(t, cfg, kubeClient)
+
+	node := func(name, weight string) *corev1.Node {
+		n := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					"my/project-label":  "11111111-2222-3333-4444-555555555555",
+					"environment-label": "env1",
+				},
+			},
+		}
+		if weight != "" {
+			n.Annotations = map[string]string{"csccm.cloudprovider.io/loadbalancer-member-weight": weight}
+		}
+		return n
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+
+	ensure := func(nodes ...*corev1.Node) {
+		srv.Calls = nil
+		cs.updateLBQueue.start(context.Background())
+		lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+		cs.updateLBQueue.stopWait()
+		require.NoError(t, err)
+		svc.Status.LoadBalancer = *lbStatus
+	}
+
+	ensure(node("n1", ""), node("n2", "10"))
+	var assignCalls []cloudstackFake.MockAPICall
+	for _, call := range srv.Calls {
+		assert.NotEqual(t, "updateLBMember", call.Command)
+		if call.Command == "assignToLoadBalancerRule" {
+			assignCalls = append(assignCalls, call)
+		}
+	}
+	require.Len(t, assignCalls, 1)
+	assert.Equal(t, "vm1", assignCalls[0].Params.Get("virtualmachineids"))
+	assert.Equal(t, "vm2", assignCalls[0].Params.Get("vmidipmap[0].vmid"))
+	assert.Equal(t, "192.168.2.10", assignCalls[0].Params.Get("vmidipmap[0].vmip"))
+	assert.Equal(t, "10", assignCalls[0].Params.Get("vmidipmap[0].weight"))
+
+	ensure(node("n1", ""), node("n2", "10"))
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listLoadBalancerRules"},
+		{Command: "listLoadBalancerRuleInstances"},
+	})
+
+	// Applied weights are read from the rule tags after a restart.
+	cs = newTestCSCloud(t, cfg, kubeClient)
+	ensure(node("n1", ""), node("n2", "10"))
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listVirtualMachines"},
+		{Command: "listVirtualMachines"},
+		{Command: "listLoadBalancerRules"},
+		{Command: "listNetworks"},
+		{Command: "listLoadBalancerRuleInstances"},
+	})
+
+	ensure(node("n1", "3"), node("n2", ""))
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listLoadBalancerRules"},
+		{Command: "listLoadBalancerRuleInstances"},
+		{Command: "updateLBMember", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineid": []string{"vm1"}, "weight": []string{"3"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_member_weight_vm1"}, "tags[0].value": []string{"3"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "updateLBMember", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineid": []string{"vm2"}, "weight": []string{"1"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "deleteTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_member_weight_vm2"}}},
+		{Command: "queryAsyncJobResult"},
+	})
+
+	ensure(node("n2", ""))
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listLoadBalancerRules"},
+		{Command: "listLoadBalancerRuleInstances"},
+		{Command: "removeFromLoadBalancerRule", Params: url.Values{"id": []string{"lbrule-1"}, "virtualmachineids": []string{"vm1"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "deleteTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_member_weight_vm1"}}},
+		{Command: "queryAsyncJobResult"},
+	})
+}
+
+func Test_CSCloud_syncMemberWeightsWithoutCommand(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+			},
+		},
+	}, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{"csccm.cloudprovider.io/loadbalancer-member-weight": "10"},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+	ensure := func() {
+		srv.Calls = nil
+		cs.updateLBQueue.start(context.Background())
+		lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*corev1.Node{node})
+		cs.updateLBQueue.stopWait()
+		require.NoError(t, err)
+		svc.Status.LoadBalancer = *lbStatus
+	}
+
+	ensure()
+	var assign cloudstackFake.MockAPICall
+	for _, call := range srv.Calls {
+		if call.Command == "assignToLoadBalancerRule" {
+			assign = call
+		}
+	}
+	assert.Equal(t, "vm1", assign.Params.Get("vmidipmap[0].vmid"))
+	assert.Equal(t, "10", assign.Params.Get("vmidipmap[0].weight"))
+
+	node.Annotations["csccm.cloudprovider.io/loadbalancer-member-weight"] = "5"
+	ensure()
+	ensure()
+	time.Sleep(200 * time.Millisecond)
+	var ignoredEvents int
+	globalTestEvents.Lock()
+	for _, evt := range globalTestEvents.events {
+		if strings.Contains(evt, "Ignoring member weight changes for load balancer svc1.test.com, no update-lb-member or update-pool-member command configured") {
+			ignoredEvents++
+		}
+	}
+	globalTestEvents.Unlock()
+	assert.Equal(t, 1, ignoredEvents)
+}
+
+func Test_CSCloud_syncMemberWeightsInPools(t *testing.T) {
+	srv := cloudstackFake.NewCloudstackServer()
+	defer srv.Close()
+	cs := newTestCSCloud(t, &CSConfig{
+		Global: globalConfig{
+			EnvironmentLabel: "environment-label",
+			ProjectIDLabel:   "my/project-label",
+		},
+		Command: commandConfig{
+			UpdatePoolMember: "updateGloboNetworkPoolMember",
+		},
+		Environment: map[string]*environmentConfig{
+			"env1": {
+				APIURL:          srv.URL,
+				APIKey:          "a",
+				SecretKey:       "b",
+				LBEnvironmentID: "1",
+				LBDomain:        "test.com",
+			},
+		},
+	}, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "n1",
+			Labels: map[string]string{
+				"my/project-label":  "11111111-2222-3333-4444-555555555555",
+				"environment-label": "env1",
+			},
+			Annotations: map[string]string{},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "myns",
+			Labels: map[string]string{
+				"environment-label": "env1",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8080, NodePort: 30001, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	_, err := cs.kubeClient.CoreV1().Services(svc.Namespace).Create(svc)
+	require.NoError(t, err)
+	ensure := func() {
+		srv.Calls = nil
+		cs.updateLBQueue.start(context.Background())
+		lbStatus, err := cs.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*corev1.Node{node})
+		cs.updateLBQueue.stopWait()
+		require.NoError(t, err)
+		svc.Status.LoadBalancer = *lbStatus
+	}
+
+	ensure()
+	node.Annotations["csccm.cloudprovider.io/loadbalancer-member-weight"] = "3"
+	ensure()
+	srv.HasCalls(t, []cloudstackFake.MockAPICall{
+		{Command: "listLoadBalancerRules"},
+		{Command: "listLoadBalancerRuleInstances"},
+		{Command: "listGloboNetworkPools", Params: url.Values{"lbruleid": []string{"lbrule-1"}}},
+		{Command: "updateGloboNetworkPoolMember", Params: url.Values{"lbruleid": []string{"lbrule-1"}, "poolids": []string{"0"}, "virtualmachineid": []string{"vm1"}, "weight": []string{"3"}}},
+		{Command: "queryAsyncJobResult"},
+		{Command: "createTags", Params: url.Values{"resourceids": []string{"lbrule-1"}, "tags[0].key": []string{"kubernetes_member_weight_vm1"}, "tags[0].value": []string{"3"}}},
+		{Command: "queryAsyncJobResult"},
+	})
+}
@@ -3,7 +3,10 @@ package cloudstack
 import (
 	"context"
 	"fmt"
+	"sort"
 
+	"github.com/xanzy/go-cloudstack/v2/cloudstack"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog"
@@ -14,7 +17,66 @@ import (
 // For the case of external cloud providers, use GetZoneByProviderID or GetZoneByNodeName since GetZone
 // can no longer be called from the kubelets.
 func (cs *CSCloud) GetZone(ctx context.Context) (cloudprovider.Zone, error) {
-	return cloudprovider.Zone{}, nil
+	klog.V(4).Infof("GetZone()")
+	zone := cloudprovider.Zone{}
+	if cs.metadata == nil {
+		return zone, nil
+	}
+	zoneName, err := cs.metadata.availabilityZone(ctx)
+	if err != nil {
+		return zone, err
+	}
+	if zoneName == "" {
+		// Some virtual routers don't report the availability zone, in this
+		// case we fallback to looking up the current instance by its ID.
+		zoneName, err = cs.zoneForCurrentInstance(ctx)
+		if err != nil {
+			return zone, err
+		}
+	}
+	klog.V(2).Infof("Current zone is %v", zoneName)
+	zone.FailureDomain = zoneName
+	zone.Region = zoneName
+	return zone, nil
+}
+
+// zoneForCurrentInstance returns the zone of the instance reported by the
+// metadata service. The metadata has no environment, the instance is looked
+// up in every environment and must be found in exactly one of them.
+func (cs *CSCloud) zoneForCurrentInstance(ctx context.Context) (string, error) {
+	instanceID, err := cs.metadata.instanceID(ctx)
+	if err != nil {
+		return "", err
+	}
+	environments := make([]string, 0, len(cs.environments))
+	for environment := range cs.environments {
+		environments = append(environments, environment)
+	}
+	sort.Strings(environments)
+	var zoneName, foundIn string
+	var found bool
+	for _, environment := range environments {
+		client, err := cs.clientForEnvironment(environment)
+		if err != nil {
+			return "", err
+		}
+		projectID, _ := cs.projectForMeta(metav1.ObjectMeta{}, environment)
+		instance, count, err := client.VirtualMachine.GetVirtualMachineByID(instanceID, cloudstack.WithProject(projectID))
+		if count == 0 {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("error retrieving instance %q in environment %q: %v", instanceID, environment, err)
+		}
+		if found {
+			return "", fmt.Errorf("instance %q found in environments %q and %q, unable to resolve its zone", instanceID, foundIn, environment)
+		}
+		zoneName, foundIn, found = instance.Zonename, environment, true
+	}
+	if !found {
+		return "", cloudprovider.InstanceNotFound
+	}
+	return zoneName, nil
 }
 
 // GetZoneByProviderID returns the Zone containing the current zone and locality region of the node specified by providerId
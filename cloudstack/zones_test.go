@@ -111,3 +111,126 @@ func TestCSCloudGetZoneByProviderID(t *testing.T) {
 		Region:        "myzone",
 	}, zone)
 }
+
+func TestCSCloudGetZoneWithMetadata(t *testing.T) {
+	metadataSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/meta-data/availability-zone" {
+			w.Write([]byte("myzone\n"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer metadataSrv.Close()
+	cs := &CSCloud{
+		environments: map[string]CSEnvironment{
+			"": {},
+		},
+		metadata: newMetadataClient(metadataSrv.URL + "/"),
+	}
+	zone, err := cs.GetZone(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, cloudprovider.Zone{
+		FailureDomain: "myzone",
+		Region:        "myzone",
+	}, zone)
+}
+
+func TestCSCloudGetZoneWithMetadataFallbackToInstanceID(t *testing.T) {
+	metadataSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/meta-data/availability-zone":
+		case "/latest/meta-data/instance-id":
+			w.Write([]byte("machineid1"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer metadataSrv.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cmd := r.URL.Query().Get("command")
+		if cmd == "listVirtualMachines" {
+			assert.Equal(t, "machineid1", r.URL.Query().Get("id"))
+			w.Write([]byte(fmt.Sprintf(`{"%s": {"count": 1, "virtualmachine": [{"id": "machineid1", "name": "mynode", "zonename": "otherzone"}]}}`, cmd)))
+		}
+	}))
+	defer srv.Close()
+	cs := &CSCloud{
+		environments: map[string]CSEnvironment{
+			"": {
+				client: cloudstack.NewAsyncClient(srv.URL, "", "", true),
+			},
+		},
+		metadata: newMetadataClient(metadataSrv.URL),
+	}
+	zone, err := cs.GetZone(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, cloudprovider.Zone{
+		FailureDomain: "otherzone",
+		Region:        "otherzone",
+	}, zone)
+}
+
+func TestCSCloudGetZoneWithMetadataMultipleEnvironments(t *testing.T) {
+	metadataSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/meta-data/availability-zone":
+		case "/latest/meta-data/instance-id":
+			w.Write([]byte("machineid1"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer metadataSrv.Close()
+	newSrv := func(zone string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cmd := r.URL.Query().Get("command")
+			if cmd != "listVirtualMachines" {
+				return
+			}
+			if zone == "" {
+				w.Write([]byte(fmt.Sprintf(`{"%s": {"count": 0, "virtualmachine": []}}`, cmd)))
+				return
+			}
+			w.Write([]byte(fmt.Sprintf(`{"%s": {"count": 1, "virtualmachine": [{"id": "machineid1", "name": "mynode", "zonename": %q}]}}`, cmd, zone)))
+		}))
+	}
+	srv1 := newSrv("")
+	defer srv1.Close()
+	srv2 := newSrv("zone2")
+	defer srv2.Close()
+	srv3 := newSrv("zone3")
+	defer srv3.Close()
+	cs := &CSCloud{
+		environments: map[string]CSEnvironment{
+			"env1": {client: cloudstack.NewAsyncClient(srv1.URL, "", "", true)},
+			"env2": {client: cloudstack.NewAsyncClient(srv2.URL, "", "", true)},
+		},
+		metadata: newMetadataClient(metadataSrv.URL),
+	}
+	zone, err := cs.GetZone(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, cloudprovider.Zone{
+		FailureDomain: "zone2",
+		Region:        "zone2",
+	}, zone)
+
+	cs.environments["env3"] = CSEnvironment{client: cloudstack.NewAsyncClient(srv3.URL, "", "", true)}
+	_, err = cs.GetZone(context.Background())
+	assert.EqualError(t, err, `instance "machineid1" found in environments "env2" and "env3", unable to resolve its zone`)
+}
+
+func TestCSCloudGetZoneWithMetadataError(t *testing.T) {
+	metadataSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("my error"))
+	}))
+	defer metadataSrv.Close()
+	cs := &CSCloud{
+		environments: map[string]CSEnvironment{
+			"": {},
+		},
+		metadata: newMetadataClient(metadataSrv.URL),
+	}
+	_, err := cs.GetZone(context.Background())
+	assert.EqualError(t, err, `invalid status code querying metadata "availability-zone": 500 - my error`)
+}
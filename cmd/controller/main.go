@@ -9,8 +9,9 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
-	_ "github.com/tsuru/custom-cloudstack-ccm/cloudstack"
+	"github.com/tsuru/custom-cloudstack-ccm/cloudstack"
 	"k8s.io/apiserver/pkg/server/healthz"
 	"k8s.io/component-base/logs"
 	"k8s.io/kubernetes/cmd/cloud-controller-manager/app"
@@ -39,6 +40,25 @@ func main() {
 		}
 	})
 
+	var webhookAddr, webhookCertFile, webhookKeyFile string
+	command.Flags().StringVar(&webhookAddr, "admission-webhook-bind-address", "", "Address serving the validating admission webhook for services, disabled if empty.")
+	command.Flags().StringVar(&webhookCertFile, "admission-webhook-tls-cert-file", "", "TLS certificate of the admission webhook.")
+	command.Flags().StringVar(&webhookKeyFile, "admission-webhook-tls-key-file", "", "TLS private key of the admission webhook.")
+	command.PreRun = func(cmd *cobra.Command, args []string) {
+		if webhookAddr == "" {
+			return
+		}
+		if webhookCertFile == "" || webhookKeyFile == "" {
+			fmt.Fprintln(os.Stderr, "admission webhook requires --admission-webhook-tls-cert-file and --admission-webhook-tls-key-file")
+			os.Exit(1)
+		}
+		go func() {
+			err := cloudstack.ServeAdmissionWebhook(webhookAddr, webhookCertFile, webhookKeyFile)
+			fmt.Fprintf(os.Stderr, "admission webhook failed: %v\n", err)
+			os.Exit(1)
+		}()
+	}
+
 	logs.InitLogs()
 	defer logs.FlushLogs()
 